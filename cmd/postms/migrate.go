@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/willdady/postms/internal/postms/postgres"
+)
+
+// runMigrateCommand implements the migrate subcommand, which applies, reverts
+// or lists the schema migrations.
+func runMigrateCommand(args []string) {
+	if backend != "postgres" {
+		log.Fatalf("The migrate command requires the postgres backend, not %q.\n", backend)
+	}
+	if len(args) == 0 {
+		log.Fatalln("Expected a migrate command of \"up\", \"down\" or \"status\".")
+	}
+	db, err := connectToDB(0)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "up":
+		applied, err := postgres.MigrateUp(db)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		for _, migration := range applied {
+			log.Printf("Applied migration %d_%s.\n", migration.Version, migration.Name)
+		}
+		if len(applied) == 0 {
+			log.Println("No pending migrations.")
+		}
+	case "down":
+		flags := flag.NewFlagSet("migrate down", flag.ExitOnError)
+		steps := flags.Int("steps", 1, "number of migrations to revert")
+		flags.Parse(args[1:])
+		if *steps <= 0 {
+			log.Fatalln("Steps must be at least 1.")
+		}
+		reverted, err := postgres.MigrateDown(db, *steps)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		for _, migration := range reverted {
+			log.Printf("Reverted migration %d_%s.\n", migration.Version, migration.Name)
+		}
+		if len(reverted) == 0 {
+			log.Println("No applied migrations.")
+		}
+	case "status":
+		statuses, err := postgres.MigrationStatuses(db)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt != nil {
+				appliedAt = status.AppliedAt.Format("2006-01-02 15:04:05 MST")
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", status.Version, status.Name, appliedAt)
+		}
+		w.Flush()
+	default:
+		log.Fatalf("Unknown migrate command %q. Expected \"up\", \"down\" or \"status\".\n", args[0])
+	}
+}
@@ -2,26 +2,35 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"log"
+	"os"
 	"time"
-	"fmt"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 	"github.com/willdady/postms/internal/postms/handlers"
-	"github.com/willdady/postms/internal/postms/models"
+	"github.com/willdady/postms/internal/postms/memory"
 	"github.com/willdady/postms/internal/postms/postgres"
+	"github.com/willdady/postms/internal/postms/services"
 	"github.com/willdady/postms/internal/rest"
 	"github.com/willdady/postms/internal/utils"
 )
 
+var backend string = utils.Getenv("BACKEND", "postgres")
 var pgHost string = utils.Getenv("PG_HOST", "0.0.0.0")
 var pgPort string = utils.Getenv("PG_PORT", "5432")
 var pgUser string = utils.Getenv("PG_USER", "postgres")
 var pgDB string = utils.Getenv("PG_DB", "postgres")
 var pgPassword string = utils.Getenv("PG_PASSWORD", "mysecretpassword")
 var pgSSLMode string = utils.Getenv("PG_SSL_MODE", "disable")
+var publishInterval string = utils.Getenv("PUBLISH_INTERVAL", "30s")
+var retentionDays string = utils.Getenv("RETENTION_DAYS", "0")
+var purgeInterval string = utils.Getenv("PURGE_INTERVAL", "1h")
+var purgeBatchSize string = utils.Getenv("PURGE_BATCH_SIZE", "500")
+var autoMigrate string = utils.Getenv("AUTO_MIGRATE", "true")
+var idempotencyTTL string = utils.Getenv("IDEMPOTENCY_TTL", "24h")
 var dbConnectionString = fmt.Sprintf("host=%v port=%v user=%v dbname=%v password=%v sslmode=%v", pgHost, pgPort, pgUser, pgDB, pgPassword, pgSSLMode)
 
 func connectToDB(retry int) (db *gorm.DB, err error) {
@@ -42,47 +51,138 @@ func connectToDB(retry int) (db *gorm.DB, err error) {
 
 var resources = rest.ResourceMap{
 	"posts": rest.ActionMap{
-		"create":        handlers.CreatePost,
-		"detail":        handlers.GetPost,
-		"list":          handlers.GetPosts,
-		"update":        handlers.UpdatePost,
-		"delete":        handlers.DeletePost,
-		"*/comments":    handlers.GetPostCommentsForPost,
-		"*/total-votes": handlers.GetPostVoteTotalForPost,
-		"*/voted-users": handlers.GetPostVoteUsersForPost,
-		"*/saves":       handlers.GetPostSaves,
+		"create":           handlers.CreatePost,
+		"detail":           handlers.GetPost,
+		"list":             handlers.GetPosts,
+		"update":           handlers.UpdatePost,
+		"patch":            handlers.PatchPost,
+		"delete":           handlers.DeletePost,
+		"by-slug/*":        handlers.GetPostBySlug,
+		"*/comments":       handlers.GetPostCommentsForPost,
+		"*/total-votes":    handlers.GetPostVoteTotalForPost,
+		"*/voted-users":    handlers.GetPostVoteUsersForPost,
+		"*/saves":          handlers.GetPostSaves,
+		"*/revisions":      handlers.GetPostRevisions,
+		"POST */publish":   handlers.PublishPost,
+		"POST */unpublish": handlers.UnpublishPost,
+		"POST */schedule":  handlers.SchedulePost,
+		"POST */restore":   handlers.RestorePost,
+		"POST */archive":   handlers.ArchivePost,
+	},
+	"post-revisions": rest.ActionMap{
+		"detail":         handlers.GetPostRevision,
+		"*/diff":         handlers.GetPostRevisionDiff,
+		"POST */restore": handlers.RestorePostRevision,
 	},
 	"post-votes": rest.ActionMap{
 		"create": handlers.CreatePostVote,
+		"delete": handlers.DeletePostVote,
 	},
 	"post-saves": rest.ActionMap{
 		"create": handlers.CreatePostSave,
 		"delete": handlers.DeletePostSave,
 	},
 	"comments": rest.ActionMap{
-		"create": handlers.CreatePostComment,
-		"delete": handlers.DeletePostComment,
-		"update": handlers.UpdatePostComment,
-		"detail": handlers.GetPostComment,
+		"create":         handlers.CreatePostComment,
+		"delete":         handlers.DeletePostComment,
+		"update":         handlers.UpdatePostComment,
+		"patch":          handlers.PatchPostComment,
+		"detail":         handlers.GetPostComment,
+		"*/revisions":    handlers.GetPostCommentRevisions,
+		"POST */restore": handlers.RestorePostComment,
+		"*/total-votes":  handlers.GetPostCommentVoteTotalForPostComment,
+		"*/voted-users":  handlers.GetPostCommentVoteUsersForPostComment,
+	},
+	"comment-votes": rest.ActionMap{
+		"create": handlers.CreatePostCommentVote,
+		"delete": handlers.DeletePostCommentVote,
 	},
 	"tags": rest.ActionMap{
 		"list": handlers.GetTags,
 	},
+	"search": rest.ActionMap{
+		"list": handlers.Search,
+	},
+	"trash": rest.ActionMap{
+		"list": handlers.GetTrash,
+	},
+}
+
+// cacheControls are the Cache-Control headers sent with successful reads.
+// Posts and comments change often, so caches must revalidate them, which is
+// cheap as unchanged responses are answered with 304 Not Modified.
+var cacheControls = rest.CacheMap{
+	"posts":    "public, no-cache",
+	"comments": "public, no-cache",
+	"tags":     "public, max-age=60",
+}
+
+// openPostService connects to the configured backend, returning the service,
+// the store of idempotency keys and a function which releases their
+// resources.
+func openPostService() (services.PostService, services.IdempotencyStore, func()) {
+	switch backend {
+	case "postgres":
+		db, err := connectToDB(0)
+		if err != nil {
+			panic(err)
+		}
+
+		if autoMigrate == "true" {
+			if err := postgres.Migrate(db); err != nil {
+				panic(err)
+			}
+		}
+
+		return postgres.NewPostService(db), postgres.NewIdempotencyStore(db), func() { db.Close() }
+	case "memory":
+		log.Println("Using in-memory backend. Data will be lost on exit.")
+		return memory.NewPostService(), memory.NewIdempotencyStore(), func() {}
+	default:
+		log.Fatalf("Unknown backend %q. Expected \"postgres\" or \"memory\".\n", backend)
+	}
+	return nil, nil, nil
 }
 
 func main() {
-	db, err := connectToDB(0)
-	if err != nil {
-		panic(err)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrateCommand(os.Args[2:])
+		return
+	}
+
+	postService, idempotencyStore, closePostService := openPostService()
+	defer closePostService()
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "purge":
+			runPurgeCommand(postService, os.Args[2:])
+		default:
+			log.Fatalf("Unknown command %q. Expected \"purge\" or \"migrate\".\n", os.Args[1])
+		}
+		return
 	}
-	defer db.Close()
 
-	db.AutoMigrate(&models.Post{})
-	db.AutoMigrate(&models.PostComment{})
-	db.AutoMigrate(&models.PostVote{})
-	db.AutoMigrate(&models.PostSave{})
+	interval, err := time.ParseDuration(publishInterval)
+	if err != nil || interval <= 0 {
+		log.Fatalf("Invalid PUBLISH_INTERVAL %q.\n", publishInterval)
+	}
+	go runScheduledPublisher(postService, interval)
 
-	postService := postgres.NewPostService(db)
+	if days, batchSize := retentionConfig(); days > 0 {
+		interval, err := time.ParseDuration(purgeInterval)
+		if err != nil || interval <= 0 {
+			log.Fatalf("Invalid PURGE_INTERVAL %q.\n", purgeInterval)
+		}
+		go runRetentionPurger(postService, days, batchSize, interval)
+	}
+
+	ttl, err := time.ParseDuration(idempotencyTTL)
+	if err != nil || ttl <= 0 {
+		log.Fatalf("Invalid IDEMPOTENCY_TTL %q.\n", idempotencyTTL)
+	}
+	rest.UseIdempotencyStore(idempotencyStore, ttl)
+	go runIdempotencyKeyPurger(idempotencyStore, ttl, time.Hour)
 
 	r := gin.Default()
 
@@ -91,7 +191,7 @@ func main() {
 		c.Next()
 	})
 
-	rest.AttachEndpoints(resources, r)
+	rest.AttachEndpoints(resources, cacheControls, r)
 
 	r.Run() // listen and serve on 0.0.0.0:8080
 }
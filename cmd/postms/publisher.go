@@ -0,0 +1,25 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/willdady/postms/internal/postms/services"
+)
+
+// runScheduledPublisher publishes scheduled posts once they are due, checking
+// every interval. It never returns. Every replica runs a publisher, the
+// PostService ensures each post is only published once.
+func runScheduledPublisher(postService services.PostService, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		count, err := postService.PublishScheduledPosts(time.Now())
+		if err != nil {
+			log.Printf("Failed to publish scheduled posts: %v\n", err)
+		} else if count > 0 {
+			log.Printf("Published %d scheduled posts.\n", count)
+		}
+		<-ticker.C
+	}
+}
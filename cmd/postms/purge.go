@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/willdady/postms/internal/postms/services"
+)
+
+// retentionConfig returns the number of days deleted rows are kept for, 0
+// meaning forever, and the number of rows purged per transaction.
+func retentionConfig() (days int, batchSize int) {
+	days, err := strconv.Atoi(retentionDays)
+	if err != nil || days < 0 {
+		log.Fatalf("Invalid RETENTION_DAYS %q.\n", retentionDays)
+	}
+	batchSize, err = strconv.Atoi(purgeBatchSize)
+	if err != nil || batchSize <= 0 {
+		log.Fatalf("Invalid PURGE_BATCH_SIZE %q.\n", purgeBatchSize)
+	}
+	return days, batchSize
+}
+
+// purgeExpired permanently deletes rows which were deleted more than days ago.
+func purgeExpired(postService services.PostService, days int, batchSize int) (services.PurgeReport, error) {
+	before := time.Now().AddDate(0, 0, -days)
+	return postService.PurgeDeleted(before, batchSize)
+}
+
+// runPurgeCommand implements the purge subcommand, which purges expired rows
+// once and reports what it removed.
+func runPurgeCommand(postService services.PostService, args []string) {
+	days, batchSize := retentionConfig()
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	flags.IntVar(&days, "days", days, "purge rows deleted more than this many days ago")
+	flags.IntVar(&batchSize, "batch-size", batchSize, "maximum number of rows to delete per transaction")
+	flags.Parse(args)
+	if days <= 0 || batchSize <= 0 {
+		log.Fatalln("Retention must be at least 1 day. Set RETENTION_DAYS or pass -days.")
+	}
+	report, err := purgeExpired(postService, days, batchSize)
+	if err != nil {
+		log.Fatalf("Purge failed after removing %v: %v\n", report, err)
+	}
+	log.Printf("Purged %v.\n", report)
+}
+
+// runRetentionPurger purges expired rows every interval. It never returns.
+func runRetentionPurger(postService services.PostService, days int, batchSize int, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		report, err := purgeExpired(postService, days, batchSize)
+		if err != nil {
+			log.Printf("Failed to purge deleted rows after removing %v: %v\n", report, err)
+		} else if report != (services.PurgeReport{}) {
+			log.Printf("Purged %v.\n", report)
+		}
+		<-ticker.C
+	}
+}
+
+// runIdempotencyKeyPurger removes expired idempotency keys every interval. It
+// never returns.
+func runIdempotencyKeyPurger(store services.IdempotencyStore, ttl time.Duration, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		count, err := store.DeleteExpired(time.Now().Add(-ttl))
+		if err != nil {
+			log.Printf("Failed to remove expired idempotency keys: %v\n", err)
+		} else if count > 0 {
+			log.Printf("Removed %d expired idempotency keys.\n", count)
+		}
+		<-ticker.C
+	}
+}
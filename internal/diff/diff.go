@@ -0,0 +1,167 @@
+package diff
+
+import (
+	"sort"
+	"strings"
+)
+
+// Op is the operation which turns one side of a diff into the other.
+type Op string
+
+const (
+	Equal  Op = "equal"
+	Insert Op = "insert"
+	Delete Op = "delete"
+)
+
+// Line is a single line of a diff.
+type Line struct {
+	Op   Op     `json:"op"`
+	Text string `json:"text"`
+}
+
+// Lines returns the line-by-line difference between a and b.
+func Lines(a string, b string) []Line {
+	return Strings(splitLines(a), splitLines(b))
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, "\n")
+}
+
+// Strings returns the shortest edit script turning a into b, computed with
+// the linear space variant of Myers' algorithm. Deletions are ordered before
+// insertions where both apply.
+func Strings(a []string, b []string) []Line {
+	lines := diffStrings(a, b, make([]Line, 0, len(a)+len(b)))
+	// Move the deletions of each run of changes before its insertions
+	for i := 0; i < len(lines); {
+		if lines[i].Op == Equal {
+			i++
+			continue
+		}
+		j := i
+		for j < len(lines) && lines[j].Op != Equal {
+			j++
+		}
+		sort.SliceStable(lines[i:j], func(x, y int) bool {
+			return lines[i+x].Op == Delete && lines[i+y].Op == Insert
+		})
+		i = j
+	}
+	return lines
+}
+
+// diffStrings appends the edit script turning a into b to lines. Common
+// prefixes and suffixes are matched directly, and what remains is split on
+// the middle of its shortest edit script, found by bisect, and diffed in two
+// halves.
+func diffStrings(a []string, b []string, lines []Line) []Line {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		lines = append(lines, Line{Op: Equal, Text: a[prefix]})
+		prefix++
+	}
+	a, b = a[prefix:], b[prefix:]
+	suffix := 0
+	for suffix < len(a) && suffix < len(b) && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	common := a[len(a)-suffix:]
+	a, b = a[:len(a)-suffix], b[:len(b)-suffix]
+	if x, y, ok := bisect(a, b); ok {
+		lines = diffStrings(a[:x], b[:y], lines)
+		lines = diffStrings(a[x:], b[y:], lines)
+	} else {
+		for _, text := range a {
+			lines = append(lines, Line{Op: Delete, Text: text})
+		}
+		for _, text := range b {
+			lines = append(lines, Line{Op: Insert, Text: text})
+		}
+	}
+	for _, text := range common {
+		lines = append(lines, Line{Op: Equal, Text: text})
+	}
+	return lines
+}
+
+// bisect finds a point (x, y) on a shortest edit script turning a into b,
+// other than its start and end, by following the furthest reaching paths
+// forwards from the start and backwards from the end until they meet. Only
+// the current path ends are kept for each diagonal, so memory is linear in
+// the length of a and b. It returns false when either is empty, as there is
+// nothing to split.
+func bisect(a []string, b []string) (int, int, bool) {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return 0, 0, false
+	}
+	maxD := (n + m + 1) / 2
+	// vf and vb hold the furthest x reached forwards and backwards on each
+	// diagonal k, offset by maxD, or -1 if it has not been reached
+	vf := make([]int, 2*maxD+2)
+	vb := make([]int, 2*maxD+2)
+	for i := range vf {
+		vf[i], vb[i] = -1, -1
+	}
+	vf[maxD+1], vb[maxD+1] = 0, 0
+	delta := n - m
+	// When delta is odd the paths meet while extending the forward path,
+	// otherwise while extending the backward path
+	forward := delta%2 != 0
+	// Diagonals are trimmed from the search once their paths leave the grid
+	kfStart, kfEnd, kbStart, kbEnd := 0, 0, 0, 0
+	for d := 0; d < maxD; d++ {
+		for k := -d + kfStart; k <= d-kfEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && vf[maxD+k-1] < vf[maxD+k+1]) {
+				x = vf[maxD+k+1]
+			} else {
+				x = vf[maxD+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			vf[maxD+k] = x
+			if x > n {
+				kfEnd += 2
+			} else if y > m {
+				kfStart += 2
+			} else if forward {
+				if i := maxD + delta - k; i >= 0 && i < len(vb) && vb[i] != -1 && x >= n-vb[i] {
+					return x, y, true
+				}
+			}
+		}
+		for k := -d + kbStart; k <= d-kbEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && vb[maxD+k-1] < vb[maxD+k+1]) {
+				x = vb[maxD+k+1]
+			} else {
+				x = vb[maxD+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n-x-1] == b[m-y-1] {
+				x++
+				y++
+			}
+			vb[maxD+k] = x
+			if x > n {
+				kbEnd += 2
+			} else if y > m {
+				kbStart += 2
+			} else if !forward {
+				if i := maxD + delta - k; i >= 0 && i < len(vf) && vf[i] != -1 && vf[i] >= n-x {
+					return vf[i], vf[i] - (delta - k), true
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,49 @@
+package diff
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestLines(t *testing.T) {
+	tests := []struct {
+		a    string
+		b    string
+		want []Line
+	}{
+		{"", "", []Line{}},
+		{"a", "a", []Line{{Equal, "a"}}},
+		{"", "a\nb", []Line{{Insert, "a"}, {Insert, "b"}}},
+		{"a\nb", "", []Line{{Delete, "a"}, {Delete, "b"}}},
+		{"a\nb\nc", "a\nc", []Line{{Equal, "a"}, {Delete, "b"}, {Equal, "c"}}},
+		{"a\nc", "a\nb\nc", []Line{{Equal, "a"}, {Insert, "b"}, {Equal, "c"}}},
+		{"a\nb\nc", "a\nx\ny\nc", []Line{{Equal, "a"}, {Delete, "b"}, {Insert, "x"}, {Insert, "y"}, {Equal, "c"}}},
+		{"a\nb\nc\nd", "b\nx\nd\ne", []Line{{Delete, "a"}, {Equal, "b"}, {Delete, "c"}, {Insert, "x"}, {Equal, "d"}, {Insert, "e"}}},
+		{"x\ny", "y\nx", []Line{{Delete, "x"}, {Equal, "y"}, {Insert, "x"}}},
+	}
+	for _, tt := range tests {
+		if got := Lines(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Lines(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestStringsLarge(t *testing.T) {
+	// Every line differs, the worst case for the edit distance
+	a := make([]string, 5000)
+	b := make([]string, 5000)
+	for i := range a {
+		a[i] = "a" + strconv.Itoa(i)
+		b[i] = "b" + strconv.Itoa(i)
+	}
+	b[2500] = a[2500]
+	lines := Strings(a, b)
+	counts := map[Op]int{}
+	for _, line := range lines {
+		counts[line.Op]++
+	}
+	if want := (map[Op]int{Equal: 1, Delete: 4999, Insert: 4999}); !reflect.DeepEqual(counts, want) {
+		t.Errorf("expected %v, got %v", want, counts)
+	}
+}
@@ -1,19 +1,298 @@
+// Package errors defines the errors returned by services and handlers which
+// are shown to clients. Each is of one of the kinds below, which decides the
+// HTTP status it is sent with, and has a stable code clients may rely on.
+//
+// Kinds may be returned directly, setting Code and Message, or embedded by a
+// more specific error which overrides Error and ErrorCode. Errors which are
+// not of this package are reported as internal server errors.
 package errors
 
-type NotFound struct{}
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Error is implemented by every error of this package.
+type Error interface {
+	error
+	// StatusCode returns the HTTP status the error is sent with.
+	StatusCode() int
+	// ErrorCode returns a stable, machine readable identifier of the error.
+	ErrorCode() string
+}
+
+// orDefault returns value, or fallback if it is empty.
+func orDefault(value string, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// BadRequest is a request which can not be understood, such as a malformed
+// body.
+type BadRequest struct {
+	Code    string
+	Message string
+}
+
+func (err *BadRequest) Error() string {
+	return orDefault(err.Message, "Bad request")
+}
+
+func (err *BadRequest) StatusCode() int {
+	return http.StatusBadRequest
+}
+
+func (err *BadRequest) ErrorCode() string {
+	return orDefault(err.Code, "bad_request")
+}
+
+// FieldError describes why a field of the body or a query parameter is
+// invalid.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Validation is a request with invalid fields.
+type Validation struct {
+	Fields []FieldError
+}
+
+// InvalidField returns a Validation error for a single field.
+func InvalidField(field string, code string, message string) *Validation {
+	return &Validation{Fields: []FieldError{{Field: field, Code: code, Message: message}}}
+}
+
+func (err *Validation) Error() string {
+	if len(err.Fields) == 0 {
+		return "Validation failed"
+	}
+	messages := make([]string, len(err.Fields))
+	for i, field := range err.Fields {
+		messages[i] = field.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (err *Validation) StatusCode() int {
+	return http.StatusBadRequest
+}
+
+func (err *Validation) ErrorCode() string {
+	return "validation_failed"
+}
+
+// Forbidden is a request the user is not allowed to make.
+type Forbidden struct {
+	Code    string
+	Message string
+}
+
+func (err *Forbidden) Error() string {
+	return orDefault(err.Message, "Forbidden")
+}
+
+func (err *Forbidden) StatusCode() int {
+	return http.StatusForbidden
+}
+
+func (err *Forbidden) ErrorCode() string {
+	return orDefault(err.Code, "forbidden")
+}
+
+// NotFound is a request for a resource which does not exist or which the user
+// is not allowed to see.
+type NotFound struct {
+	Code    string
+	Message string
+}
 
 func (err *NotFound) Error() string {
-	return "Not found"
+	return orDefault(err.Message, "Not found")
+}
+
+func (err *NotFound) StatusCode() int {
+	return http.StatusNotFound
+}
+
+func (err *NotFound) ErrorCode() string {
+	return orDefault(err.Code, "not_found")
+}
+
+// Conflict is a request which conflicts with the current state of a resource.
+type Conflict struct {
+	Code    string
+	Message string
+}
+
+func (err *Conflict) Error() string {
+	return orDefault(err.Message, "Conflict")
 }
 
-type DeleteIsMissingID struct{}
+func (err *Conflict) StatusCode() int {
+	return http.StatusConflict
+}
+
+func (err *Conflict) ErrorCode() string {
+	return orDefault(err.Code, "conflict")
+}
+
+// PreconditionFailed is a request whose preconditions, such as If-Match, do
+// not hold.
+type PreconditionFailed struct {
+	Code    string
+	Message string
+}
+
+func (err *PreconditionFailed) Error() string {
+	return orDefault(err.Message, "Precondition failed")
+}
+
+func (err *PreconditionFailed) StatusCode() int {
+	return http.StatusPreconditionFailed
+}
+
+func (err *PreconditionFailed) ErrorCode() string {
+	return orDefault(err.Code, "precondition_failed")
+}
+
+// UnsupportedMediaType is a request with a body of the wrong Content-Type.
+type UnsupportedMediaType struct {
+	Code    string
+	Message string
+}
+
+func (err *UnsupportedMediaType) Error() string {
+	return orDefault(err.Message, "Unsupported media type")
+}
+
+func (err *UnsupportedMediaType) StatusCode() int {
+	return http.StatusUnsupportedMediaType
+}
+
+func (err *UnsupportedMediaType) ErrorCode() string {
+	return orDefault(err.Code, "unsupported_media_type")
+}
+
+// Unprocessable is a well formed request which can not be carried out.
+type Unprocessable struct {
+	Code    string
+	Message string
+}
+
+func (err *Unprocessable) Error() string {
+	return orDefault(err.Message, "Unprocessable entity")
+}
+
+func (err *Unprocessable) StatusCode() int {
+	return http.StatusUnprocessableEntity
+}
+
+func (err *Unprocessable) ErrorCode() string {
+	return orDefault(err.Code, "unprocessable")
+}
+
+// RateLimited is a request made too soon after others. It may be retried after
+// RetryAfter, if that is set.
+type RateLimited struct {
+	Code       string
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (err *RateLimited) Error() string {
+	return orDefault(err.Message, "Too many requests")
+}
+
+func (err *RateLimited) StatusCode() int {
+	return http.StatusTooManyRequests
+}
+
+func (err *RateLimited) ErrorCode() string {
+	return orDefault(err.Code, "rate_limited")
+}
+
+// RetryAfterDuration returns how long the client should wait before retrying.
+func (err *RateLimited) RetryAfterDuration() time.Duration {
+	return err.RetryAfter
+}
+
+// Unavailable is a request which could not be served because a dependency,
+// such as the database, is unavailable or overloaded. It may be retried after
+// RetryAfter, if that is set.
+type Unavailable struct {
+	Code       string
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (err *Unavailable) Error() string {
+	return orDefault(err.Message, "Service temporarily unavailable")
+}
+
+func (err *Unavailable) StatusCode() int {
+	return http.StatusServiceUnavailable
+}
+
+func (err *Unavailable) ErrorCode() string {
+	return orDefault(err.Code, "unavailable")
+}
+
+// RetryAfterDuration returns how long the client should wait before retrying.
+func (err *Unavailable) RetryAfterDuration() time.Duration {
+	return err.RetryAfter
+}
+
+type DeleteIsMissingID struct{ BadRequest }
 
 func (err *DeleteIsMissingID) Error() string {
 	return "Can not delete. Struct missing ID."
 }
 
-type CursorDecodingError struct{}
+func (err *DeleteIsMissingID) ErrorCode() string {
+	return "missing_id"
+}
+
+type CursorDecodingError struct{ BadRequest }
 
 func (err *CursorDecodingError) Error() string {
 	return "Unable to decode cursor"
 }
+
+func (err *CursorDecodingError) ErrorCode() string {
+	return "invalid_cursor"
+}
+
+type RestoreParentIsDeleted struct{ Conflict }
+
+func (err *RestoreParentIsDeleted) Error() string {
+	return "Can not restore. Parent is deleted."
+}
+
+func (err *RestoreParentIsDeleted) ErrorCode() string {
+	return "parent_deleted"
+}
+
+type SlugTaken struct{ Conflict }
+
+func (err *SlugTaken) Error() string {
+	return "Slug is already taken."
+}
+
+func (err *SlugTaken) ErrorCode() string {
+	return "slug_taken"
+}
+
+type VersionMismatch struct{ PreconditionFailed }
+
+func (err *VersionMismatch) Error() string {
+	return "Version does not match. Resource has been modified."
+}
+
+func (err *VersionMismatch) ErrorCode() string {
+	return "version_mismatch"
+}
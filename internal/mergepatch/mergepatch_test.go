@@ -0,0 +1,59 @@
+package mergepatch
+
+import (
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	// The examples of RFC 7396 Appendix A
+	tests := []struct {
+		doc   string
+		patch string
+		want  string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+		// Members are sorted and large integers are not rounded
+		{`{"id":9007199254740993}`, `{"a":1}`, `{"a":1,"id":9007199254740993}`},
+	}
+	for _, tt := range tests {
+		got, err := Apply([]byte(tt.doc), []byte(tt.patch))
+		if err != nil {
+			t.Errorf("Apply(%s, %s) returned error: %v", tt.doc, tt.patch, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("Apply(%s, %s) = %s, want %s", tt.doc, tt.patch, got, tt.want)
+		}
+	}
+}
+
+func TestApplyInvalid(t *testing.T) {
+	tests := []struct {
+		doc   string
+		patch string
+	}{
+		{`{"a":"b"}`, ``},
+		{`{"a":"b"}`, `{"a":`},
+		{`{"a":"b"}`, `{"a":"c"} {"a":"d"}`},
+		{`{"a":`, `{"a":"c"}`},
+	}
+	for _, tt := range tests {
+		if got, err := Apply([]byte(tt.doc), []byte(tt.patch)); err == nil {
+			t.Errorf("Apply(%s, %s) = %s, expected an error", tt.doc, tt.patch, got)
+		}
+	}
+}
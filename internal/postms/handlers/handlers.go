@@ -1,33 +1,191 @@
 package handlers
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	"github.com/willdady/postms/internal/errors"
+	"github.com/willdady/postms/internal/mergepatch"
 	"github.com/willdady/postms/internal/postms/models"
 	"github.com/willdady/postms/internal/postms/services"
+	"github.com/willdady/postms/internal/rest"
+	"github.com/willdady/postms/internal/utils"
+	"gopkg.in/go-playground/validator.v8"
 )
 
-func handleServiceError(err error, c *gin.Context) {
-	switch err.(type) {
-	case *errors.NotFound:
-		c.AbortWithStatusJSON(
-			http.StatusNotFound,
-			gin.H{"status": http.StatusNotFound, "message": err.Error()})
-	case *errors.DeleteIsMissingID:
-		c.AbortWithStatusJSON(
-			http.StatusBadRequest,
-			gin.H{"status": http.StatusBadRequest, "message": err.Error()})
-	case *errors.CursorDecodingError:
-		c.AbortWithStatusJSON(
-			http.StatusBadRequest,
-			gin.H{"status": http.StatusBadRequest, "message": err.Error()})
-	default:
-		c.AbortWithStatusJSON(
-			http.StatusInternalServerError,
-			gin.H{"status": http.StatusInternalServerError, "message": "An internal server error occurred"})
+// maxPageSize is the largest page which may be requested from list endpoints.
+const maxPageSize = 100
+
+// bindJSON binds the JSON request body into obj and validates it. It aborts
+// with an error response if that fails.
+func bindJSON(c *gin.Context, obj interface{}) bool {
+	body, err := c.GetRawData()
+	if err != nil {
+		rest.AbortWithError(c, &errors.BadRequest{Code: "malformed_body", Message: "Request body could not be read"})
+		return false
+	}
+	return bindDocument(c, body, obj)
+}
+
+// bindDocument binds the JSON document doc into obj and validates it. It
+// aborts with an error response if that fails.
+func bindDocument(c *gin.Context, doc []byte, obj interface{}) bool {
+	var err error
+	if len(bytes.TrimSpace(doc)) == 0 {
+		err = io.EOF
+	} else if bytes.Equal(bytes.TrimSpace(doc), []byte("null")) {
+		// Unmarshalling null leaves obj as it is rather than failing
+		rest.AbortWithError(c, &errors.BadRequest{Code: "malformed_body", Message: "Request body must be a JSON object"})
+		return false
+	} else {
+		err = json.Unmarshal(doc, obj)
+	}
+	if err == nil {
+		err = binding.Validator.ValidateStruct(obj)
+	}
+	if err != nil {
+		rest.AbortWithError(c, bindingError(err, obj, doc))
+		return false
+	}
+	return true
+}
+
+// bindingError converts an error from binding the JSON document doc to obj
+// into an error of the errors package, naming invalid fields by their JSON
+// names.
+func bindingError(err error, obj interface{}, doc []byte) error {
+	switch err := err.(type) {
+	case validator.ValidationErrors:
+		fields := []errors.FieldError{}
+		for _, fieldError := range err {
+			name := jsonFieldName(obj, fieldError.Field)
+			message := fmt.Sprintf("%s is invalid", name)
+			if fieldError.Tag == "required" {
+				message = fmt.Sprintf("%s is required", name)
+			}
+			fields = append(fields, errors.FieldError{Field: name, Code: fieldError.Tag, Message: message})
+		}
+		sort.Slice(fields, func(i, j int) bool {
+			return fields[i].Field < fields[j].Field
+		})
+		return &errors.Validation{Fields: fields}
+	case *json.UnmarshalTypeError:
+		// The body itself has the wrong type rather than one of its fields
+		if err.Field == "" {
+			return &errors.BadRequest{Code: "malformed_body", Message: "Request body must be a JSON object"}
+		}
+		return errors.InvalidField(err.Field, "invalid_type", fmt.Sprintf("%s must be %s", err.Field, jsonTypeName(err.Type)))
+	case *json.SyntaxError:
+		return &errors.BadRequest{Code: "malformed_body", Message: "Request body is not valid JSON"}
+	case *time.ParseError:
+		// Errors from parsing times do not say which field they came from
+		if name := invalidTimeField(obj, doc); name != "" {
+			return errors.InvalidField(name, "invalid_type", fmt.Sprintf("%s must be %s", name, jsonTypeName(timeType)))
+		}
+	}
+	if err == io.EOF {
+		return &errors.BadRequest{Code: "malformed_body", Message: "Request body is empty"}
+	}
+	return &errors.BadRequest{Code: "malformed_body", Message: "Request body is invalid"}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// jsonTypeName describes the JSON values which can be decoded into a value of
+// type t, such as "a number".
+func jsonTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return "an RFC 3339 timestamp"
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	}
+	return "an object"
+}
+
+// invalidTimeField returns the JSON name of the first time field of obj whose
+// value in the JSON document doc is not a valid time, or "" if there is none.
+func invalidTimeField(obj interface{}, doc []byte) string {
+	t := reflect.TypeOf(obj)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	values := map[string]json.RawMessage{}
+	if t.Kind() != reflect.Struct || json.Unmarshal(doc, &values) != nil {
+		return ""
+	}
+	for _, field := range reflect.VisibleFields(t) {
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if fieldType != timeType || !field.IsExported() {
+			continue
+		}
+		name := jsonFieldName(obj, field.Name)
+		value, ok := values[name]
+		if !ok || string(value) == "null" {
+			continue
+		}
+		if err := json.Unmarshal(value, &time.Time{}); err != nil {
+			return name
+		}
 	}
+	return ""
+}
+
+// jsonFieldName returns the name of the field of obj named field in JSON.
+func jsonFieldName(obj interface{}, field string) string {
+	t := reflect.TypeOf(obj)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return field
+	}
+	structField, ok := t.FieldByName(field)
+	if !ok {
+		return field
+	}
+	name := strings.Split(structField.Tag.Get("json"), ",")[0]
+	if name == "" || name == "-" {
+		return field
+	}
+	return name
+}
+
+// pageLimit returns the page size requested by the limit query parameter,
+// defaulting to maxPageSize. It aborts with a validation error if the limit is
+// out of range.
+func pageLimit(c *gin.Context) (int, bool) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(maxPageSize)))
+	if err != nil || limit < 1 || limit > maxPageSize {
+		rest.AbortWithError(c, errors.InvalidField("limit", "out_of_range", fmt.Sprintf("limit must be between 1 and %d", maxPageSize)))
+		return 0, false
+	}
+	return limit, true
 }
 
 func getPostServiceFromContext(c *gin.Context) services.PostService {
@@ -35,190 +193,838 @@ func getPostServiceFromContext(c *gin.Context) services.PostService {
 	return value.(services.PostService)
 }
 
+// getViewerID returns the ID of the user making the request, as set by the API
+// gateway in the X-User-ID header. It is empty for anonymous requests.
+func getViewerID(c *gin.Context) string {
+	return c.GetHeader("X-User-ID")
+}
+
+// isModerator reports whether the user making the request is a moderator, as
+// set by the API gateway in the comma separated X-User-Roles header.
+func isModerator(c *gin.Context) bool {
+	for _, role := range strings.Split(c.GetHeader("X-User-Roles"), ",") {
+		if strings.TrimSpace(role) == "moderator" {
+			return true
+		}
+	}
+	return false
+}
+
+// requireAuthor aborts the request unless it is made by the user with ID
+// userID, the author of the resource being changed.
+func requireAuthor(c *gin.Context, userID string) bool {
+	if viewerID := getViewerID(c); viewerID == "" || viewerID != userID {
+		rest.AbortWithError(c, &errors.Forbidden{Code: "not_author", Message: "Only the author may do this"})
+		return false
+	}
+	return true
+}
+
+func Forbidden(c *gin.Context) {
+	rest.AbortWithError(c, &errors.Forbidden{})
+}
+
 func NotFound(c *gin.Context) {
-	c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"status": http.StatusNotFound, "message": "Not found"})
+	rest.AbortWithError(c, &errors.NotFound{})
+}
+
+// resourceETag returns the entity tag of a resource at version, last updated
+// at updatedAt. Votes and replies change updatedAt but not the version, so
+// only the version is compared for If-Match. Times are rounded to the
+// precision stored by Postgres.
+func resourceETag(version int, updatedAt time.Time) string {
+	return fmt.Sprintf("\"%d-%x\"", version, updatedAt.Round(time.Microsecond).UnixNano()/1000)
+}
+
+// setValidators sets the ETag and Last-Modified headers of the response for a
+// resource at version, last updated at updatedAt.
+func setValidators(c *gin.Context, version int, updatedAt time.Time) {
+	c.Header("ETag", resourceETag(version, updatedAt))
+	rest.SetLastModified(c, updatedAt)
+}
+
+// setPostCacheControl keeps private posts out of shared caches.
+func setPostCacheControl(c *gin.Context, post models.Post) {
+	if models.IsPrivatePostStatus(post.Status) {
+		c.Header("Cache-Control", "private, no-cache")
+	}
+}
+
+// ifMatchVersion checks the If-Match header of the request against the
+// current version of a resource, returning the version a change must be made
+// to, or 0 if the header allows any version. It aborts with a precondition
+// failed response if no entity tag matches.
+func ifMatchVersion(c *gin.Context, version int) (int, bool) {
+	header := c.GetHeader("If-Match")
+	if header == "" {
+		return 0, true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return 0, true
+		}
+		// Weak entity tags never match as If-Match uses strong comparison
+		if tag == fmt.Sprintf("\"%d\"", version) || strings.HasPrefix(tag, fmt.Sprintf("\"%d-", version)) {
+			return version, true
+		}
+	}
+	rest.AbortWithError(c, &errors.VersionMismatch{})
+	return 0, false
 }
 
 func CreatePost(c *gin.Context) {
 	postService := getPostServiceFromContext(c)
 	post := &models.Post{}
-	err := c.ShouldBindJSON(post)
-	if err != nil {
-		c.AbortWithStatusJSON(
-			http.StatusBadRequest,
-			gin.H{"status": http.StatusBadRequest, "message": err.Error()})
+	if !bindJSON(c, post) {
 		return
 	}
-	err = postService.CreatePost(post)
+	if post.PublishAt != nil && post.Status == "" {
+		post.Status = models.PostStatusScheduled
+	}
+	switch post.Status {
+	case "", models.PostStatusDraft, models.PostStatusPublished:
+		post.PublishAt = nil
+	case models.PostStatusScheduled:
+		if post.PublishAt == nil || !post.PublishAt.After(time.Now()) {
+			rest.AbortWithError(c, errors.InvalidField("publishAt", "not_future", "publishAt must be in the future"))
+			return
+		}
+	default:
+		rest.AbortWithError(c, errors.InvalidField("status", "one_of", "status must be one of draft, scheduled or published"))
+		return
+	}
+	if !validPostSlug(c, post.Slug) {
+		return
+	}
+	err := postService.CreatePost(post)
 	if err != nil {
-		handleServiceError(err, c)
+		rest.AbortWithError(c, err)
 		return
 	}
+	setValidators(c, post.Version, post.UpdatedAt)
 	c.JSON(http.StatusCreated, post)
 }
 
+// validPostSlug checks a slug given in a request body, which is optional but
+// must already be in the form generated from titles. It aborts with a bad
+// request if not.
+func validPostSlug(c *gin.Context, slug string) bool {
+	if slug != "" && !models.IsSlug(slug) {
+		rest.AbortWithError(c, errors.InvalidField("slug", "invalid", "slug must contain only lowercase letters, digits and single hyphens"))
+		return false
+	}
+	return true
+}
+
 func UpdatePost(c *gin.Context) {
-	postService := getPostServiceFromContext(c)
 	postID := uint64(c.GetInt64("ID"))
+	existingPost, ok := getVisiblePost(c, postID)
+	if !ok {
+		return
+	}
 	post := &models.Post{}
-	err := c.ShouldBindJSON(post)
-	if err != nil {
-		c.AbortWithStatusJSON(
-			http.StatusBadRequest,
-			gin.H{"status": http.StatusBadRequest, "message": err.Error()})
+	if !bindJSON(c, post) {
 		return
 	}
-	var existingPost models.Post
-	existingPost, err = postService.GetPost(postID)
-	if err != nil {
-		handleServiceError(err, c)
+	updatePost(c, post, existingPost)
+}
+
+// PatchPost changes part of a post with a JSON merge patch. Fields which may
+// not be set by UpdatePost are ignored in the same way.
+func PatchPost(c *gin.Context) {
+	postID := uint64(c.GetInt64("ID"))
+	existingPost, ok := getVisiblePost(c, postID)
+	if !ok {
+		return
+	}
+	post := &models.Post{}
+	if !bindMergePatch(c, existingPost, post) {
 		return
 	}
-	post.ID = uint(postID)
+	updatePost(c, post, existingPost)
+}
+
+// updatePost replaces existingPost with post, keeping the fields which are
+// not set directly. Only the author may update a post.
+func updatePost(c *gin.Context, post *models.Post, existingPost models.Post) {
+	postService := getPostServiceFromContext(c)
+	if !requireAuthor(c, existingPost.UserID) {
+		return
+	}
+	post.ID = existingPost.ID
+	post.UserID = existingPost.UserID
 	post.CreatedAt = existingPost.CreatedAt
-	err = postService.UpdatePost(post)
-	if err != nil {
-		handleServiceError(err, c)
+	post.CopyCounters(&existingPost)
+	post.Status = existingPost.Status
+	post.PublishedAt = existingPost.PublishedAt
+	post.PublishAt = existingPost.PublishAt
+	if !validPostSlug(c, post.Slug) {
 		return
 	}
+	version, ok := ifMatchVersion(c, existingPost.Version)
+	if !ok {
+		return
+	}
+	post.Version = version
+	if err := postService.UpdatePost(post); err != nil {
+		rest.AbortWithError(c, err)
+		return
+	}
+	setValidators(c, post.Version, post.UpdatedAt)
 	c.JSON(http.StatusOK, post)
 }
 
+// bindMergePatch applies the JSON merge patch in the request body to the JSON
+// form of existing, binding and validating the result into obj. It aborts
+// with an error response if that fails.
+func bindMergePatch(c *gin.Context, existing interface{}, obj interface{}) bool {
+	switch c.ContentType() {
+	case "application/merge-patch+json", "application/json":
+	default:
+		rest.AbortWithError(c, &errors.UnsupportedMediaType{Message: "Content-Type must be application/merge-patch+json"})
+		return false
+	}
+	patch, err := c.GetRawData()
+	if err != nil {
+		rest.AbortWithError(c, &errors.BadRequest{Message: err.Error()})
+		return false
+	}
+	doc, err := json.Marshal(existing)
+	if err != nil {
+		rest.AbortWithError(c, err)
+		return false
+	}
+	doc, err = mergepatch.Apply(doc, patch)
+	if err != nil {
+		rest.AbortWithError(c, bindingError(err, obj, patch))
+		return false
+	}
+	return bindDocument(c, doc, obj)
+}
+
 func CreatePostComment(c *gin.Context) {
 	postService := getPostServiceFromContext(c)
 	postComment := &models.PostComment{}
-	err := c.ShouldBindJSON(postComment)
-	if err != nil {
-		c.AbortWithStatusJSON(
-			http.StatusBadRequest,
-			gin.H{"status": http.StatusBadRequest, "message": err.Error()})
+	if !bindJSON(c, postComment) {
 		return
 	}
-	if _, err := postService.GetPost(uint64(postComment.PostID)); err != nil {
-		// TODO: Specifically check err is a NotFound error
-		c.AbortWithStatusJSON(
-			http.StatusBadRequest,
-			gin.H{"status": http.StatusBadRequest, "message": "Can not create comment for non-existent post"})
+	// The score is maintained by votes and can not be set by clients
+	postComment.Score = 0
+	if _, err := findVisiblePost(c, uint64(postComment.PostID)); err != nil {
+		if _, ok := err.(*errors.NotFound); ok {
+			err = errors.InvalidField("postId", "not_found", "Can not create comment for non-existent post")
+		}
+		rest.AbortWithError(c, err)
 		return
 	}
-	err = postService.CreatePostComment(postComment)
+	if postComment.ParentID != nil {
+		parent, err := postService.GetPostComment(uint64(*postComment.ParentID))
+		if _, ok := err.(*errors.NotFound); ok || (err == nil && parent.PostID != postComment.PostID) {
+			err = errors.InvalidField("parentId", "not_found", "Can not reply to non-existent comment")
+		}
+		if err != nil {
+			rest.AbortWithError(c, err)
+			return
+		}
+	}
+	err := postService.CreatePostComment(postComment)
 	if err != nil {
-		handleServiceError(err, c)
+		rest.AbortWithError(c, err)
 		return
 	}
+	setValidators(c, postComment.Version, postComment.UpdatedAt)
 	c.JSON(http.StatusCreated, postComment)
 }
 
 func UpdatePostComment(c *gin.Context) {
-	postService := getPostServiceFromContext(c)
 	postCommentID := uint64(c.GetInt64("ID"))
+	existingPostComment, ok := getVisiblePostComment(c, postCommentID)
+	if !ok {
+		return
+	}
 	postComment := &models.PostComment{}
-	err := c.ShouldBindJSON(postComment)
-	if err != nil {
-		c.AbortWithStatusJSON(
-			http.StatusBadRequest,
-			gin.H{"status": http.StatusBadRequest, "message": err.Error()})
+	if !bindJSON(c, postComment) {
 		return
 	}
-	var existingPostComment models.PostComment
-	existingPostComment, err = postService.GetPostComment(postCommentID)
-	if err != nil {
-		handleServiceError(err, c)
+	updatePostComment(c, postComment, existingPostComment)
+}
+
+// PatchPostComment changes a comment with a JSON merge patch. As with
+// UpdatePostComment only the body may be changed.
+func PatchPostComment(c *gin.Context) {
+	postCommentID := uint64(c.GetInt64("ID"))
+	existingPostComment, ok := getVisiblePostComment(c, postCommentID)
+	if !ok {
+		return
+	}
+	postComment := &models.PostComment{}
+	if !bindMergePatch(c, existingPostComment, postComment) {
+		return
+	}
+	updatePostComment(c, postComment, existingPostComment)
+}
+
+// updatePostComment changes the body of existingPostComment to that of
+// postComment. Only the author may update a comment.
+func updatePostComment(c *gin.Context, postComment *models.PostComment, existingPostComment models.PostComment) {
+	postService := getPostServiceFromContext(c)
+	if !requireAuthor(c, existingPostComment.UserID) {
+		return
+	}
+	version, ok := ifMatchVersion(c, existingPostComment.Version)
+	if !ok {
 		return
 	}
 	existingPostComment.Body = postComment.Body
-	err = postService.UpdatePostComment(&existingPostComment)
-	if err != nil {
-		handleServiceError(err, c)
+	existingPostComment.Version = version
+	if err := postService.UpdatePostComment(&existingPostComment); err != nil {
+		rest.AbortWithError(c, err)
 		return
 	}
+	setValidators(c, existingPostComment.Version, existingPostComment.UpdatedAt)
 	c.JSON(http.StatusOK, existingPostComment)
 }
 
+// GetPostCommentRevisions responds with a page of the revisions of a comment,
+// newest first. Only moderators may see prior versions of a comment.
+func GetPostCommentRevisions(c *gin.Context) {
+	postService := getPostServiceFromContext(c)
+	postCommentID := uint64(c.GetInt64("ID"))
+	if !isModerator(c) {
+		Forbidden(c)
+		return
+	}
+	limit, ok := pageLimit(c)
+	if !ok {
+		return
+	}
+	if _, err := postService.GetPostComment(postCommentID); err != nil {
+		rest.AbortWithError(c, err)
+		return
+	}
+	postCommentRevisions, nextCursor, err := postService.GetPostCommentRevisions(postCommentID, c.Query("cursor"), limit)
+	if err != nil {
+		rest.AbortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"nextCursor": nextCursor, "results": postCommentRevisions})
+}
+
+// GetPostCommentsForPost responds with a page of comments for a post. The sort
+// query parameter orders comments by newest (the default), oldest or top and
+// limit sets the page size. An optional parentId restricts the page to direct
+// replies of a comment (or top-level comments when 0). With view=tree each
+// comment in the page is returned as a thread of nested replies, limited to
+// depth levels when depth is given.
 func GetPostCommentsForPost(c *gin.Context) {
 	postService := getPostServiceFromContext(c)
 	postID := uint64(c.GetInt64("ID"))
-	postComments, err := postService.GetPostCommentsForPost(postID)
+	cursor := c.Query("cursor")
+	mode := c.DefaultQuery("sort", services.SortNewest)
+	if !services.IsPostCommentSort(mode) {
+		rest.AbortWithError(c, errors.InvalidField("sort", "one_of", "sort must be one of newest, oldest or top"))
+		return
+	}
+	limit, ok := pageLimit(c)
+	if !ok {
+		return
+	}
+	tree := c.Query("view") == "tree"
+	var parentID *uint64
+	if _, ok := c.GetQuery("parentId"); ok || tree {
+		id, err := strconv.ParseUint(c.DefaultQuery("parentId", "0"), 10, 64)
+		if err != nil {
+			rest.AbortWithError(c, errors.InvalidField("parentId", "invalid", "parentId must be a comment id"))
+			return
+		}
+		parentID = &id
+	}
+	depth, err := strconv.Atoi(c.DefaultQuery("depth", "0"))
+	if err != nil || depth < 0 {
+		rest.AbortWithError(c, errors.InvalidField("depth", "invalid", "depth must be a non-negative integer"))
+		return
+	}
+	if _, ok := getVisiblePost(c, postID); !ok {
+		return
+	}
+	postComments, nextCursor, err := postService.GetPostCommentsForPost(postID, parentID, cursor, mode, limit)
+	if err != nil {
+		rest.AbortWithError(c, err)
+		return
+	}
+	if !tree {
+		c.JSON(http.StatusOK, gin.H{"nextCursor": nextCursor, "results": postComments})
+		return
+	}
+	rootIDs := make([]uint64, 0, len(postComments))
+	for _, postComment := range postComments {
+		rootIDs = append(rootIDs, uint64(postComment.ID))
+	}
+	// The roots form the first level of each thread so only depth-1 levels
+	// of replies are needed. A depth of 0 means the threads are unlimited.
+	replies, err := postService.GetPostCommentReplies(postID, rootIDs, depth-1)
 	if err != nil {
-		handleServiceError(err, c)
+		rest.AbortWithError(c, err)
 		return
 	}
-	c.JSON(http.StatusOK, postComments)
+	threads := services.BuildPostCommentThreads(postComments, replies, depth, mode)
+	c.JSON(http.StatusOK, gin.H{"nextCursor": nextCursor, "results": threads})
 }
 
 func GetPost(c *gin.Context) {
+	postID := uint64(c.GetInt64("ID"))
+	post, ok := getVisiblePost(c, postID)
+	if !ok {
+		return
+	}
+	setValidators(c, post.Version, post.UpdatedAt)
+	c.JSON(http.StatusOK, post)
+}
+
+// GetPostBySlug returns the post identified by the slug in the URL. Previous
+// slugs of a post redirect to its current one.
+func GetPostBySlug(c *gin.Context) {
+	postService := getPostServiceFromContext(c)
+	slug := c.GetString("Key")
+	post, err := postService.GetPostBySlug(slug)
+	if err != nil {
+		rest.AbortWithError(c, err)
+		return
+	}
+	if !post.VisibleTo(getViewerID(c)) {
+		NotFound(c)
+		return
+	}
+	if post.Slug != slug {
+		c.Redirect(http.StatusMovedPermanently, "/posts/by-slug/"+post.Slug)
+		return
+	}
+	setPostCacheControl(c, post)
+	setValidators(c, post.Version, post.UpdatedAt)
+	c.JSON(http.StatusOK, post)
+}
+
+func updatePostStatus(c *gin.Context, status string) {
+	postService := getPostServiceFromContext(c)
+	postID := uint64(c.GetInt64("ID"))
+	post, ok := getVisiblePost(c, postID)
+	if !ok || !requireAuthor(c, post.UserID) {
+		return
+	}
+	if post.Status != status {
+		if err := postService.UpdatePostStatus(&post, status); err != nil {
+			rest.AbortWithError(c, err)
+			return
+		}
+	}
+	setValidators(c, post.Version, post.UpdatedAt)
+	c.JSON(http.StatusOK, post)
+}
+
+// PublishPost makes a draft or archived post visible to everyone.
+func PublishPost(c *gin.Context) {
+	updatePostStatus(c, models.PostStatusPublished)
+}
+
+// UnpublishPost returns a post to draft so only its author can see it.
+func UnpublishPost(c *gin.Context) {
+	updatePostStatus(c, models.PostStatusDraft)
+}
+
+// SchedulePost sets a post to be published at a future time by the scheduled
+// publisher.
+func SchedulePost(c *gin.Context) {
 	postService := getPostServiceFromContext(c)
 	postID := uint64(c.GetInt64("ID"))
+	var body struct {
+		PublishAt time.Time `json:"publishAt" binding:"required"`
+	}
+	if !bindJSON(c, &body) {
+		return
+	}
+	if !body.PublishAt.After(time.Now()) {
+		rest.AbortWithError(c, errors.InvalidField("publishAt", "not_future", "publishAt must be in the future"))
+		return
+	}
+	post, ok := getVisiblePost(c, postID)
+	if !ok || !requireAuthor(c, post.UserID) {
+		return
+	}
+	if post.Status == models.PostStatusPublished {
+		rest.AbortWithError(c, &errors.Conflict{Code: "already_published", Message: "Post is already published"})
+		return
+	}
+	post.PublishAt = &body.PublishAt
+	if err := postService.UpdatePostStatus(&post, models.PostStatusScheduled); err != nil {
+		rest.AbortWithError(c, err)
+		return
+	}
+	setValidators(c, post.Version, post.UpdatedAt)
+	c.JSON(http.StatusOK, post)
+}
+
+// ArchivePost removes a post from the default listing while leaving it
+// readable.
+func ArchivePost(c *gin.Context) {
+	updatePostStatus(c, models.PostStatusArchived)
+}
+
+// getVisiblePost fetches a post which the viewer is allowed to see, otherwise
+// aborting the request.
+func getVisiblePost(c *gin.Context, postID uint64) (models.Post, bool) {
+	post, err := findVisiblePost(c, postID)
+	if err != nil {
+		rest.AbortWithError(c, err)
+		return post, false
+	}
+	setPostCacheControl(c, post)
+	return post, true
+}
+
+// findVisiblePost fetches a post which the viewer is allowed to see. Posts
+// they may not see are not found.
+// getVisiblePostComment returns the comment with ID postCommentID, aborting
+// with NotFound if it does not exist or is on a post the viewer may not see.
+func getVisiblePostComment(c *gin.Context, postCommentID uint64) (models.PostComment, bool) {
+	postComment, err := findVisiblePostComment(c, postCommentID)
+	if err != nil {
+		rest.AbortWithError(c, err)
+		return postComment, false
+	}
+	return postComment, true
+}
+
+// findVisiblePostComment returns the comment with ID postCommentID, or
+// NotFound if it does not exist or is on a post the viewer may not see.
+func findVisiblePostComment(c *gin.Context, postCommentID uint64) (models.PostComment, error) {
+	postService := getPostServiceFromContext(c)
+	postComment, err := postService.GetPostComment(postCommentID)
+	if err != nil {
+		return postComment, err
+	}
+	if _, err := findVisiblePost(c, uint64(postComment.PostID)); err != nil {
+		return postComment, err
+	}
+	return postComment, nil
+}
+
+func findVisiblePost(c *gin.Context, postID uint64) (models.Post, error) {
+	postService := getPostServiceFromContext(c)
 	post, err := postService.GetPost(postID)
 	if err != nil {
-		handleServiceError(err, c)
+		return post, err
+	}
+	if !post.VisibleTo(getViewerID(c)) {
+		return post, &errors.NotFound{}
+	}
+	return post, nil
+}
+
+func GetPostRevisions(c *gin.Context) {
+	postService := getPostServiceFromContext(c)
+	postID := uint64(c.GetInt64("ID"))
+	limit, ok := pageLimit(c)
+	if !ok {
+		return
+	}
+	if _, ok := getVisiblePost(c, postID); !ok {
+		return
+	}
+	postRevisions, nextCursor, err := postService.GetPostRevisions(postID, c.Query("cursor"), limit)
+	if err != nil {
+		rest.AbortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"nextCursor": nextCursor, "results": postRevisions})
+}
+
+// getVisiblePostRevision fetches a revision of a post which the viewer is
+// allowed to see, otherwise aborting the request.
+func getVisiblePostRevision(c *gin.Context, postRevisionID uint64) (models.PostRevision, models.Post, bool) {
+	postService := getPostServiceFromContext(c)
+	postRevision, err := postService.GetPostRevision(postRevisionID)
+	if err != nil {
+		rest.AbortWithError(c, err)
+		return postRevision, models.Post{}, false
+	}
+	post, ok := getVisiblePost(c, uint64(postRevision.PostID))
+	return postRevision, post, ok
+}
+
+func GetPostRevision(c *gin.Context) {
+	postRevisionID := uint64(c.GetInt64("ID"))
+	postRevision, _, ok := getVisiblePostRevision(c, postRevisionID)
+	if !ok {
 		return
 	}
+	c.JSON(http.StatusOK, postRevision)
+}
+
+// GetPostRevisionDiff compares a revision with the revision given by the from
+// query parameter, defaulting to the one before it.
+func GetPostRevisionDiff(c *gin.Context) {
+	postService := getPostServiceFromContext(c)
+	postRevisionID := uint64(c.GetInt64("ID"))
+	to, _, ok := getVisiblePostRevision(c, postRevisionID)
+	if !ok {
+		return
+	}
+	var from models.PostRevision
+	if value, ok := c.GetQuery("from"); ok {
+		fromID, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			rest.AbortWithError(c, errors.InvalidField("from", "invalid", "from must be a revision id"))
+			return
+		}
+		from, err = postService.GetPostRevision(fromID)
+		if err != nil {
+			rest.AbortWithError(c, err)
+			return
+		}
+		if from.PostID != to.PostID {
+			rest.AbortWithError(c, errors.InvalidField("from", "invalid", "from must be a revision of the same post"))
+			return
+		}
+	} else if to.ID > 1 {
+		// Revisions are listed newest first so the first revision before
+		// to is the previous one. The first revision is compared with an
+		// empty post.
+		previous, _, err := postService.GetPostRevisions(uint64(to.PostID), utils.EncodeCursor(int64(to.ID-1)), 1)
+		if err != nil {
+			rest.AbortWithError(c, err)
+			return
+		}
+		if len(previous) > 0 {
+			from = previous[0]
+		}
+	}
+	c.JSON(http.StatusOK, models.DiffPostRevisions(from, to))
+}
+
+// RestorePostRevision replaces the content of a post with that of one of its
+// revisions, which records a new revision. Only the author may restore a
+// revision, and If-Match is compared with the version of the post.
+func RestorePostRevision(c *gin.Context) {
+	postService := getPostServiceFromContext(c)
+	postRevisionID := uint64(c.GetInt64("ID"))
+	postRevision, post, ok := getVisiblePostRevision(c, postRevisionID)
+	if !ok || !requireAuthor(c, post.UserID) {
+		return
+	}
+	version, ok := ifMatchVersion(c, post.Version)
+	if !ok {
+		return
+	}
+	post.Version = version
+	post.RestoreRevision(postRevision)
+	if err := postService.UpdatePost(&post); err != nil {
+		rest.AbortWithError(c, err)
+		return
+	}
+	setValidators(c, post.Version, post.UpdatedAt)
 	c.JSON(http.StatusOK, post)
 }
 
 func GetPosts(c *gin.Context) {
 	postService := getPostServiceFromContext(c)
-	cursor := c.Query("cursor")
-	userID := c.Query("userId")
-	tag := c.Query("tag")
-	posts, nextCursor, err := postService.GetPosts(cursor, userID, tag)
+	query := services.PostQuery{
+		Cursor:   c.Query("cursor"),
+		UserID:   c.Query("userId"),
+		Tag:      c.Query("tag"),
+		Sort:     c.DefaultQuery("sort", services.SortNewest),
+		Window:   c.DefaultQuery("window", services.WindowAll),
+		Status:   c.DefaultQuery("status", models.PostStatusPublished),
+		ViewerID: getViewerID(c),
+	}
+	if !services.IsPostSort(query.Sort) {
+		rest.AbortWithError(c, errors.InvalidField("sort", "one_of", "sort must be one of newest, hot, top or controversial"))
+		return
+	}
+	if !models.IsPostStatus(query.Status) {
+		rest.AbortWithError(c, errors.InvalidField("status", "one_of", "status must be one of draft, published or archived"))
+		return
+	}
+	if !services.IsWindow(query.Window) {
+		rest.AbortWithError(c, errors.InvalidField("window", "one_of", "window must be one of day, week, month, year or all"))
+		return
+	}
+	posts, nextCursor, err := postService.GetPosts(query)
 	if err != nil {
-		handleServiceError(err, c)
+		rest.AbortWithError(c, err)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"nextCursor": nextCursor, "results": posts})
 }
 
+// DeletePost moves a post to the trash, or permanently deletes it along with
+// everything belonging to it when the permanent query parameter is true. Only
+// the author may delete a post.
 func DeletePost(c *gin.Context) {
 	postService := getPostServiceFromContext(c)
 	postID := uint64(c.GetInt64("ID"))
-	post, err := postService.GetPost(postID)
+	permanent := c.Query("permanent") == "true"
+	post, err := findVisiblePost(c, postID)
+	// Posts in the trash have no version to match, so may only be permanently
+	// deleted without If-Match
+	if _, ok := err.(*errors.NotFound); ok && permanent && c.GetHeader("If-Match") == "" {
+		post, err = postService.GetDeletedPost(postID)
+	}
 	if err != nil {
-		handleServiceError(err, c)
+		rest.AbortWithError(c, err)
+		return
+	}
+	if !requireAuthor(c, post.UserID) {
+		return
+	}
+	version, ok := ifMatchVersion(c, post.Version)
+	if !ok {
 		return
 	}
+	if permanent {
+		if err := postService.PurgePost(postID); err != nil {
+			rest.AbortWithError(c, err)
+			return
+		}
+		c.JSON(http.StatusNoContent, gin.H{})
+		return
+	}
+	post.Version = version
 	if err := postService.DeletePost(&post); err != nil {
-		handleServiceError(err, c)
+		rest.AbortWithError(c, err)
 		return
 	}
 	c.JSON(http.StatusNoContent, gin.H{})
 }
 
 func GetPostComment(c *gin.Context) {
-	postService := getPostServiceFromContext(c)
 	postCommentID := uint64(c.GetInt64("ID"))
-	postComment, err := postService.GetPostComment(postCommentID)
-	if err != nil {
-		handleServiceError(err, c)
+	postComment, ok := getVisiblePostComment(c, postCommentID)
+	if !ok {
 		return
 	}
+	setValidators(c, postComment.Version, postComment.UpdatedAt)
 	c.JSON(http.StatusOK, postComment)
 }
 
+// DeletePostComment moves a comment to the trash, or permanently deletes it
+// when the permanent query parameter is true. Only the author may delete a
+// comment.
 func DeletePostComment(c *gin.Context) {
 	postService := getPostServiceFromContext(c)
 	postCommentID := uint64(c.GetInt64("ID"))
-	postComment, err := postService.GetPostComment(postCommentID)
+	permanent := c.Query("permanent") == "true"
+	postComment, err := findVisiblePostComment(c, postCommentID)
+	// Comments in the trash have no version to match, so may only be
+	// permanently deleted without If-Match
+	if _, ok := err.(*errors.NotFound); ok && permanent && c.GetHeader("If-Match") == "" {
+		postComment, err = postService.GetDeletedPostComment(postCommentID)
+	}
 	if err != nil {
-		handleServiceError(err, c)
+		rest.AbortWithError(c, err)
+		return
+	}
+	if !requireAuthor(c, postComment.UserID) {
+		return
+	}
+	version, ok := ifMatchVersion(c, postComment.Version)
+	if !ok {
+		return
+	}
+	if permanent {
+		if err := postService.PurgePostComment(postCommentID); err != nil {
+			rest.AbortWithError(c, err)
+			return
+		}
+		c.JSON(http.StatusNoContent, gin.H{})
 		return
 	}
+	postComment.Version = version
 	if err := postService.DeletePostComment(&postComment); err != nil {
-		handleServiceError(err, c)
+		rest.AbortWithError(c, err)
 		return
 	}
 	c.JSON(http.StatusNoContent, gin.H{})
 }
 
+// RestorePost takes a post out of the trash along with the comments and saves
+// which were deleted with it. Only the author may restore a post.
+func RestorePost(c *gin.Context) {
+	postService := getPostServiceFromContext(c)
+	postID := uint64(c.GetInt64("ID"))
+	deletedPost, err := postService.GetDeletedPost(postID)
+	if err != nil {
+		rest.AbortWithError(c, err)
+		return
+	}
+	if !requireAuthor(c, deletedPost.UserID) {
+		return
+	}
+	if err := postService.RestorePost(postID); err != nil {
+		rest.AbortWithError(c, err)
+		return
+	}
+	post, err := postService.GetPost(postID)
+	if err != nil {
+		rest.AbortWithError(c, err)
+		return
+	}
+	setValidators(c, post.Version, post.UpdatedAt)
+	c.JSON(http.StatusOK, post)
+}
+
+// RestorePostComment takes a comment out of the trash. Comments on a post in
+// the trash can only be restored with the post. Only the author may restore a
+// comment.
+func RestorePostComment(c *gin.Context) {
+	postService := getPostServiceFromContext(c)
+	postCommentID := uint64(c.GetInt64("ID"))
+	deletedPostComment, err := postService.GetDeletedPostComment(postCommentID)
+	if err != nil {
+		rest.AbortWithError(c, err)
+		return
+	}
+	if !requireAuthor(c, deletedPostComment.UserID) {
+		return
+	}
+	if err := postService.RestorePostComment(postCommentID); err != nil {
+		rest.AbortWithError(c, err)
+		return
+	}
+	postComment, err := postService.GetPostComment(postCommentID)
+	if err != nil {
+		rest.AbortWithError(c, err)
+		return
+	}
+	setValidators(c, postComment.Version, postComment.UpdatedAt)
+	c.JSON(http.StatusOK, postComment)
+}
+
+// GetTrash responds with a page of the posts and comments deleted by the user
+// making the request, most recently deleted first.
+func GetTrash(c *gin.Context) {
+	postService := getPostServiceFromContext(c)
+	userID := getViewerID(c)
+	if userID == "" {
+		rest.AbortWithError(c, &errors.Forbidden{Code: "anonymous", Message: "Only signed in users have a trash"})
+		return
+	}
+	limit, ok := pageLimit(c)
+	if !ok {
+		return
+	}
+	items, nextCursor, err := postService.GetTrash(userID, c.Query("cursor"), limit)
+	if err != nil {
+		rest.AbortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"nextCursor": nextCursor, "results": items})
+}
+
 func CreatePostVote(c *gin.Context) {
 	postService := getPostServiceFromContext(c)
 	postVote := &models.PostVote{}
-	err := c.ShouldBindJSON(postVote)
-	if err != nil {
-		c.AbortWithStatusJSON(
-			http.StatusBadRequest,
-			gin.H{"status": http.StatusBadRequest, "message": err.Error()})
+	if !bindJSON(c, postVote) {
 		return
 	}
 	if postVote.Value >= 0 {
@@ -226,76 +1032,186 @@ func CreatePostVote(c *gin.Context) {
 	} else if postVote.Value < 0 {
 		postVote.Value = -1
 	}
-	// Check the post actually exists
-	postExists, err := postService.PostExists(uint64(postVote.PostID))
-	if err != nil {
-		c.AbortWithStatusJSON(
-			http.StatusBadRequest,
-			gin.H{"status": http.StatusBadRequest, "message": err.Error()})
+	// Check the post actually exists and is visible to the voter
+	if _, err := findVisiblePost(c, uint64(postVote.PostID)); err != nil {
+		if _, ok := err.(*errors.NotFound); ok {
+			err = errors.InvalidField("postId", "not_found", "Post matching id does not exist")
+		}
+		rest.AbortWithError(c, err)
 		return
 	}
-	if !postExists {
-		c.AbortWithStatusJSON(
-			http.StatusBadRequest,
-			gin.H{"status": http.StatusBadRequest, "message": "Post matching id does not exist"})
+	// An existing vote by the user has its value changed
+	isNew, err := postService.CreatePostVote(postVote)
+	if err != nil {
+		rest.AbortWithError(c, err)
 		return
 	}
-	// If a vote already exists, return it
-	existingPostVote, _ := postService.GetPostVote(uint64(postVote.PostID), postVote.UserID)
-	if existingPostVote.UserID != "" {
-		c.JSON(http.StatusOK, existingPostVote)
+	status := http.StatusOK
+	if isNew {
+		status = http.StatusCreated
+	}
+	c.JSON(status, postVote)
+}
+
+// voterID returns the ID of the user making the request, whose vote is to be
+// retracted. The userId query parameter may name them too, but the request is
+// aborted with Forbidden if it names anyone else or the request is anonymous.
+func voterID(c *gin.Context) (string, bool) {
+	userID := getViewerID(c)
+	if userID == "" || (c.Query("userId") != "" && c.Query("userId") != userID) {
+		rest.AbortWithError(c, &errors.Forbidden{Code: "not_voter", Message: "Only the voter may retract a vote"})
+		return "", false
+	}
+	return userID, true
+}
+
+// DeletePostVote retracts the vote of the user making the request on the post
+// identified by the ID in the path.
+func DeletePostVote(c *gin.Context) {
+	postService := getPostServiceFromContext(c)
+	postID := uint64(c.GetInt64("ID"))
+	userID, ok := voterID(c)
+	if !ok {
 		return
 	}
-	err = postService.CreatePostVote(postVote)
+	postVote, err := postService.GetPostVote(postID, userID)
 	if err != nil {
-		handleServiceError(err, c)
+		rest.AbortWithError(c, err)
+		return
+	}
+	if err := postService.DeletePostVote(&postVote); err != nil {
+		rest.AbortWithError(c, err)
 		return
 	}
-	c.JSON(http.StatusCreated, postVote)
+	c.JSON(http.StatusNoContent, gin.H{})
 }
 
 func GetPostVoteTotalForPost(c *gin.Context) {
 	postService := getPostServiceFromContext(c)
 	postID := uint64(c.GetInt64("ID"))
-	total := postService.GetPostVoteTotalForPost(postID)
+	if _, ok := getVisiblePost(c, postID); !ok {
+		return
+	}
+	total, err := postService.GetPostVoteTotalForPost(postID)
+	if err != nil {
+		rest.AbortWithError(c, err)
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"total": total})
 }
 
 func GetPostVoteUsersForPost(c *gin.Context) {
 	postService := getPostServiceFromContext(c)
 	postID := uint64(c.GetInt64("ID"))
-	userIDs := postService.GetPostVoteUsersForPost(postID)
+	if _, ok := getVisiblePost(c, postID); !ok {
+		return
+	}
+	userIDs, err := postService.GetPostVoteUsersForPost(postID)
+	if err != nil {
+		rest.AbortWithError(c, err)
+		return
+	}
 	c.JSON(http.StatusOK, &userIDs)
 }
 
-func CreatePostSave(c *gin.Context) {
+func CreatePostCommentVote(c *gin.Context) {
 	postService := getPostServiceFromContext(c)
-	postSave := models.PostSave{}
-	err := c.ShouldBindJSON(&postSave)
+	postCommentVote := &models.PostCommentVote{}
+	if !bindJSON(c, postCommentVote) {
+		return
+	}
+	if postCommentVote.Value >= 0 {
+		postCommentVote.Value = 1
+	} else if postCommentVote.Value < 0 {
+		postCommentVote.Value = -1
+	}
+	// Check the comment actually exists and is visible to the voter
+	if _, err := findVisiblePostComment(c, uint64(postCommentVote.PostCommentID)); err != nil {
+		if _, ok := err.(*errors.NotFound); ok {
+			err = errors.InvalidField("commentId", "not_found", "Comment matching id does not exist")
+		}
+		rest.AbortWithError(c, err)
+		return
+	}
+	// An existing vote by the user has its value changed
+	isNew, err := postService.CreatePostCommentVote(postCommentVote)
 	if err != nil {
-		c.AbortWithStatusJSON(
-			http.StatusBadRequest,
-			gin.H{"status": http.StatusBadRequest, "message": err.Error()})
+		rest.AbortWithError(c, err)
 		return
 	}
-	// Check the post actually exists
-	postExists, err := postService.PostExists(uint64(postSave.PostID))
+	status := http.StatusOK
+	if isNew {
+		status = http.StatusCreated
+	}
+	c.JSON(status, postCommentVote)
+}
+
+// DeletePostCommentVote retracts the vote of the user making the request on
+// the comment identified by the ID in the path.
+func DeletePostCommentVote(c *gin.Context) {
+	postService := getPostServiceFromContext(c)
+	postCommentID := uint64(c.GetInt64("ID"))
+	userID, ok := voterID(c)
+	if !ok {
+		return
+	}
+	postCommentVote, err := postService.GetPostCommentVote(postCommentID, userID)
 	if err != nil {
-		c.AbortWithStatusJSON(
-			http.StatusBadRequest,
-			gin.H{"status": http.StatusBadRequest, "message": err.Error()})
+		rest.AbortWithError(c, err)
 		return
 	}
-	if !postExists {
-		c.AbortWithStatusJSON(
-			http.StatusBadRequest,
-			gin.H{"status": http.StatusBadRequest, "message": "Post matching id does not exist"})
+	if err := postService.DeletePostCommentVote(&postCommentVote); err != nil {
+		rest.AbortWithError(c, err)
 		return
 	}
-	var isNew bool
-	postSave, isNew, err = postService.CreatePostSave(&postSave)
+	c.JSON(http.StatusNoContent, gin.H{})
+}
+
+func GetPostCommentVoteTotalForPostComment(c *gin.Context) {
+	postService := getPostServiceFromContext(c)
+	postCommentID := uint64(c.GetInt64("ID"))
+	if _, ok := getVisiblePostComment(c, postCommentID); !ok {
+		return
+	}
+	total, err := postService.GetPostCommentVoteTotalForPostComment(postCommentID)
 	if err != nil {
-		handleServiceError(err, c)
+		rest.AbortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"total": total})
+}
+
+func GetPostCommentVoteUsersForPostComment(c *gin.Context) {
+	postService := getPostServiceFromContext(c)
+	postCommentID := uint64(c.GetInt64("ID"))
+	if _, ok := getVisiblePostComment(c, postCommentID); !ok {
+		return
+	}
+	userIDs, err := postService.GetPostCommentVoteUsersForPostComment(postCommentID)
+	if err != nil {
+		rest.AbortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, &userIDs)
+}
+
+func CreatePostSave(c *gin.Context) {
+	postService := getPostServiceFromContext(c)
+	postSave := models.PostSave{}
+	if !bindJSON(c, &postSave) {
+		return
+	}
+	// Check the post actually exists and is visible to the user saving it
+	if _, err := findVisiblePost(c, uint64(postSave.PostID)); err != nil {
+		if _, ok := err.(*errors.NotFound); ok {
+			err = errors.InvalidField("postId", "not_found", "Post matching id does not exist")
+		}
+		rest.AbortWithError(c, err)
+		return
+	}
+	postSave, isNew, err := postService.CreatePostSave(&postSave)
+	if err != nil {
+		rest.AbortWithError(c, err)
 		return
 	}
 	var status int
@@ -310,9 +1226,12 @@ func CreatePostSave(c *gin.Context) {
 func GetPostSaves(c *gin.Context) {
 	postService := getPostServiceFromContext(c)
 	postID := uint64(c.GetInt64("ID"))
+	if _, ok := getVisiblePost(c, postID); !ok {
+		return
+	}
 	postSaves, err := postService.GetPostSaves(postID, "")
 	if err != nil {
-		handleServiceError(err, c)
+		rest.AbortWithError(c, err)
 		return
 	}
 	c.JSON(http.StatusCreated, postSaves)
@@ -323,11 +1242,11 @@ func DeletePostSave(c *gin.Context) {
 	postSaveID := uint64(c.GetInt64("ID"))
 	postSave, err := postService.GetPostSave(postSaveID)
 	if err != nil {
-		handleServiceError(err, c)
+		rest.AbortWithError(c, err)
 		return
 	}
 	if err := postService.DeletePostSave(&postSave); err != nil {
-		handleServiceError(err, c)
+		rest.AbortWithError(c, err)
 		return
 	}
 	c.JSON(http.StatusNoContent, gin.H{})
@@ -337,8 +1256,35 @@ func GetTags(c *gin.Context) {
 	postService := getPostServiceFromContext(c)
 	tags, err := postService.GetTags()
 	if err != nil {
-		handleServiceError(err, c)
+		rest.AbortWithError(c, err)
 		return
 	}
 	c.JSON(http.StatusOK, tags)
 }
+
+// Search responds with a page of posts and comments matching the q query
+// parameter. The optional type parameter restricts results to posts or
+// comments.
+func Search(c *gin.Context) {
+	postService := getPostServiceFromContext(c)
+	query := c.Query("q")
+	if query == "" {
+		rest.AbortWithError(c, errors.InvalidField("q", "required", "q is required"))
+		return
+	}
+	kind := c.Query("type")
+	if kind != "" && kind != models.SearchResultPost && kind != models.SearchResultComment {
+		rest.AbortWithError(c, errors.InvalidField("type", "one_of", "type must be one of post or comment"))
+		return
+	}
+	limit, ok := pageLimit(c)
+	if !ok {
+		return
+	}
+	results, nextCursor, err := postService.Search(query, kind, c.Query("cursor"), limit)
+	if err != nil {
+		rest.AbortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"nextCursor": nextCursor, "results": results})
+}
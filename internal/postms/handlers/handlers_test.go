@@ -0,0 +1,643 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/willdady/postms/internal/errors"
+	"github.com/willdady/postms/internal/postms/memory"
+	"github.com/willdady/postms/internal/postms/models"
+	"github.com/willdady/postms/internal/postms/services"
+	"github.com/willdady/postms/internal/rest"
+)
+
+// testResources routes requests to the handlers under test in the same way
+// as the server.
+var testResources = rest.ResourceMap{
+	"posts": rest.ActionMap{
+		"create":           CreatePost,
+		"detail":           GetPost,
+		"update":           UpdatePost,
+		"patch":            PatchPost,
+		"*/comments":       GetPostCommentsForPost,
+		"*/total-votes":    GetPostVoteTotalForPost,
+		"*/voted-users":    GetPostVoteUsersForPost,
+		"*/saves":          GetPostSaves,
+		"POST */publish":   PublishPost,
+		"POST */unpublish": UnpublishPost,
+		"POST */schedule":  SchedulePost,
+		"POST */archive":   ArchivePost,
+		"delete":           DeletePost,
+		"POST */restore":   RestorePost,
+	},
+	"comments": rest.ActionMap{
+		"create":         CreatePostComment,
+		"detail":         GetPostComment,
+		"update":         UpdatePostComment,
+		"patch":          PatchPostComment,
+		"delete":         DeletePostComment,
+		"POST */restore": RestorePostComment,
+		"*/total-votes":  GetPostCommentVoteTotalForPostComment,
+		"*/voted-users":  GetPostCommentVoteUsersForPostComment,
+	},
+	"post-votes": rest.ActionMap{
+		"create": CreatePostVote,
+		"delete": DeletePostVote,
+	},
+	"comment-votes": rest.ActionMap{
+		"create": CreatePostCommentVote,
+		"delete": DeletePostCommentVote,
+	},
+	"post-saves": rest.ActionMap{
+		"create": CreatePostSave,
+	},
+	"post-revisions": rest.ActionMap{
+		"POST */restore": RestorePostRevision,
+	},
+	"trash": rest.ActionMap{
+		"list": GetTrash,
+	},
+}
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// newTestRouter returns a router serving the handlers from a new, empty
+// in-memory service.
+func newTestRouter() (*gin.Engine, services.PostService) {
+	return newTestRouterWith(memory.NewPostService())
+}
+
+// newTestRouterWith returns a router serving the handlers from postService.
+func newTestRouterWith(postService services.PostService) (*gin.Engine, services.PostService) {
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("postService", postService)
+		c.Next()
+	})
+	rest.AttachEndpoints(testResources, rest.CacheMap{}, r)
+	return r, postService
+}
+
+// serve makes a request as the user with ID userID, or anonymously if it is
+// empty, sending body as JSON unless it is empty. Further headers are given
+// as name and value pairs.
+func serve(r *gin.Engine, method string, path string, userID string, body string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if userID != "" {
+		req.Header.Set("X-User-ID", userID)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func mustCreatePost(t *testing.T, postService services.PostService, userID string, status string) models.Post {
+	t.Helper()
+	post := models.Post{UserID: userID, Title: "Title", Body: "Body", Status: status}
+	if err := postService.CreatePost(&post); err != nil {
+		t.Fatalf("CreatePost() returned error: %v", err)
+	}
+	return post
+}
+
+func mustCreatePostComment(t *testing.T, postService services.PostService, postID uint, userID string) models.PostComment {
+	t.Helper()
+	postComment := models.PostComment{PostID: postID, UserID: userID, Body: "Comment"}
+	if err := postService.CreatePostComment(&postComment); err != nil {
+		t.Fatalf("CreatePostComment() returned error: %v", err)
+	}
+	return postComment
+}
+
+func TestCommentsOnDraftsArePrivate(t *testing.T) {
+	r, postService := newTestRouter()
+	draft := mustCreatePost(t, postService, "author", models.PostStatusDraft)
+	postComment := mustCreatePostComment(t, postService, draft.ID, "author")
+
+	tests := []struct {
+		method string
+		path   string
+		userID string
+		body   string
+		want   int
+	}{
+		{"GET", fmt.Sprintf("/posts/%d/comments", draft.ID), "", "", http.StatusNotFound},
+		{"GET", fmt.Sprintf("/posts/%d/comments", draft.ID), "other", "", http.StatusNotFound},
+		{"GET", fmt.Sprintf("/posts/%d/comments", draft.ID), "author", "", http.StatusOK},
+		{"GET", fmt.Sprintf("/comments/%d", postComment.ID), "other", "", http.StatusNotFound},
+		{"GET", fmt.Sprintf("/comments/%d", postComment.ID), "author", "", http.StatusOK},
+		{"POST", "/comments", "other", fmt.Sprintf(`{"postId": %d, "userId": "other", "body": "Hi"}`, draft.ID), http.StatusBadRequest},
+		{"POST", "/comments", "author", fmt.Sprintf(`{"postId": %d, "userId": "author", "body": "Hi"}`, draft.ID), http.StatusCreated},
+	}
+	for _, tt := range tests {
+		w := serve(r, tt.method, tt.path, tt.userID, tt.body)
+		if w.Code != tt.want {
+			t.Errorf("%s %s as %q responded with %d, want %d: %s", tt.method, tt.path, tt.userID, w.Code, tt.want, w.Body.String())
+		}
+	}
+	if comments, _, _ := postService.GetPostCommentsForPost(uint64(draft.ID), nil, "", services.SortNewest, 10); len(comments) != 2 {
+		t.Errorf("expected only the author's comment to be created, got %+v", comments)
+	}
+}
+
+func TestOnlyAuthorsChangePostStatus(t *testing.T) {
+	r, postService := newTestRouter()
+	published := mustCreatePost(t, postService, "author", models.PostStatusPublished)
+	draft := mustCreatePost(t, postService, "author", models.PostStatusDraft)
+	schedule := `{"publishAt": "2999-01-01T00:00:00Z"}`
+
+	tests := []struct {
+		path   string
+		userID string
+		body   string
+		want   int
+	}{
+		{fmt.Sprintf("/posts/%d/unpublish", published.ID), "", "", http.StatusForbidden},
+		{fmt.Sprintf("/posts/%d/unpublish", published.ID), "other", "", http.StatusForbidden},
+		{fmt.Sprintf("/posts/%d/archive", published.ID), "other", "", http.StatusForbidden},
+		{fmt.Sprintf("/posts/%d/publish", draft.ID), "other", "", http.StatusNotFound},
+		{fmt.Sprintf("/posts/%d/schedule", draft.ID), "other", schedule, http.StatusNotFound},
+		{fmt.Sprintf("/posts/%d/archive", published.ID), "author", "", http.StatusOK},
+		{fmt.Sprintf("/posts/%d/schedule", draft.ID), "author", schedule, http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := serve(r, "POST", tt.path, tt.userID, tt.body)
+		if w.Code != tt.want {
+			t.Errorf("POST %s as %q responded with %d, want %d: %s", tt.path, tt.userID, w.Code, tt.want, w.Body.String())
+		}
+	}
+	if post, err := postService.GetPost(uint64(published.ID)); err != nil || post.Status != models.PostStatusArchived {
+		t.Errorf("expected only the author to change the status, got %q, %v", post.Status, err)
+	}
+}
+
+func TestOnlyAuthorsManageTheirTrash(t *testing.T) {
+	r, postService := newTestRouter()
+	post := mustCreatePost(t, postService, "author", models.PostStatusPublished)
+	postComment := mustCreatePostComment(t, postService, post.ID, "commenter")
+	purged := mustCreatePost(t, postService, "author", models.PostStatusPublished)
+	if err := postService.DeletePostComment(&postComment); err != nil {
+		t.Fatalf("DeletePostComment() returned error: %v", err)
+	}
+	if err := postService.DeletePost(&purged); err != nil {
+		t.Fatalf("DeletePost() returned error: %v", err)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		userID string
+		want   int
+	}{
+		{"GET", "/trash", "", http.StatusForbidden},
+		{"GET", "/trash?userId=commenter", "other", http.StatusOK},
+		{"POST", fmt.Sprintf("/comments/%d/restore", postComment.ID), "other", http.StatusForbidden},
+		{"DELETE", fmt.Sprintf("/comments/%d?permanent=true", postComment.ID), "author", http.StatusForbidden},
+		{"DELETE", fmt.Sprintf("/posts/%d?permanent=true", purged.ID), "other", http.StatusForbidden},
+		{"DELETE", fmt.Sprintf("/posts/%d?permanent=true", post.ID), "commenter", http.StatusForbidden},
+		{"POST", fmt.Sprintf("/posts/%d/restore", post.ID), "author", http.StatusNotFound},
+		{"POST", fmt.Sprintf("/comments/%d/restore", postComment.ID), "commenter", http.StatusOK},
+		{"DELETE", fmt.Sprintf("/posts/%d?permanent=true", purged.ID), "author", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		w := serve(r, tt.method, tt.path, tt.userID, "")
+		if w.Code != tt.want {
+			t.Errorf("%s %s as %q responded with %d, want %d: %s", tt.method, tt.path, tt.userID, w.Code, tt.want, w.Body.String())
+		}
+	}
+
+	w := serve(r, "GET", "/trash?userId=author", "commenter", "")
+	if strings.Contains(w.Body.String(), `"type":"post"`) {
+		t.Errorf("expected the trash of the user making the request, got %s", w.Body.String())
+	}
+	if _, err := postService.GetPost(uint64(post.ID)); err != nil {
+		t.Errorf("expected the post to survive deletion by another user, got %v", err)
+	}
+	if _, err := postService.GetDeletedPost(uint64(purged.ID)); err == nil {
+		t.Error("expected the author to purge their post from the trash")
+	}
+}
+
+func TestBindingErrors(t *testing.T) {
+	r, postService := newTestRouter()
+	draft := mustCreatePost(t, postService, "author", models.PostStatusDraft)
+	schedule := fmt.Sprintf("/posts/%d/schedule", draft.ID)
+
+	tests := []struct {
+		path string
+		body string
+		want string
+	}{
+		{"/posts", `{"userId": "author", "title": 5, "body": "Body"}`, `"message":"title must be a string"`},
+		{"/posts", `{"userId": "author", "title": "Title", "body": "Body", "tags": "news"}`, `"message":"tags must be an array"`},
+		{"/posts", `{"userId": "author", "title": "Title", "body": "Body", "publishAt": "tomorrow"}`, `"message":"publishAt must be an RFC 3339 timestamp"`},
+		{schedule, `{"publishAt": 5}`, `"message":"publishAt must be an RFC 3339 timestamp"`},
+		{schedule, `{"publishAt": "tomorrow"}`, `"message":"publishAt must be an RFC 3339 timestamp"`},
+		{schedule, `{"publishAt": `, `"detail":"Request body is not valid JSON"`},
+		{schedule, ` `, `"detail":"Request body is empty"`},
+		{"/posts", `[1]`, `"detail":"Request body must be a JSON object"`},
+		{schedule, `"tomorrow"`, `"detail":"Request body must be a JSON object"`},
+		{"/posts", `null`, `"detail":"Request body must be a JSON object"`},
+	}
+	for _, tt := range tests {
+		w := serve(r, "POST", tt.path, "author", tt.body)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tt.want) {
+			t.Errorf("POST %s with %s responded with %d %s, want 400 containing %s", tt.path, tt.body, w.Code, w.Body.String(), tt.want)
+		}
+		if strings.Contains(w.Body.String(), `"field":""`) {
+			t.Errorf("POST %s with %s named an empty field: %s", tt.path, tt.body, w.Body.String())
+		}
+		if strings.Contains(w.Body.String(), "parsing time") {
+			t.Errorf("POST %s with %s leaked the parse error: %s", tt.path, tt.body, w.Body.String())
+		}
+	}
+}
+
+// unavailablePostService fails to get posts and comments as though the
+// database could not be reached.
+type unavailablePostService struct {
+	services.PostService
+}
+
+func (service unavailablePostService) GetPost(postID uint64) (models.Post, error) {
+	return models.Post{}, &errors.Unavailable{Code: "database_unavailable"}
+}
+
+func (service unavailablePostService) GetPostComment(postCommentID uint64) (models.PostComment, error) {
+	return models.PostComment{}, &errors.Unavailable{Code: "database_unavailable"}
+}
+
+func TestCreatePostCommentErrors(t *testing.T) {
+	r, postService := newTestRouter()
+	post := mustCreatePost(t, postService, "author", models.PostStatusPublished)
+	other := mustCreatePost(t, postService, "author", models.PostStatusPublished)
+	parent := mustCreatePostComment(t, postService, other.ID, "author")
+	unavailable, _ := newTestRouterWith(unavailablePostService{postService})
+
+	tests := []struct {
+		r    *gin.Engine
+		body string
+		want int
+		code string
+	}{
+		{r, `{"postId": 999, "userId": "author", "body": "Hi"}`, http.StatusBadRequest, `"field":"postId"`},
+		{r, fmt.Sprintf(`{"postId": %d, "parentId": 999, "userId": "author", "body": "Hi"}`, post.ID), http.StatusBadRequest, `"field":"parentId"`},
+		{r, fmt.Sprintf(`{"postId": %d, "parentId": %d, "userId": "author", "body": "Hi"}`, post.ID, parent.ID), http.StatusBadRequest, `"field":"parentId"`},
+		{unavailable, fmt.Sprintf(`{"postId": %d, "userId": "author", "body": "Hi"}`, post.ID), http.StatusServiceUnavailable, `"code":"database_unavailable"`},
+	}
+	for _, tt := range tests {
+		w := serve(tt.r, "POST", "/comments", "author", tt.body)
+		if w.Code != tt.want || !strings.Contains(w.Body.String(), tt.code) {
+			t.Errorf("POST /comments with %s responded with %d %s, want %d containing %s", tt.body, w.Code, w.Body.String(), tt.want, tt.code)
+		}
+	}
+}
+
+func TestOnlyAuthorsChangePosts(t *testing.T) {
+	r, postService := newTestRouter()
+	draft := mustCreatePost(t, postService, "alice", models.PostStatusDraft)
+	published := mustCreatePost(t, postService, "alice", models.PostStatusPublished)
+	draftComment := mustCreatePostComment(t, postService, draft.ID, "alice")
+	postComment := mustCreatePostComment(t, postService, published.ID, "bob")
+	draftPath := fmt.Sprintf("/posts/%d", draft.ID)
+	publishedPath := fmt.Sprintf("/posts/%d", published.ID)
+	draftCommentPath := fmt.Sprintf("/comments/%d", draftComment.ID)
+	postCommentPath := fmt.Sprintf("/comments/%d", postComment.ID)
+	post := `{"userId": "mallory", "title": "Mine", "body": "Mine"}`
+	comment := fmt.Sprintf(`{"postId": %d, "userId": "mallory", "body": "Mine"}`, published.ID)
+
+	tests := []struct {
+		method string
+		path   string
+		userID string
+		body   string
+		want   int
+	}{
+		{"PUT", draftPath, "mallory", post, http.StatusNotFound},
+		{"PATCH", draftPath, "mallory", `{}`, http.StatusNotFound},
+		{"DELETE", draftPath, "mallory", "", http.StatusNotFound},
+		{"PUT", publishedPath, "mallory", post, http.StatusForbidden},
+		{"PATCH", publishedPath, "mallory", `{"userId": "mallory"}`, http.StatusForbidden},
+		{"PATCH", publishedPath, "", `{}`, http.StatusForbidden},
+		{"DELETE", publishedPath, "mallory", "", http.StatusForbidden},
+		{"PUT", draftCommentPath, "mallory", comment, http.StatusNotFound},
+		{"PATCH", draftCommentPath, "mallory", `{}`, http.StatusNotFound},
+		{"DELETE", draftCommentPath, "mallory", "", http.StatusNotFound},
+		{"PUT", postCommentPath, "mallory", comment, http.StatusForbidden},
+		{"PATCH", postCommentPath, "alice", `{"body": "Mine"}`, http.StatusForbidden},
+		{"DELETE", postCommentPath, "mallory", "", http.StatusForbidden},
+		{"PATCH", draftPath, "alice", `{"userId": "mallory", "title": "New title"}`, http.StatusOK},
+		{"PATCH", postCommentPath, "bob", `{"body": "Edited"}`, http.StatusOK},
+		{"DELETE", postCommentPath, "bob", "", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		w := serve(r, tt.method, tt.path, tt.userID, tt.body)
+		if w.Code != tt.want {
+			t.Errorf("%s %s as %q responded with %d, want %d: %s", tt.method, tt.path, tt.userID, w.Code, tt.want, w.Body.String())
+		}
+		if tt.want == http.StatusNotFound && strings.Contains(w.Body.String(), "Body") {
+			t.Errorf("%s %s as %q leaked the draft: %s", tt.method, tt.path, tt.userID, w.Body.String())
+		}
+	}
+
+	got, err := postService.GetPost(uint64(draft.ID))
+	if err != nil || got.UserID != "alice" || got.Title != "New title" {
+		t.Errorf("expected the author to keep their draft, got %+v, %v", got, err)
+	}
+	if got, err := postService.GetPost(uint64(published.ID)); err != nil || got.UserID != "alice" || got.Title != "Title" {
+		t.Errorf("expected the published post to be unchanged, got %+v, %v", got, err)
+	}
+	if got, err := postService.GetPostComment(uint64(draftComment.ID)); err != nil || got.Body != "Comment" {
+		t.Errorf("expected the comment on the draft to be unchanged, got %+v, %v", got, err)
+	}
+}
+
+func TestRestorePostRevision(t *testing.T) {
+	r, postService := newTestRouter()
+	post := mustCreatePost(t, postService, "alice", models.PostStatusPublished)
+	post.Title = "Second"
+	if err := postService.UpdatePost(&post); err != nil {
+		t.Fatalf("UpdatePost() returned error: %v", err)
+	}
+	revisions, _, err := postService.GetPostRevisions(uint64(post.ID), "", 10)
+	if err != nil || len(revisions) != 2 {
+		t.Fatalf("expected 2 revisions, got %v, %v", revisions, err)
+	}
+	path := fmt.Sprintf("/post-revisions/%d/restore", revisions[1].ID)
+
+	if w := serve(r, "POST", path, "mallory", ""); w.Code != http.StatusForbidden {
+		t.Errorf("expected other users to be forbidden, got %d %s", w.Code, w.Body.String())
+	}
+	if w := serve(r, "POST", path, "alice", "", "If-Match", `"1"`); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected a stale If-Match to fail, got %d %s", w.Code, w.Body.String())
+	}
+	w := serve(r, "POST", path, "alice", "", "If-Match", fmt.Sprintf(`"%d"`, post.Version))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the author to restore the revision, got %d %s", w.Code, w.Body.String())
+	}
+	if got, err := postService.GetPost(uint64(post.ID)); err != nil || got.Title != "Title" || got.Version != post.Version+1 {
+		t.Errorf("expected the first revision to be restored, got %+v, %v", got, err)
+	}
+}
+
+func TestVotesAndSavesOfDraftsArePrivate(t *testing.T) {
+	r, postService := newTestRouter()
+	draft := mustCreatePost(t, postService, "alice", models.PostStatusDraft)
+	postComment := mustCreatePostComment(t, postService, draft.ID, "alice")
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		want   int
+		author int
+	}{
+		{"POST", "/post-votes", fmt.Sprintf(`{"postId": %d, "userId": "%%s", "value": 1}`, draft.ID), http.StatusBadRequest, http.StatusCreated},
+		{"POST", "/comment-votes", fmt.Sprintf(`{"commentId": %d, "userId": "%%s", "value": 1}`, postComment.ID), http.StatusBadRequest, http.StatusCreated},
+		{"POST", "/post-saves", fmt.Sprintf(`{"postId": %d, "userId": "%%s"}`, draft.ID), http.StatusBadRequest, http.StatusCreated},
+		{"GET", fmt.Sprintf("/posts/%d/total-votes", draft.ID), "", http.StatusNotFound, http.StatusOK},
+		{"GET", fmt.Sprintf("/posts/%d/voted-users", draft.ID), "", http.StatusNotFound, http.StatusOK},
+		{"GET", fmt.Sprintf("/posts/%d/saves", draft.ID), "", http.StatusNotFound, http.StatusCreated},
+		{"GET", fmt.Sprintf("/comments/%d/total-votes", postComment.ID), "", http.StatusNotFound, http.StatusOK},
+		{"GET", fmt.Sprintf("/comments/%d/voted-users", postComment.ID), "", http.StatusNotFound, http.StatusOK},
+	}
+	for _, tt := range tests {
+		for _, userID := range []string{"mallory", "alice"} {
+			body := tt.body
+			if body != "" {
+				body = fmt.Sprintf(body, userID)
+			}
+			want := tt.want
+			if userID == "alice" {
+				want = tt.author
+			}
+			w := serve(r, tt.method, tt.path, userID, body)
+			if w.Code != want {
+				t.Errorf("%s %s as %q responded with %d, want %d: %s", tt.method, tt.path, userID, w.Code, want, w.Body.String())
+			}
+		}
+	}
+	if users, err := postService.GetPostVoteUsersForPost(uint64(draft.ID)); err != nil || len(users) != 1 {
+		t.Errorf("expected only the author to vote, got %v, %v", users, err)
+	}
+}
+
+func TestOnlyVotersRetractPostVotes(t *testing.T) {
+	r, postService := newTestRouter()
+	post := mustCreatePost(t, postService, "alice", models.PostStatusPublished)
+	if _, err := postService.CreatePostVote(&models.PostVote{PostID: post.ID, UserID: "bob", Value: 1}); err != nil {
+		t.Fatalf("CreatePostVote() returned error: %v", err)
+	}
+
+	tests := []struct {
+		path   string
+		userID string
+		want   int
+	}{
+		{fmt.Sprintf("/post-votes/%d?userId=bob", post.ID), "", http.StatusForbidden},
+		{fmt.Sprintf("/post-votes/%d?userId=bob", post.ID), "mallory", http.StatusForbidden},
+		{fmt.Sprintf("/post-votes/%d", post.ID), "mallory", http.StatusNotFound},
+		{fmt.Sprintf("/post-votes/%d", post.ID), "bob", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		w := serve(r, "DELETE", tt.path, tt.userID, "")
+		if w.Code != tt.want {
+			t.Errorf("DELETE %s as %q responded with %d, want %d: %s", tt.path, tt.userID, w.Code, tt.want, w.Body.String())
+		}
+	}
+}
+
+func TestOnlyVotersRetractPostCommentVotes(t *testing.T) {
+	r, postService := newTestRouter()
+	post := mustCreatePost(t, postService, "alice", models.PostStatusPublished)
+	postComment := mustCreatePostComment(t, postService, post.ID, "alice")
+	if _, err := postService.CreatePostCommentVote(&models.PostCommentVote{PostCommentID: postComment.ID, UserID: "bob", Value: 1}); err != nil {
+		t.Fatalf("CreatePostCommentVote() returned error: %v", err)
+	}
+
+	tests := []struct {
+		path   string
+		userID string
+		want   int
+	}{
+		{fmt.Sprintf("/comment-votes/%d?userId=bob", postComment.ID), "", http.StatusForbidden},
+		{fmt.Sprintf("/comment-votes/%d?userId=bob", postComment.ID), "mallory", http.StatusForbidden},
+		{fmt.Sprintf("/comment-votes/%d", postComment.ID), "mallory", http.StatusNotFound},
+		{fmt.Sprintf("/comment-votes/%d?userId=bob", postComment.ID), "bob", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		w := serve(r, "DELETE", tt.path, tt.userID, "")
+		if w.Code != tt.want {
+			t.Errorf("DELETE %s as %q responded with %d, want %d: %s", tt.path, tt.userID, w.Code, tt.want, w.Body.String())
+		}
+	}
+}
+
+func TestETags(t *testing.T) {
+	r, postService := newTestRouter()
+	post := mustCreatePost(t, postService, "alice", models.PostStatusPublished)
+	postComment := mustCreatePostComment(t, postService, post.ID, "alice")
+	postPath := fmt.Sprintf("/posts/%d", post.ID)
+	commentPath := fmt.Sprintf("/comments/%d", postComment.ID)
+
+	for _, path := range []string{postPath, commentPath} {
+		w := serve(r, "GET", path, "alice", "")
+		if etag := w.Header().Get("ETag"); !strings.HasPrefix(etag, `"1-`) {
+			t.Errorf("GET %s responded with ETag %q, want one for version 1", path, etag)
+		}
+	}
+
+	// A patch which changes nothing which may be written keeps the version
+	etag := serve(r, "GET", postPath, "alice", "").Header().Get("ETag")
+	w := serve(r, "PATCH", postPath, "alice", `{"status": "draft", "score": 1000}`)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != etag || !strings.Contains(w.Body.String(), `"version":1`) {
+		t.Errorf("expected an empty patch to keep ETag %s, got %d %v %s", etag, w.Code, w.Header(), w.Body.String())
+	}
+	if revisions, _, err := postService.GetPostRevisions(uint64(post.ID), "", 10); err != nil || len(revisions) != 1 {
+		t.Errorf("expected an empty patch to record no revision, got %v, %v", revisions, err)
+	}
+}
+
+func TestStaleIfMatch(t *testing.T) {
+	r, postService := newTestRouter()
+	post := mustCreatePost(t, postService, "alice", models.PostStatusPublished)
+	postComment := mustCreatePostComment(t, postService, post.ID, "alice")
+	post.Title = "Edited"
+	if err := postService.UpdatePost(&post); err != nil {
+		t.Fatalf("UpdatePost() returned error: %v", err)
+	}
+	postComment.Body = "Edited"
+	if err := postService.UpdatePostComment(&postComment); err != nil {
+		t.Fatalf("UpdatePostComment() returned error: %v", err)
+	}
+	postPath := fmt.Sprintf("/posts/%d", post.ID)
+	commentPath := fmt.Sprintf("/comments/%d", postComment.ID)
+	stale := `"1-abc"`
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{"PUT", postPath, `{"userId": "alice", "title": "Clobbered", "body": "Clobbered"}`},
+		{"PATCH", postPath, `{"title": "Clobbered"}`},
+		{"DELETE", postPath, ""},
+		{"PUT", commentPath, fmt.Sprintf(`{"postId": %d, "userId": "alice", "body": "Clobbered"}`, post.ID)},
+		{"PATCH", commentPath, `{"body": "Clobbered"}`},
+		{"DELETE", commentPath, ""},
+	}
+	for _, tt := range tests {
+		w := serve(r, tt.method, tt.path, "alice", tt.body, "If-Match", stale)
+		if w.Code != http.StatusPreconditionFailed || !strings.Contains(w.Body.String(), `"code":"version_mismatch"`) {
+			t.Errorf("%s %s with a stale If-Match responded with %d, want 412: %s", tt.method, tt.path, w.Code, w.Body.String())
+		}
+	}
+	// The comment is deleted first as it is hidden along with its post
+	for _, path := range []string{commentPath, postPath} {
+		w := serve(r, "GET", path, "alice", "")
+		if strings.Contains(w.Body.String(), "Clobbered") || !strings.Contains(w.Body.String(), `"version":2`) {
+			t.Errorf("expected %s to be unchanged, got %s", path, w.Body.String())
+		}
+		etag := w.Header().Get("ETag")
+		if w := serve(r, "DELETE", path, "alice", "", "If-Match", etag); w.Code != http.StatusNoContent {
+			t.Errorf("DELETE %s with the current ETag responded with %d: %s", path, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestPatchPost(t *testing.T) {
+	r, postService := newTestRouter()
+	post := mustCreatePost(t, postService, "alice", models.PostStatusPublished)
+	path := fmt.Sprintf("/posts/%d", post.ID)
+
+	tests := []struct {
+		contentType string
+		body        string
+		want        int
+		contains    string
+	}{
+		{"application/merge-patch+json", `{"title": "Merged"}`, http.StatusOK, `"title":"Merged"`},
+		{"application/json", `{"body": "Merged"}`, http.StatusOK, `"body":"Merged"`},
+		{"text/plain", `{"title": "Plain"}`, http.StatusUnsupportedMediaType, `"status":415`},
+		{"application/merge-patch+json", `{"title": null}`, http.StatusBadRequest, `"field":"title"`},
+		{"application/merge-patch+json", `{"body": null}`, http.StatusBadRequest, `"field":"body"`},
+		{"application/merge-patch+json", `[1]`, http.StatusBadRequest, `"code":"malformed_body"`},
+		{"application/merge-patch+json", `"title"`, http.StatusBadRequest, `"code":"malformed_body"`},
+		{"application/merge-patch+json", `{"title": `, http.StatusBadRequest, `"code":"malformed_body"`},
+	}
+	for _, tt := range tests {
+		w := serve(r, "PATCH", path, "alice", tt.body, "Content-Type", tt.contentType)
+		if w.Code != tt.want || !strings.Contains(w.Body.String(), tt.contains) {
+			t.Errorf("PATCH %s as %s with %s responded with %d %s, want %d containing %s", path, tt.contentType, tt.body, w.Code, w.Body.String(), tt.want, tt.contains)
+		}
+	}
+
+	// Fields which are not set directly are ignored rather than rejected
+	w := serve(r, "PATCH", path, "alice", `{"id": 999, "userId": "mallory", "status": "draft", "score": 1000, "upvotes": 5, "commentCount": 5, "version": 99, "tags": ["go"]}`, "Content-Type", "application/merge-patch+json")
+	if w.Code != http.StatusOK {
+		t.Fatalf("PATCH %s with read-only fields responded with %d: %s", path, w.Code, w.Body.String())
+	}
+	patched, err := postService.GetPost(uint64(post.ID))
+	if err != nil {
+		t.Fatalf("GetPost() returned error: %v", err)
+	}
+	if patched.UserID != "alice" || patched.Status != models.PostStatusPublished || patched.Score != 0 || patched.Upvotes != 0 || patched.CommentCount != 0 || patched.Version != 4 {
+		t.Errorf("expected read-only fields to be ignored, got %+v", patched)
+	}
+	if patched.Title != "Merged" || patched.Body != "Merged" || len(patched.Tags) != 1 || patched.Tags[0] != "go" {
+		t.Errorf("expected writable fields to be merged, got %+v", patched)
+	}
+}
+
+func TestPatchPostComment(t *testing.T) {
+	r, postService := newTestRouter()
+	post := mustCreatePost(t, postService, "alice", models.PostStatusPublished)
+	other := mustCreatePost(t, postService, "alice", models.PostStatusPublished)
+	postComment := mustCreatePostComment(t, postService, post.ID, "alice")
+	path := fmt.Sprintf("/comments/%d", postComment.ID)
+
+	tests := []struct {
+		contentType string
+		body        string
+		want        int
+		contains    string
+	}{
+		{"application/merge-patch+json", `{"body": "Merged"}`, http.StatusOK, `"body":"Merged"`},
+		{"application/json", `{"body": "Merged again"}`, http.StatusOK, `"body":"Merged again"`},
+		{"application/xml", `<body>Merged</body>`, http.StatusUnsupportedMediaType, `"status":415`},
+		{"application/merge-patch+json", `{"body": null}`, http.StatusBadRequest, `"field":"body"`},
+		{"application/merge-patch+json", `[1]`, http.StatusBadRequest, `"code":"malformed_body"`},
+		{"application/merge-patch+json", `null`, http.StatusBadRequest, `"code":"malformed_body"`},
+	}
+	for _, tt := range tests {
+		w := serve(r, "PATCH", path, "alice", tt.body, "Content-Type", tt.contentType)
+		if w.Code != tt.want || !strings.Contains(w.Body.String(), tt.contains) {
+			t.Errorf("PATCH %s as %s with %s responded with %d %s, want %d containing %s", path, tt.contentType, tt.body, w.Code, w.Body.String(), tt.want, tt.contains)
+		}
+	}
+
+	// Fields which are not set directly are ignored rather than rejected
+	body := fmt.Sprintf(`{"id": 999, "postId": %d, "userId": "mallory", "score": 1000, "version": 99, "body": "Final"}`, other.ID)
+	if w := serve(r, "PATCH", path, "alice", body, "Content-Type", "application/merge-patch+json"); w.Code != http.StatusOK {
+		t.Fatalf("PATCH %s with read-only fields responded with %d: %s", path, w.Code, w.Body.String())
+	}
+	patched, err := postService.GetPostComment(uint64(postComment.ID))
+	if err != nil {
+		t.Fatalf("GetPostComment() returned error: %v", err)
+	}
+	if patched.PostID != post.ID || patched.UserID != "alice" || patched.Score != 0 || patched.Body != "Final" || patched.Version != 4 {
+		t.Errorf("expected only the body to be merged, got %+v", patched)
+	}
+}
@@ -0,0 +1,76 @@
+package memory
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/willdady/postms/internal/postms/services"
+)
+
+// IdempotencyStore is an in-memory implementation of services.IdempotencyStore.
+type IdempotencyStore struct {
+	mu      sync.Mutex
+	records map[string]services.IdempotencyRecord
+}
+
+func NewIdempotencyStore() *IdempotencyStore {
+	return &IdempotencyStore{records: make(map[string]services.IdempotencyRecord)}
+}
+
+// copyIdempotencyRecord returns a copy of record which shares no memory with
+// the original.
+func copyIdempotencyRecord(record services.IdempotencyRecord) services.IdempotencyRecord {
+	record.Header = record.Header.Clone()
+	if record.Body != nil {
+		record.Body = append(record.Body[:0:0], record.Body...)
+	}
+	return record
+}
+
+func (store *IdempotencyStore) Claim(key string, fingerprint string, expiredBefore time.Time) (services.IdempotencyRecord, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if record, ok := store.records[key]; ok && !record.CreatedAt.Before(expiredBefore) {
+		return copyIdempotencyRecord(record), false, nil
+	}
+	record := services.IdempotencyRecord{Key: key, Fingerprint: fingerprint, CreatedAt: time.Now()}
+	store.records[key] = record
+	return record, true, nil
+}
+
+func (store *IdempotencyStore) Complete(key string, status int, header http.Header, body []byte) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	record, ok := store.records[key]
+	if !ok {
+		return nil
+	}
+	record.Status = status
+	record.Header = header
+	record.Body = body
+	store.records[key] = copyIdempotencyRecord(record)
+	return nil
+}
+
+func (store *IdempotencyStore) Release(key string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if record, ok := store.records[key]; ok && record.Status == 0 {
+		delete(store.records, key)
+	}
+	return nil
+}
+
+func (store *IdempotencyStore) DeleteExpired(expiredBefore time.Time) (int64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	var count int64
+	for key, record := range store.records {
+		if record.CreatedAt.Before(expiredBefore) {
+			delete(store.records, key)
+			count++
+		}
+	}
+	return count, nil
+}
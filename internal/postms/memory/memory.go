@@ -0,0 +1,925 @@
+package memory
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/willdady/postms/internal/errors"
+	"github.com/willdady/postms/internal/postms/models"
+	"github.com/willdady/postms/internal/postms/services"
+	"github.com/willdady/postms/internal/utils"
+)
+
+type postVoteKey struct {
+	PostID uint
+	UserID string
+}
+
+type postCommentVoteKey struct {
+	PostCommentID uint
+	UserID        string
+}
+
+// PostService is an in-memory implementation of services.PostService. It is
+// safe for concurrent use and mirrors the behaviour of postgres.PostService so
+// the service can be run without a database.
+type PostService struct {
+	mu sync.RWMutex
+
+	posts            map[uint]models.Post
+	postComments     map[uint]models.PostComment
+	postVotes        map[postVoteKey]models.PostVote
+	postCommentVotes map[postCommentVoteKey]models.PostCommentVote
+	postSaves        map[uint]models.PostSave
+	postRevisions    map[uint]models.PostRevision
+	postSlugs        map[string]models.PostSlug
+
+	postCommentRevisions map[uint]models.PostCommentRevision
+
+	lastPostID                uint
+	lastPostCommentID         uint
+	lastPostSaveID            uint
+	lastPostRevisionID        uint
+	lastPostCommentRevisionID uint
+}
+
+func NewPostService() *PostService {
+	return &PostService{
+		posts:            make(map[uint]models.Post),
+		postComments:     make(map[uint]models.PostComment),
+		postVotes:        make(map[postVoteKey]models.PostVote),
+		postCommentVotes: make(map[postCommentVoteKey]models.PostCommentVote),
+		postSaves:        make(map[uint]models.PostSave),
+		postRevisions:    make(map[uint]models.PostRevision),
+		postSlugs:        make(map[string]models.PostSlug),
+
+		postCommentRevisions: make(map[uint]models.PostCommentRevision),
+	}
+}
+
+// copyPost returns a copy of post which shares no memory with the original.
+func copyPost(post models.Post) models.Post {
+	if post.Tags != nil {
+		post.Tags = append(post.Tags[:0:0], post.Tags...)
+	}
+	if post.DeletedAt != nil {
+		deletedAt := *post.DeletedAt
+		post.DeletedAt = &deletedAt
+	}
+	if post.PublishedAt != nil {
+		publishedAt := *post.PublishedAt
+		post.PublishedAt = &publishedAt
+	}
+	if post.PublishAt != nil {
+		publishAt := *post.PublishAt
+		post.PublishAt = &publishAt
+	}
+	return post
+}
+
+// copyPostRevision returns a copy of postRevision which shares no memory with
+// the original.
+func copyPostRevision(postRevision models.PostRevision) models.PostRevision {
+	if postRevision.Tags != nil {
+		postRevision.Tags = append(postRevision.Tags[:0:0], postRevision.Tags...)
+	}
+	return postRevision
+}
+
+// addPostRevision records the current content of post as its next revision.
+// The caller must hold the write lock.
+func (service *PostService) addPostRevision(post *models.Post, now time.Time) {
+	number := 1
+	for _, r := range service.postRevisions {
+		if r.PostID == post.ID && r.Number >= number {
+			number = r.Number + 1
+		}
+	}
+	revision := models.NewPostRevision(post, number)
+	service.lastPostRevisionID++
+	revision.ID = service.lastPostRevisionID
+	revision.CreatedAt = now
+	service.postRevisions[revision.ID] = revision
+}
+
+// setPostSlug sets the slug of post as described by services.PostService,
+// where current is its slug before the change and frozen is true if it must
+// be kept unless replaced. It records the slug in the slug history. The caller
+// must hold the write lock.
+func (service *PostService) setPostSlug(post *models.Post, current string, frozen bool, now time.Time) error {
+	taken := func(slug string) bool {
+		s, ok := service.postSlugs[slug]
+		return ok && s.PostID != post.ID
+	}
+	switch {
+	case post.Slug != "" && post.Slug != current:
+		if taken(post.Slug) {
+			return &errors.SlugTaken{}
+		}
+	case post.Slug != "" || (current != "" && frozen):
+		post.Slug = current
+	default:
+		base := models.SlugBase(post.Title)
+		if current != "" && models.HasSlugBase(current, base) {
+			post.Slug = current
+			break
+		}
+		for n := 1; ; n++ {
+			post.Slug = models.SlugCandidate(base, n)
+			if !taken(post.Slug) {
+				break
+			}
+		}
+	}
+	if _, ok := service.postSlugs[post.Slug]; !ok {
+		service.postSlugs[post.Slug] = models.PostSlug{Slug: post.Slug, PostID: post.ID, CreatedAt: now}
+	}
+	return nil
+}
+
+// copyPostComment returns a copy of postComment which shares no memory with the
+// original.
+func copyPostComment(postComment models.PostComment) models.PostComment {
+	if postComment.ParentID != nil {
+		parentID := *postComment.ParentID
+		postComment.ParentID = &parentID
+	}
+	if postComment.DeletedAt != nil {
+		deletedAt := *postComment.DeletedAt
+		postComment.DeletedAt = &deletedAt
+	}
+	if postComment.EditedAt != nil {
+		editedAt := *postComment.EditedAt
+		postComment.EditedAt = &editedAt
+	}
+	return postComment
+}
+
+// addPostCommentRevision records the current body of postComment as its next
+// revision. The caller must hold the write lock.
+func (service *PostService) addPostCommentRevision(postComment *models.PostComment, now time.Time) {
+	revision := models.NewPostCommentRevision(postComment)
+	service.lastPostCommentRevisionID++
+	revision.ID = service.lastPostCommentRevisionID
+	revision.CreatedAt = now
+	service.postCommentRevisions[revision.ID] = revision
+}
+
+func (service *PostService) CreatePost(post *models.Post) error {
+	post.BeforeSave()
+	post.BeforeCreate()
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	now := time.Now()
+	post.ResetCounters()
+	service.lastPostID++
+	post.ID = service.lastPostID
+	post.CreatedAt = now
+	post.UpdatedAt = now
+	if post.Status == "" {
+		post.Status = models.PostStatusPublished
+	}
+	post.PublishedAt = nil
+	post.SetStatus(post.Status, now)
+	post.UpdateRanks()
+	post.Version = 1
+	if err := service.setPostSlug(post, "", false, now); err != nil {
+		return err
+	}
+	service.posts[post.ID] = copyPost(*post)
+	service.addPostRevision(post, now)
+	return nil
+}
+
+func (service *PostService) UpdatePost(post *models.Post) error {
+	post.BeforeSave()
+	post.BeforeUpdate()
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	existing, ok := service.posts[post.ID]
+	if !ok || existing.DeletedAt != nil {
+		return &errors.NotFound{}
+	}
+	if post.Version != 0 && post.Version != existing.Version {
+		return &errors.VersionMismatch{}
+	}
+	// Counters are only ever changed by votes and comments and the status
+	// only by UpdatePostStatus
+	post.CopyCounters(&existing)
+	post.Status = existing.Status
+	post.PublishedAt = existing.PublishedAt
+	post.PublishAt = existing.PublishAt
+	post.UpdatedAt = time.Now()
+	if err := service.setPostSlug(post, existing.Slug, !models.IsPrivatePostStatus(existing.Status), post.UpdatedAt); err != nil {
+		return err
+	}
+	if post.SameContent(&existing) {
+		*post = copyPost(existing)
+		return nil
+	}
+	post.Version = existing.Version + 1
+	service.posts[post.ID] = copyPost(*post)
+	service.addPostRevision(post, post.UpdatedAt)
+	return nil
+}
+
+func (service *PostService) UpdatePostStatus(post *models.Post, status string) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	existing, ok := service.posts[post.ID]
+	if !ok || existing.DeletedAt != nil {
+		return &errors.NotFound{}
+	}
+	now := time.Now()
+	post.SetStatus(status, now)
+	post.UpdatedAt = now
+	post.Version = existing.Version + 1
+	existing.Status = post.Status
+	existing.PublishedAt = post.PublishedAt
+	existing.PublishAt = post.PublishAt
+	existing.UpdatedAt = now
+	existing.Version = post.Version
+	existing.UpdateRanks()
+	post.Hot = existing.Hot
+	service.posts[post.ID] = copyPost(existing)
+	return nil
+}
+
+func (service *PostService) PublishScheduledPosts(now time.Time) (int, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	count := 0
+	for id, p := range service.posts {
+		if p.DeletedAt != nil || p.Status != models.PostStatusScheduled || p.PublishAt == nil || p.PublishAt.After(now) {
+			continue
+		}
+		// Posts are published as of the time they were scheduled for rather
+		// than whenever the publisher happened to run
+		p.PublishedAt = p.PublishAt
+		p.SetStatus(models.PostStatusPublished, now)
+		p.UpdateRanks()
+		p.UpdatedAt = now
+		p.Version++
+		service.posts[id] = p
+		count++
+	}
+	return count, nil
+}
+
+func (service *PostService) DeletePost(post *models.Post) error {
+	if post.ID == 0 {
+		return &errors.DeleteIsMissingID{}
+	}
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	existing, ok := service.posts[post.ID]
+	if !ok || existing.DeletedAt != nil {
+		return nil
+	}
+	if post.Version != 0 && post.Version != existing.Version {
+		return &errors.VersionMismatch{}
+	}
+	// Comments and saves are deleted along with the post, sharing its
+	// deletion time so RestorePost can tell them apart from those deleted
+	// earlier. Votes are kept but hidden while the post is deleted.
+	now := time.Now()
+	existing.DeletedAt = &now
+	service.posts[post.ID] = existing
+	for id, p := range service.postComments {
+		if p.PostID == post.ID && p.DeletedAt == nil {
+			p.DeletedAt = &now
+			service.postComments[id] = p
+		}
+	}
+	for id, p := range service.postSaves {
+		if p.PostID == post.ID && p.DeletedAt == nil {
+			p.DeletedAt = &now
+			service.postSaves[id] = p
+		}
+	}
+	post.DeletedAt = &now
+	return nil
+}
+
+func (service *PostService) GetPost(postID uint64) (models.Post, error) {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+	p, ok := service.posts[uint(postID)]
+	if !ok || p.DeletedAt != nil {
+		return models.Post{}, &errors.NotFound{}
+	}
+	return copyPost(p), nil
+}
+
+func (service *PostService) GetPostBySlug(slug string) (models.Post, error) {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+	s, ok := service.postSlugs[slug]
+	if !ok {
+		return models.Post{}, &errors.NotFound{}
+	}
+	p, ok := service.posts[s.PostID]
+	if !ok || p.DeletedAt != nil {
+		return models.Post{}, &errors.NotFound{}
+	}
+	return copyPost(p), nil
+}
+
+func (service *PostService) PostExists(postID uint64) (bool, error) {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+	p, ok := service.posts[uint(postID)]
+	return ok && p.DeletedAt == nil, nil
+}
+
+func (service *PostService) GetPosts(query services.PostQuery) ([]models.Post, string, error) {
+	posts := []models.Post{}
+	var cursorKey float64
+	var cursorID uint64
+	if query.Cursor != "" {
+		var err error
+		if cursorKey, cursorID, err = services.DecodePostCursor(query.Cursor, query.Sort); err != nil {
+			return posts, "", &errors.CursorDecodingError{}
+		}
+	}
+	status := query.Status
+	if status == "" {
+		status = models.PostStatusPublished
+	}
+	if models.IsPrivatePostStatus(status) && query.ViewerID == "" {
+		return posts, "", nil
+	}
+	var since time.Time
+	windowed := false
+	if query.Sort == services.SortTop || query.Sort == services.SortControversial {
+		since, windowed = services.WindowStart(query.Window, time.Now())
+	}
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+	for _, p := range service.posts {
+		if p.DeletedAt != nil {
+			continue
+		}
+		if query.Cursor != "" {
+			key := services.PostSortKey(p, query.Sort)
+			if key > cursorKey || (key == cursorKey && uint64(p.ID) > cursorID) {
+				continue
+			}
+		}
+		if p.Status != status || (models.IsPrivatePostStatus(status) && p.UserID != query.ViewerID) {
+			continue
+		}
+		if query.UserID != "" && p.UserID != query.UserID {
+			continue
+		}
+		if query.Tag != "" && !containsString(p.Tags, query.Tag) {
+			continue
+		}
+		if windowed && p.CreatedAt.Before(since) {
+			continue
+		}
+		posts = append(posts, copyPost(p))
+	}
+	services.SortPosts(posts, query.Sort)
+	// Note we over-fetch by 1 so we can check if there are more items
+	limit := 101
+	if len(posts) > limit {
+		posts = posts[:limit]
+	}
+	nextCursor := ""
+	if len(posts) == limit {
+		lastItem := posts[len(posts)-1]
+		nextCursor = services.EncodePostCursor(lastItem, query.Sort)
+		posts = posts[:len(posts)-1]
+	}
+	return posts, nextCursor, nil
+}
+
+func (service *PostService) GetPostRevisions(postID uint64, cursor string, limit int) ([]models.PostRevision, string, error) {
+	postRevisions := make([]models.PostRevision, 0)
+	var cursorID int64 = -1
+	if cursor != "" {
+		values, err := utils.DecodeCursor(cursor, 1)
+		if err != nil {
+			return postRevisions, "", &errors.CursorDecodingError{}
+		}
+		cursorID = values[0]
+	}
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+	for _, r := range service.postRevisions {
+		if uint64(r.PostID) != postID || (cursorID >= 0 && int64(r.ID) > cursorID) {
+			continue
+		}
+		postRevisions = append(postRevisions, copyPostRevision(r))
+	}
+	sort.Slice(postRevisions, func(i, j int) bool {
+		return postRevisions[i].ID > postRevisions[j].ID
+	})
+	// Note we over-fetch by 1 so we can check if there are more items
+	nextCursor := ""
+	if len(postRevisions) > limit {
+		nextCursor = utils.EncodeCursor(int64(postRevisions[limit].ID))
+		postRevisions = postRevisions[:limit]
+	}
+	return postRevisions, nextCursor, nil
+}
+
+func (service *PostService) GetPostRevision(postRevisionID uint64) (models.PostRevision, error) {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+	r, ok := service.postRevisions[uint(postRevisionID)]
+	if !ok {
+		return models.PostRevision{}, &errors.NotFound{}
+	}
+	return copyPostRevision(r), nil
+}
+
+func (service *PostService) CreatePostComment(postComment *models.PostComment) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	now := time.Now()
+	service.lastPostCommentID++
+	postComment.ID = service.lastPostCommentID
+	postComment.CreatedAt = now
+	postComment.UpdatedAt = now
+	postComment.EditedAt = nil
+	postComment.EditCount = 0
+	postComment.Version = 1
+	service.postComments[postComment.ID] = copyPostComment(*postComment)
+	service.addPostCommentRevision(postComment, now)
+	service.adjustPostCommentCount(postComment.PostID, 1)
+	return nil
+}
+
+func (service *PostService) UpdatePostComment(postComment *models.PostComment) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	existing, ok := service.postComments[postComment.ID]
+	if !ok || existing.DeletedAt != nil {
+		return &errors.NotFound{}
+	}
+	if postComment.Version != 0 && postComment.Version != existing.Version {
+		return &errors.VersionMismatch{}
+	}
+	now := time.Now()
+	// The score is only ever changed by votes
+	postComment.Score = existing.Score
+	postComment.EditedAt = existing.EditedAt
+	postComment.EditCount = existing.EditCount
+	postComment.Version = existing.Version
+	postComment.UpdatedAt = now
+	edited := postComment.Body != existing.Body
+	if edited {
+		postComment.EditedAt = &now
+		postComment.EditCount++
+		postComment.Version++
+	}
+	service.postComments[postComment.ID] = copyPostComment(*postComment)
+	if edited {
+		service.addPostCommentRevision(postComment, now)
+	}
+	return nil
+}
+
+func (service *PostService) GetPostCommentRevisions(postCommentID uint64, cursor string, limit int) ([]models.PostCommentRevision, string, error) {
+	postCommentRevisions := make([]models.PostCommentRevision, 0)
+	var cursorID int64 = -1
+	if cursor != "" {
+		values, err := utils.DecodeCursor(cursor, 1)
+		if err != nil {
+			return postCommentRevisions, "", &errors.CursorDecodingError{}
+		}
+		cursorID = values[0]
+	}
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+	for _, r := range service.postCommentRevisions {
+		if uint64(r.PostCommentID) != postCommentID || (cursorID >= 0 && int64(r.ID) > cursorID) {
+			continue
+		}
+		postCommentRevisions = append(postCommentRevisions, r)
+	}
+	sort.Slice(postCommentRevisions, func(i, j int) bool {
+		return postCommentRevisions[i].ID > postCommentRevisions[j].ID
+	})
+	// Note we over-fetch by 1 so we can check if there are more items
+	nextCursor := ""
+	if len(postCommentRevisions) > limit {
+		nextCursor = utils.EncodeCursor(int64(postCommentRevisions[limit].ID))
+		postCommentRevisions = postCommentRevisions[:limit]
+	}
+	return postCommentRevisions, nextCursor, nil
+}
+
+func (service *PostService) DeletePostComment(postComment *models.PostComment) error {
+	if postComment.ID == 0 {
+		return &errors.DeleteIsMissingID{}
+	}
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	existing, ok := service.postComments[postComment.ID]
+	if !ok || existing.DeletedAt != nil {
+		return nil
+	}
+	if postComment.Version != 0 && postComment.Version != existing.Version {
+		return &errors.VersionMismatch{}
+	}
+	now := time.Now()
+	existing.DeletedAt = &now
+	service.postComments[postComment.ID] = existing
+	service.adjustPostCommentCount(existing.PostID, -1)
+	return nil
+}
+
+func (service *PostService) GetPostComment(postCommentID uint64) (models.PostComment, error) {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+	p, ok := service.postComments[uint(postCommentID)]
+	if !ok || p.DeletedAt != nil {
+		return models.PostComment{}, &errors.NotFound{}
+	}
+	return copyPostComment(p), nil
+}
+
+func (service *PostService) GetPostCommentsForPost(postID uint64, parentID *uint64, cursor string, mode string, limit int) ([]models.PostComment, string, error) {
+	postComments := make([]models.PostComment, 0)
+	var cursorValues []int64
+	if cursor != "" {
+		n := 1
+		if mode == services.SortTop {
+			n = 2
+		}
+		var err error
+		if cursorValues, err = utils.DecodeCursor(cursor, n); err != nil {
+			return postComments, "", &errors.CursorDecodingError{}
+		}
+	}
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+	for _, p := range service.postComments {
+		if p.DeletedAt != nil || uint64(p.PostID) != postID {
+			continue
+		}
+		if parentID != nil {
+			if *parentID == 0 && p.ParentID != nil {
+				continue
+			}
+			if *parentID != 0 && (p.ParentID == nil || uint64(*p.ParentID) != *parentID) {
+				continue
+			}
+		}
+		if cursorValues != nil {
+			id := int64(p.ID)
+			switch mode {
+			case services.SortTop:
+				score := int64(p.Score)
+				if score > cursorValues[0] || (score == cursorValues[0] && id > cursorValues[1]) {
+					continue
+				}
+			case services.SortOldest:
+				if id < cursorValues[0] {
+					continue
+				}
+			default:
+				if id > cursorValues[0] {
+					continue
+				}
+			}
+		}
+		postComments = append(postComments, copyPostComment(p))
+	}
+	services.SortPostComments(postComments, mode)
+	// Note we over-fetch by 1 so we can check if there are more items
+	if len(postComments) > limit+1 {
+		postComments = postComments[:limit+1]
+	}
+	nextCursor := ""
+	if len(postComments) == limit+1 {
+		lastItem := postComments[len(postComments)-1]
+		if mode == services.SortTop {
+			nextCursor = utils.EncodeCursor(int64(lastItem.Score), int64(lastItem.ID))
+		} else {
+			nextCursor = utils.EncodeCursor(int64(lastItem.ID))
+		}
+		postComments = postComments[:len(postComments)-1]
+	}
+	return postComments, nextCursor, nil
+}
+
+func (service *PostService) GetPostCommentReplies(postID uint64, parentIDs []uint64, depth int) ([]models.PostComment, error) {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+	children := make(map[uint64][]models.PostComment)
+	for _, p := range service.postComments {
+		if p.DeletedAt != nil || uint64(p.PostID) != postID || p.ParentID == nil {
+			continue
+		}
+		key := uint64(*p.ParentID)
+		children[key] = append(children[key], copyPostComment(p))
+	}
+	postComments := make([]models.PostComment, 0)
+	var level []models.PostComment
+	for _, parentID := range parentIDs {
+		level = append(level, children[parentID]...)
+	}
+	for i := 1; len(level) > 0 && (depth < 0 || i <= depth+1); i++ {
+		postComments = append(postComments, level...)
+		var next []models.PostComment
+		for _, p := range level {
+			next = append(next, children[uint64(p.ID)]...)
+		}
+		level = next
+	}
+	sort.Slice(postComments, func(i, j int) bool { return postComments[i].ID > postComments[j].ID })
+	return postComments, nil
+}
+
+// livePost and livePostComment report whether a post or comment exists and
+// is not deleted, as votes are hidden while it is deleted. The caller must
+// hold the lock.
+func (service *PostService) livePost(postID uint) bool {
+	p, ok := service.posts[postID]
+	return ok && p.DeletedAt == nil
+}
+
+func (service *PostService) livePostComment(postCommentID uint) bool {
+	p, ok := service.postComments[postCommentID]
+	return ok && p.DeletedAt == nil
+}
+
+func (service *PostService) GetPostVoteTotalForPost(postID uint64) (int64, error) {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+	total := int64(0)
+	if !service.livePost(uint(postID)) {
+		return total, nil
+	}
+	for _, pV := range service.postVotes {
+		if uint64(pV.PostID) == postID {
+			total += int64(pV.Value)
+		}
+	}
+	return total, nil
+}
+
+func (service *PostService) GetPostVote(postID uint64, userID string) (models.PostVote, error) {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+	pV, ok := service.postVotes[postVoteKey{PostID: uint(postID), UserID: userID}]
+	if !ok || !service.livePost(pV.PostID) {
+		return models.PostVote{}, &errors.NotFound{}
+	}
+	return pV, nil
+}
+
+func (service *PostService) GetPostVoteUsersForPost(postID uint64) ([]string, error) {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+	userIDs := make([]string, 0)
+	if !service.livePost(uint(postID)) {
+		return userIDs, nil
+	}
+	for _, pV := range service.postVotes {
+		if uint64(pV.PostID) == postID {
+			userIDs = append(userIDs, pV.UserID)
+		}
+	}
+	sort.Strings(userIDs)
+	return userIDs, nil
+}
+
+// adjustPostVoteCounts applies a vote changing from oldValue to newValue to the
+// counters of a post. The caller must hold the write lock.
+func (service *PostService) adjustPostVoteCounts(postID uint, oldValue int, newValue int) {
+	if p, ok := service.posts[postID]; ok {
+		score, upvotes, downvotes := models.VoteDelta(oldValue, newValue)
+		p.Score += score
+		p.Upvotes += upvotes
+		p.Downvotes += downvotes
+		p.UpdateRanks()
+		p.UpdatedAt = time.Now()
+		service.posts[postID] = p
+	}
+}
+
+// adjustPostCommentCount adds delta to the comment count of a post. The caller
+// must hold the write lock.
+func (service *PostService) adjustPostCommentCount(postID uint, delta int) {
+	if p, ok := service.posts[postID]; ok {
+		p.CommentCount += delta
+		p.UpdatedAt = time.Now()
+		service.posts[postID] = p
+	}
+}
+
+func (service *PostService) CreatePostVote(postVote *models.PostVote) (bool, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	key := postVoteKey{PostID: postVote.PostID, UserID: postVote.UserID}
+	if existing, ok := service.postVotes[key]; ok {
+		if existing.Value != postVote.Value {
+			service.adjustPostVoteCounts(existing.PostID, existing.Value, postVote.Value)
+			existing.Value = postVote.Value
+			service.postVotes[key] = existing
+		}
+		*postVote = existing
+		return false, nil
+	}
+	postVote.CreatedAt = time.Now()
+	service.postVotes[key] = *postVote
+	service.adjustPostVoteCounts(postVote.PostID, 0, postVote.Value)
+	return true, nil
+}
+
+func (service *PostService) DeletePostVote(postVote *models.PostVote) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	key := postVoteKey{PostID: postVote.PostID, UserID: postVote.UserID}
+	existing, ok := service.postVotes[key]
+	if !ok {
+		return &errors.NotFound{}
+	}
+	service.adjustPostVoteCounts(existing.PostID, existing.Value, 0)
+	delete(service.postVotes, key)
+	return nil
+}
+
+func (service *PostService) GetPostCommentVoteTotalForPostComment(postCommentID uint64) (int64, error) {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+	total := int64(0)
+	if !service.livePostComment(uint(postCommentID)) {
+		return total, nil
+	}
+	for _, pCV := range service.postCommentVotes {
+		if uint64(pCV.PostCommentID) == postCommentID {
+			total += int64(pCV.Value)
+		}
+	}
+	return total, nil
+}
+
+func (service *PostService) GetPostCommentVote(postCommentID uint64, userID string) (models.PostCommentVote, error) {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+	pCV, ok := service.postCommentVotes[postCommentVoteKey{PostCommentID: uint(postCommentID), UserID: userID}]
+	if !ok || !service.livePostComment(pCV.PostCommentID) {
+		return models.PostCommentVote{}, &errors.NotFound{}
+	}
+	return pCV, nil
+}
+
+func (service *PostService) GetPostCommentVoteUsersForPostComment(postCommentID uint64) ([]string, error) {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+	userIDs := make([]string, 0)
+	if !service.livePostComment(uint(postCommentID)) {
+		return userIDs, nil
+	}
+	for _, pCV := range service.postCommentVotes {
+		if uint64(pCV.PostCommentID) == postCommentID {
+			userIDs = append(userIDs, pCV.UserID)
+		}
+	}
+	sort.Strings(userIDs)
+	return userIDs, nil
+}
+
+// adjustPostCommentScore adds delta to the score of a comment. The caller must
+// hold the write lock.
+func (service *PostService) adjustPostCommentScore(postCommentID uint, delta int) {
+	if p, ok := service.postComments[postCommentID]; ok {
+		p.Score += delta
+		p.UpdatedAt = time.Now()
+		service.postComments[postCommentID] = p
+	}
+}
+
+func (service *PostService) CreatePostCommentVote(postCommentVote *models.PostCommentVote) (bool, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	key := postCommentVoteKey{PostCommentID: postCommentVote.PostCommentID, UserID: postCommentVote.UserID}
+	if existing, ok := service.postCommentVotes[key]; ok {
+		if existing.Value != postCommentVote.Value {
+			service.adjustPostCommentScore(existing.PostCommentID, postCommentVote.Value-existing.Value)
+			existing.Value = postCommentVote.Value
+			service.postCommentVotes[key] = existing
+		}
+		*postCommentVote = existing
+		return false, nil
+	}
+	postCommentVote.CreatedAt = time.Now()
+	service.postCommentVotes[key] = *postCommentVote
+	service.adjustPostCommentScore(postCommentVote.PostCommentID, postCommentVote.Value)
+	return true, nil
+}
+
+func (service *PostService) DeletePostCommentVote(postCommentVote *models.PostCommentVote) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	key := postCommentVoteKey{PostCommentID: postCommentVote.PostCommentID, UserID: postCommentVote.UserID}
+	existing, ok := service.postCommentVotes[key]
+	if !ok {
+		return &errors.NotFound{}
+	}
+	service.adjustPostCommentScore(existing.PostCommentID, -existing.Value)
+	delete(service.postCommentVotes, key)
+	return nil
+}
+
+func (service *PostService) CreatePostSave(postSave *models.PostSave) (models.PostSave, bool, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	for id, existingPostSave := range service.postSaves {
+		if existingPostSave.PostID == postSave.PostID && existingPostSave.UserID == postSave.UserID {
+			existingPostSave.DeletedAt = nil
+			existingPostSave.UpdatedAt = time.Now()
+			service.postSaves[id] = existingPostSave
+			return existingPostSave, false, nil
+		}
+	}
+	now := time.Now()
+	service.lastPostSaveID++
+	postSave.ID = service.lastPostSaveID
+	postSave.CreatedAt = now
+	postSave.UpdatedAt = now
+	service.postSaves[postSave.ID] = *postSave
+	return *postSave, true, nil
+}
+
+func (service *PostService) GetPostSave(postSaveID uint64) (models.PostSave, error) {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+	p, ok := service.postSaves[uint(postSaveID)]
+	if !ok || p.DeletedAt != nil {
+		return models.PostSave{}, &errors.NotFound{}
+	}
+	return p, nil
+}
+
+func (service *PostService) GetPostSaves(postID uint64, userID string) ([]models.PostSave, error) {
+	results := []models.PostSave{}
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+	for _, p := range service.postSaves {
+		if p.DeletedAt != nil {
+			continue
+		}
+		if postID > 0 && uint64(p.PostID) != postID {
+			continue
+		}
+		if userID != "" && p.UserID != userID {
+			continue
+		}
+		results = append(results, p)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].ID < results[j].ID })
+	return results, nil
+}
+
+func (service *PostService) DeletePostSave(postSave *models.PostSave) error {
+	if postSave.ID == 0 {
+		return &errors.DeleteIsMissingID{}
+	}
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	existing, ok := service.postSaves[postSave.ID]
+	if !ok || existing.DeletedAt != nil {
+		return nil
+	}
+	now := time.Now()
+	existing.DeletedAt = &now
+	service.postSaves[postSave.ID] = existing
+	return nil
+}
+
+func (service *PostService) GetTags() ([]string, error) {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+	seen := make(map[string]bool)
+	tags := []string{}
+	for _, p := range service.posts {
+		if p.DeletedAt != nil || models.IsPrivatePostStatus(p.Status) {
+			continue
+		}
+		for _, tag := range p.Tags {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+func containsString(items []string, value string) bool {
+	for _, item := range items {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
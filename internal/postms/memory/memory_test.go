@@ -0,0 +1,14 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/willdady/postms/internal/postms/services"
+	"github.com/willdady/postms/internal/postms/services/servicestest"
+)
+
+func TestPostService(t *testing.T) {
+	servicestest.Run(t, func(t *testing.T) services.PostService {
+		return NewPostService()
+	})
+}
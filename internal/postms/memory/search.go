@@ -0,0 +1,157 @@
+package memory
+
+import (
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/willdady/postms/internal/errors"
+	"github.com/willdady/postms/internal/postms/models"
+	"github.com/willdady/postms/internal/postms/services"
+)
+
+var searchTermPattern = regexp.MustCompile(`[\pL\pN]+`)
+
+// snippetWords is the number of words either side of the first match included
+// in a snippet.
+const snippetWords = 12
+
+// searchTerms splits a query into lower case terms.
+func searchTerms(query string) []string {
+	return searchTermPattern.FindAllString(strings.ToLower(query), -1)
+}
+
+// matchSearch returns the number of times terms occur in text, or 0 unless
+// every term occurs at least once. Terms match words which begin with them, a
+// crude approximation of the stemming done by Postgres.
+func matchSearch(terms []string, text string) int {
+	words := searchTerms(text)
+	total := 0
+	for _, term := range terms {
+		count := 0
+		for _, word := range words {
+			if strings.HasPrefix(word, term) {
+				count++
+			}
+		}
+		if count == 0 {
+			return 0
+		}
+		total += count
+	}
+	return total
+}
+
+// searchSnippet returns an excerpt of text around the first word matching one
+// of terms, escaped as HTML, with every matching word wrapped in <mark> tags.
+func searchSnippet(terms []string, text string) string {
+	words := strings.Fields(text)
+	matches := func(word string) bool {
+		for _, w := range searchTerms(word) {
+			for _, term := range terms {
+				if strings.HasPrefix(w, term) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	first := -1
+	for i, word := range words {
+		if matches(word) {
+			first = i
+			break
+		}
+	}
+	start, end := 0, len(words)
+	if first >= 0 {
+		if first > snippetWords {
+			start = first - snippetWords
+		}
+		if first+snippetWords+1 < end {
+			end = first + snippetWords + 1
+		}
+	} else if end > 2*snippetWords+1 {
+		end = 2*snippetWords + 1
+	}
+	snippet := make([]string, 0, end-start)
+	for _, word := range words[start:end] {
+		if matches(word) {
+			snippet = append(snippet, "<mark>"+html.EscapeString(word)+"</mark>")
+		} else {
+			snippet = append(snippet, html.EscapeString(word))
+		}
+	}
+	return strings.Join(snippet, " ")
+}
+
+// Search is a naive implementation of full-text search which matches posts and
+// comments containing every term of the query.
+func (service *PostService) Search(query string, kind string, cursor string, limit int) ([]models.SearchResult, string, error) {
+	results := make([]models.SearchResult, 0)
+	var first *models.SearchResult
+	if cursor != "" {
+		result, err := services.DecodeSearchCursor(cursor)
+		if err != nil {
+			return results, "", &errors.CursorDecodingError{}
+		}
+		first = &result
+	}
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return results, "", nil
+	}
+	service.mu.RLock()
+	if kind == "" || kind == models.SearchResultPost {
+		for _, p := range service.posts {
+			if p.DeletedAt != nil || models.IsPrivatePostStatus(p.Status) {
+				continue
+			}
+			if count := matchSearch(terms, p.Title+" "+p.Body); count > 0 {
+				results = append(results, models.SearchResult{
+					Type:    models.SearchResultPost,
+					ID:      p.ID,
+					PostID:  p.ID,
+					Title:   p.Title,
+					Snippet: p.Body,
+					Rank:    float64(count),
+				})
+			}
+		}
+	}
+	if kind == "" || kind == models.SearchResultComment {
+		for _, p := range service.postComments {
+			if p.DeletedAt != nil || models.IsPrivatePostStatus(service.posts[p.PostID].Status) {
+				continue
+			}
+			if count := matchSearch(terms, p.Body); count > 0 {
+				results = append(results, models.SearchResult{
+					Type:    models.SearchResultComment,
+					ID:      p.ID,
+					PostID:  p.PostID,
+					Snippet: p.Body,
+					Rank:    float64(count),
+				})
+			}
+		}
+	}
+	service.mu.RUnlock()
+	sort.Slice(results, func(i, j int) bool {
+		return services.SearchResultBefore(results[i], results[j])
+	})
+	if first != nil {
+		results = results[sort.Search(len(results), func(i int) bool {
+			return !services.SearchResultBefore(results[i], *first)
+		}):]
+	}
+	nextCursor := ""
+	if len(results) > limit {
+		nextCursor = services.EncodeSearchCursor(results[limit])
+		results = results[:limit]
+	}
+	for i := range results {
+		results[i].Snippet = searchSnippet(terms, results[i].Snippet)
+	}
+	return results, nextCursor, nil
+}
@@ -0,0 +1,250 @@
+package memory
+
+import (
+	"sort"
+	"time"
+
+	"github.com/willdady/postms/internal/errors"
+	"github.com/willdady/postms/internal/postms/models"
+	"github.com/willdady/postms/internal/postms/services"
+)
+
+func (service *PostService) GetTrash(userID string, cursor string, limit int) ([]models.TrashItem, string, error) {
+	items := make([]models.TrashItem, 0)
+	var first *models.TrashItem
+	if cursor != "" {
+		item, err := services.DecodeTrashCursor(cursor)
+		if err != nil {
+			return items, "", &errors.CursorDecodingError{}
+		}
+		first = &item
+	}
+	service.mu.RLock()
+	for _, p := range service.posts {
+		if p.DeletedAt == nil || p.UserID != userID {
+			continue
+		}
+		items = append(items, models.TrashItem{
+			Type:      models.TrashItemPost,
+			ID:        p.ID,
+			PostID:    p.ID,
+			Title:     p.Title,
+			Body:      p.Body,
+			DeletedAt: *p.DeletedAt,
+		})
+	}
+	for _, p := range service.postComments {
+		if p.DeletedAt == nil || p.UserID != userID || service.posts[p.PostID].DeletedAt != nil {
+			continue
+		}
+		items = append(items, models.TrashItem{
+			Type:      models.TrashItemComment,
+			ID:        p.ID,
+			PostID:    p.PostID,
+			Body:      p.Body,
+			DeletedAt: *p.DeletedAt,
+		})
+	}
+	service.mu.RUnlock()
+	sort.Slice(items, func(i, j int) bool {
+		return services.TrashItemBefore(items[i], items[j])
+	})
+	if first != nil {
+		items = items[sort.Search(len(items), func(i int) bool {
+			return !services.TrashItemBefore(items[i], *first)
+		}):]
+	}
+	nextCursor := ""
+	if len(items) > limit {
+		nextCursor = services.EncodeTrashCursor(items[limit])
+		items = items[:limit]
+	}
+	return items, nextCursor, nil
+}
+
+func (service *PostService) GetDeletedPost(postID uint64) (models.Post, error) {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+	p, ok := service.posts[uint(postID)]
+	if !ok || p.DeletedAt == nil {
+		return models.Post{}, &errors.NotFound{}
+	}
+	return copyPost(p), nil
+}
+
+func (service *PostService) GetDeletedPostComment(postCommentID uint64) (models.PostComment, error) {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+	p, ok := service.postComments[uint(postCommentID)]
+	if !ok || p.DeletedAt == nil {
+		return models.PostComment{}, &errors.NotFound{}
+	}
+	return copyPostComment(p), nil
+}
+
+func (service *PostService) RestorePost(postID uint64) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	post, ok := service.posts[uint(postID)]
+	if !ok || post.DeletedAt == nil {
+		return &errors.NotFound{}
+	}
+	// Comments and saves deleted along with the post share its deletion time
+	deletedAt := *post.DeletedAt
+	post.DeletedAt = nil
+	for id, p := range service.postComments {
+		if p.PostID == post.ID && p.DeletedAt != nil && p.DeletedAt.Equal(deletedAt) {
+			p.DeletedAt = nil
+			service.postComments[id] = p
+		}
+	}
+	for id, p := range service.postSaves {
+		if p.PostID == post.ID && p.DeletedAt != nil && p.DeletedAt.Equal(deletedAt) {
+			p.DeletedAt = nil
+			service.postSaves[id] = p
+		}
+	}
+	post.CommentCount = 0
+	for _, p := range service.postComments {
+		if p.PostID == post.ID && p.DeletedAt == nil {
+			post.CommentCount++
+		}
+	}
+	post.UpdatedAt = time.Now()
+	service.posts[post.ID] = post
+	return nil
+}
+
+func (service *PostService) RestorePostComment(postCommentID uint64) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	postComment, ok := service.postComments[uint(postCommentID)]
+	if !ok || postComment.DeletedAt == nil {
+		return &errors.NotFound{}
+	}
+	if post, ok := service.posts[postComment.PostID]; !ok || post.DeletedAt != nil {
+		return &errors.RestoreParentIsDeleted{}
+	}
+	postComment.DeletedAt = nil
+	service.postComments[postComment.ID] = postComment
+	service.adjustPostCommentCount(postComment.PostID, 1)
+	return nil
+}
+
+func (service *PostService) PurgePost(postID uint64) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	if _, ok := service.posts[uint(postID)]; !ok {
+		return &errors.NotFound{}
+	}
+	service.purgePost(uint(postID), &services.PurgeReport{})
+	return nil
+}
+
+func (service *PostService) PurgePostComment(postCommentID uint64) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	postComment, ok := service.postComments[uint(postCommentID)]
+	if !ok {
+		return &errors.NotFound{}
+	}
+	service.purgePostComment(postComment.ID, &services.PurgeReport{})
+	if postComment.DeletedAt == nil {
+		service.adjustPostCommentCount(postComment.PostID, -1)
+	}
+	return nil
+}
+
+// PurgeDeleted purges everything in a single pass as there are no table locks
+// to hold for long, so batchSize is ignored.
+func (service *PostService) PurgeDeleted(before time.Time, batchSize int) (services.PurgeReport, error) {
+	report := services.PurgeReport{}
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	expired := func(deletedAt *time.Time) bool {
+		return deletedAt != nil && deletedAt.Before(before)
+	}
+	for id, p := range service.posts {
+		if expired(p.DeletedAt) {
+			service.purgePost(id, &report)
+		}
+	}
+	for id, p := range service.postComments {
+		if expired(p.DeletedAt) {
+			service.purgePostComment(id, &report)
+		}
+	}
+	for id, p := range service.postSaves {
+		if expired(p.DeletedAt) {
+			delete(service.postSaves, id)
+			report.PostSaves++
+		}
+	}
+	return report, nil
+}
+
+// purgePost removes a post along with everything belonging to it, counting
+// what was removed in report. The caller must hold the write lock.
+func (service *PostService) purgePost(postID uint, report *services.PurgeReport) {
+	for id, p := range service.postComments {
+		if p.PostID == postID {
+			service.purgePostComment(id, report)
+		}
+	}
+	for key := range service.postVotes {
+		if key.PostID == postID {
+			delete(service.postVotes, key)
+			report.PostVotes++
+		}
+	}
+	for id, p := range service.postSaves {
+		if p.PostID == postID {
+			delete(service.postSaves, id)
+			report.PostSaves++
+		}
+	}
+	for id, r := range service.postRevisions {
+		if r.PostID == postID {
+			delete(service.postRevisions, id)
+			report.PostRevisions++
+		}
+	}
+	// Slugs are freed for other posts to take
+	for slug, s := range service.postSlugs {
+		if s.PostID == postID {
+			delete(service.postSlugs, slug)
+		}
+	}
+	delete(service.posts, postID)
+	report.Posts++
+}
+
+// purgePostComment removes a comment along with its votes and revisions,
+// counting what was removed in report. Its replies are moved up to its
+// parent. The caller must hold the write lock.
+func (service *PostService) purgePostComment(postCommentID uint, report *services.PurgeReport) {
+	postComment, ok := service.postComments[postCommentID]
+	if !ok {
+		return
+	}
+	for id, p := range service.postComments {
+		if p.ParentID != nil && *p.ParentID == postCommentID {
+			p.ParentID = postComment.ParentID
+			service.postComments[id] = copyPostComment(p)
+		}
+	}
+	for key := range service.postCommentVotes {
+		if key.PostCommentID == postCommentID {
+			delete(service.postCommentVotes, key)
+			report.PostCommentVotes++
+		}
+	}
+	for id, r := range service.postCommentRevisions {
+		if r.PostCommentID == postCommentID {
+			delete(service.postCommentRevisions, id)
+			report.PostCommentRevisions++
+		}
+	}
+	delete(service.postComments, postCommentID)
+	report.PostComments++
+}
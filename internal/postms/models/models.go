@@ -1,10 +1,14 @@
 package models
 
 import (
+	"math"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gosimple/slug"
 	"github.com/lib/pq"
+	"github.com/willdady/postms/internal/diff"
 	"github.com/willdady/postms/internal/utils"
 )
 
@@ -12,52 +16,393 @@ type CommonFields struct {
 	ID        uint       `json:"id" gorm:"primary_key"`
 	CreatedAt time.Time  `json:"createdAt"`
 	UpdatedAt time.Time  `json:"updatedAt"`
-	DeletedAt *time.Time `json:"-"`
+	DeletedAt *time.Time `json:"-" gorm:"index"`
 }
 
 type Post struct {
 	CommonFields
-	UserID string         `json:"userId" binding:"required"`
-	Title  string         `json:"title" binding:"required"`
-	Slug   string         `json:"slug"`
-	Body   string         `json:"body" binding:"required"`
-	Tags   pq.StringArray `json:"tags" gorm:"type:varchar(64)[]"`
+	UserID       string         `json:"userId" binding:"required" gorm:"index"`
+	Title        string         `json:"title" binding:"required"`
+	Slug         string         `json:"slug" gorm:"unique_index"`
+	Body         string         `json:"body" binding:"required"`
+	Tags         pq.StringArray `json:"tags" gorm:"type:varchar(64)[]"`
+	Status       string         `json:"status" gorm:"not null;default:'published';index"`
+	PublishedAt  *time.Time     `json:"publishedAt"`
+	PublishAt    *time.Time     `json:"publishAt" gorm:"index"`
+	Score        int            `json:"score" gorm:"not null;default:0"`
+	Upvotes      int            `json:"upvotes" gorm:"not null;default:0"`
+	Downvotes    int            `json:"downvotes" gorm:"not null;default:0"`
+	CommentCount int            `json:"commentCount" gorm:"not null;default:0"`
+	Hot          float64        `json:"-" gorm:"type:double precision;not null;default:0;index"`
+	Controversy  float64        `json:"-" gorm:"type:double precision;not null;default:0;index"`
+	// Version counts changes to the post from 1 so concurrent edits can be
+	// detected. Changes to its counters are not counted.
+	Version int `json:"version" gorm:"not null;default:1"`
+}
+
+// Statuses of a Post. Drafts and scheduled posts are only visible to their
+// author.
+const (
+	PostStatusDraft     = "draft"
+	PostStatusScheduled = "scheduled"
+	PostStatusPublished = "published"
+	PostStatusArchived  = "archived"
+)
+
+// IsPostStatus reports whether value is a valid status for a post.
+func IsPostStatus(value string) bool {
+	switch value {
+	case PostStatusDraft, PostStatusScheduled, PostStatusPublished, PostStatusArchived:
+		return true
+	}
+	return false
+}
+
+// IsPrivatePostStatus reports whether posts with the given status are only
+// visible to their author.
+func IsPrivatePostStatus(status string) bool {
+	return status == PostStatusDraft || status == PostStatusScheduled
+}
+
+// SetStatus changes the status of p. PublishedAt records when the post was
+// last published and is cleared when it is returned to draft or scheduled.
+// PublishAt is only kept while the post is scheduled.
+func (p *Post) SetStatus(status string, now time.Time) {
+	p.Status = status
+	switch status {
+	case PostStatusPublished:
+		if p.PublishedAt == nil {
+			p.PublishedAt = &now
+		}
+	case PostStatusDraft, PostStatusScheduled:
+		p.PublishedAt = nil
+	}
+	if status != PostStatusScheduled {
+		p.PublishAt = nil
+	}
+}
+
+// VisibleTo reports whether the post may be seen by the user with ID viewerID,
+// which is empty for anonymous users.
+func (p *Post) VisibleTo(viewerID string) bool {
+	return !IsPrivatePostStatus(p.Status) || (viewerID != "" && p.UserID == viewerID)
+}
+
+// PostCounterColumns are the columns of Post which are maintained by votes and
+// comments rather than set directly.
+var PostCounterColumns = []string{"score", "upvotes", "downvotes", "comment_count", "hot", "controversy"}
+
+// PostStatusColumns are the columns of Post which are only changed along with
+// its status.
+var PostStatusColumns = []string{"status", "published_at", "publish_at"}
+
+// ResetCounters zeroes the fields of p which are maintained by votes and
+// comments.
+func (p *Post) ResetCounters() {
+	p.Score = 0
+	p.Upvotes = 0
+	p.Downvotes = 0
+	p.CommentCount = 0
+	p.Hot = 0
+	p.Controversy = 0
+}
+
+// CopyCounters copies the fields maintained by votes and comments from other.
+func (p *Post) CopyCounters(other *Post) {
+	p.Score = other.Score
+	p.Upvotes = other.Upvotes
+	p.Downvotes = other.Downvotes
+	p.CommentCount = other.CommentCount
+	p.Hot = other.Hot
+	p.Controversy = other.Controversy
+}
+
+// UpdateRanks recalculates the hot and controversy rankings of p from its
+// votes. Posts are aged from when they were published, or created if they
+// have not been, so drafts are not buried when they are published. It must
+// be called whenever the votes, CreatedAt or PublishedAt change.
+func (p *Post) UpdateRanks() {
+	publishedAt := p.CreatedAt
+	if p.PublishedAt != nil {
+		publishedAt = *p.PublishedAt
+	}
+	p.Hot = HotRank(p.Score, publishedAt)
+	p.Controversy = ControversyRank(p.Upvotes, p.Downvotes)
+}
+
+// hotEpoch is the time from which HotRank measures the age of a post.
+var hotEpoch = time.Date(2005, time.December, 8, 7, 46, 43, 0, time.UTC)
+
+// HotRank ranks a post by its score decayed by its age. Every order of
+// magnitude of score is worth the same as being 12.5 hours newer.
+func HotRank(score int, publishedAt time.Time) float64 {
+	order := math.Log10(math.Max(math.Abs(float64(score)), 1))
+	sign := 0.0
+	if score > 0 {
+		sign = 1
+	} else if score < 0 {
+		sign = -1
+	}
+	seconds := float64(publishedAt.Unix() - hotEpoch.Unix())
+	return sign*order + seconds/45000
+}
+
+// ControversyRank ranks a post by how many votes it has and how evenly they
+// are split between upvotes and downvotes.
+func ControversyRank(upvotes int, downvotes int) float64 {
+	if upvotes <= 0 || downvotes <= 0 {
+		return 0
+	}
+	magnitude := float64(upvotes + downvotes)
+	balance := float64(downvotes) / float64(upvotes)
+	if upvotes <= downvotes {
+		balance = float64(upvotes) / float64(downvotes)
+	}
+	return math.Pow(magnitude, balance)
+}
+
+// VoteDelta returns the change to a post's score, upvotes and downvotes when a
+// vote changes from oldValue to newValue. A value of 0 means no vote.
+func VoteDelta(oldValue int, newValue int) (score int, upvotes int, downvotes int) {
+	count := func(value int, want int) int {
+		if value == want {
+			return 1
+		}
+		return 0
+	}
+	score = newValue - oldValue
+	upvotes = count(newValue, 1) - count(oldValue, 1)
+	downvotes = count(newValue, -1) - count(oldValue, -1)
+	return
 }
 
 func (p *Post) BeforeCreate() (err error) {
-	p.Slug = slug.Make(p.Title)
 	p.Tags = utils.ToTagSlice(p.Tags)
 	return
 }
 
 func (p *Post) BeforeSave() (err error) {
-	p.Slug = slug.Make(p.Title)
 	p.Tags = utils.ToTagSlice(p.Tags)
 	return
 }
 
 func (p *Post) BeforeUpdate() (err error) {
-	p.Slug = slug.Make(p.Title)
 	p.Tags = utils.ToTagSlice(p.Tags)
 	return
 }
 
+// SlugBase returns the slug for a post titled title, before any suffix is
+// added to make it unique.
+func SlugBase(title string) string {
+	base := slug.Make(title)
+	if base == "" {
+		return "post"
+	}
+	return base
+}
+
+// IsSlug reports whether value is in the form of a generated slug, so may be
+// given as a post's slug.
+func IsSlug(value string) bool {
+	return value != "" && slug.Make(value) == value
+}
+
+// SlugCandidate returns the nth slug to try for a post whose slug base is
+// base. The first is base itself and later ones have a numeric suffix.
+func SlugCandidate(base string, n int) string {
+	if n <= 1 {
+		return base
+	}
+	return base + "-" + strconv.Itoa(n)
+}
+
+// HasSlugBase reports whether value is base or base with a numeric suffix, in
+// which case a post whose slug base is base may keep it.
+func HasSlugBase(value string, base string) bool {
+	if value == base {
+		return true
+	}
+	suffix := strings.TrimPrefix(value, base+"-")
+	if suffix == value {
+		return false
+	}
+	n, err := strconv.Atoi(suffix)
+	return err == nil && n > 1 && SlugCandidate(base, n) == value
+}
+
+// PostSlug is a slug which identifies a post. Every slug a post has had is
+// kept, so links using an old slug can be redirected to its current one, and
+// no other post may take it.
+type PostSlug struct {
+	Slug      string    `json:"slug" gorm:"primary_key"`
+	PostID    uint      `json:"postId" gorm:"not null;index"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// PostRevision is an immutable snapshot of the content of a post, recorded
+// whenever the post is created or updated. Number counts the revisions of each
+// post from 1.
+type PostRevision struct {
+	ID        uint           `json:"id" gorm:"primary_key"`
+	CreatedAt time.Time      `json:"createdAt"`
+	PostID    uint           `json:"postId" gorm:"not null;unique_index:idx_post_revisions_post_id_number"`
+	Number    int            `json:"number" gorm:"not null;unique_index:idx_post_revisions_post_id_number"`
+	Title     string         `json:"title"`
+	Body      string         `json:"body"`
+	Tags      pq.StringArray `json:"tags" gorm:"type:varchar(64)[]"`
+}
+
+// NewPostRevision returns revision number of post, recording its current
+// content.
+func NewPostRevision(post *Post, number int) PostRevision {
+	return PostRevision{
+		PostID: post.ID,
+		Number: number,
+		Title:  post.Title,
+		Body:   post.Body,
+		Tags:   append(pq.StringArray{}, post.Tags...),
+	}
+}
+
+// RestoreRevision replaces the content of p with that recorded by revision.
+func (p *Post) RestoreRevision(revision PostRevision) {
+	p.Title = revision.Title
+	p.Body = revision.Body
+	p.Tags = append(pq.StringArray{}, revision.Tags...)
+}
+
+// SameContent reports whether p has the same title, slug, body and tags as
+// other, so saving p over other would change nothing.
+func (p *Post) SameContent(other *Post) bool {
+	if p.Title != other.Title || p.Slug != other.Slug || p.Body != other.Body || len(p.Tags) != len(other.Tags) {
+		return false
+	}
+	for i := range p.Tags {
+		if p.Tags[i] != other.Tags[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// PostRevisionDiff is the line-by-line difference between the content of two
+// revisions of a post.
+type PostRevisionDiff struct {
+	From  uint        `json:"from"`
+	To    uint        `json:"to"`
+	Title []diff.Line `json:"title"`
+	Body  []diff.Line `json:"body"`
+	Tags  []diff.Line `json:"tags"`
+}
+
+// DiffPostRevisions returns the changes made to a post between revisions from
+// and to.
+func DiffPostRevisions(from PostRevision, to PostRevision) PostRevisionDiff {
+	return PostRevisionDiff{
+		From:  from.ID,
+		To:    to.ID,
+		Title: diff.Lines(from.Title, to.Title),
+		Body:  diff.Lines(from.Body, to.Body),
+		Tags:  diff.Strings(from.Tags, to.Tags),
+	}
+}
+
 type PostComment struct {
 	CommonFields
-	UserID string `json:"userId" binding:"required"`
-	PostID uint   `json:"postId" binding:"required"`
-	Body   string `json:"body" binding:"required"`
+	UserID    string     `json:"userId" binding:"required" gorm:"index"`
+	PostID    uint       `json:"postId" binding:"required" gorm:"index"`
+	ParentID  *uint      `json:"parentId" gorm:"index"`
+	Body      string     `json:"body" binding:"required"`
+	Score     int        `json:"score" gorm:"not null;default:0"`
+	EditedAt  *time.Time `json:"editedAt"`
+	EditCount int        `json:"editCount" gorm:"not null;default:0"`
+	// Version counts changes to the comment from 1 so concurrent edits can
+	// be detected. Changes to its score are not counted.
+	Version int `json:"version" gorm:"not null;default:1"`
+}
+
+// PostCommentRevision is an immutable snapshot of the body of a comment,
+// recorded when the comment is created and whenever its body is edited. Number
+// counts the revisions of each comment from 1, so the current revision of a
+// comment is always EditCount + 1.
+type PostCommentRevision struct {
+	ID            uint      `json:"id" gorm:"primary_key"`
+	CreatedAt     time.Time `json:"createdAt"`
+	PostCommentID uint      `json:"commentId" gorm:"not null;unique_index:idx_post_comment_revisions_post_comment_id_number"`
+	Number        int       `json:"number" gorm:"not null;unique_index:idx_post_comment_revisions_post_comment_id_number"`
+	Body          string    `json:"body"`
+}
+
+// NewPostCommentRevision returns a revision recording the current body of
+// postComment.
+func NewPostCommentRevision(postComment *PostComment) PostCommentRevision {
+	return PostCommentRevision{
+		PostCommentID: postComment.ID,
+		Number:        postComment.EditCount + 1,
+		Body:          postComment.Body,
+	}
+}
+
+// PostCommentThread is a comment along with its nested replies. MoreReplies is
+// true when the comment has replies which were omitted because the thread was
+// truncated at a maximum depth.
+type PostCommentThread struct {
+	PostComment
+	Replies     []PostCommentThread `json:"replies"`
+	MoreReplies bool                `json:"moreReplies"`
 }
 
 type PostVote struct {
 	CreatedAt time.Time `json:"createdAt"`
-	UserID    string    `json:"userId" binding:"required" gorm:"primary_key`
-	PostID    uint      `json:"postId" binding:"required" gorm:"primary_key`
+	UserID    string    `json:"userId" binding:"required" gorm:"primary_key;auto_increment:false"`
+	PostID    uint      `json:"postId" binding:"required" gorm:"primary_key;auto_increment:false;index"`
 	Value     int       `json:"value" binding:"required"`
 }
 
+type PostCommentVote struct {
+	CreatedAt     time.Time `json:"createdAt"`
+	UserID        string    `json:"userId" binding:"required" gorm:"primary_key;auto_increment:false"`
+	PostCommentID uint      `json:"commentId" binding:"required" gorm:"primary_key;auto_increment:false;index"`
+	Value         int       `json:"value" binding:"required"`
+}
+
 type PostSave struct {
 	CommonFields
-	UserID string `json:"userId" binding:"required" gorm:"primary_key`
-	PostID uint   `json:"postId" binding:"required" gorm:"primary_key`
+	UserID string `json:"userId" binding:"required" gorm:"index;unique_index:idx_post_saves_user_id_post_id"`
+	PostID uint   `json:"postId" binding:"required" gorm:"index;unique_index:idx_post_saves_user_id_post_id"`
 }
+
+// SearchResult is a post or comment matching a search query. Snippet is an
+// excerpt of the body escaped as HTML, with matching terms wrapped in <mark>
+// tags, so it may be rendered as HTML.
+type SearchResult struct {
+	Type    string  `json:"type"`
+	ID      uint    `json:"id"`
+	PostID  uint    `json:"postId"`
+	Title   string  `json:"title,omitempty"`
+	Snippet string  `json:"snippet"`
+	Rank    float64 `json:"rank"`
+}
+
+// Types of SearchResult.
+const (
+	SearchResultPost    = "post"
+	SearchResultComment = "comment"
+)
+
+// TrashItem is a post or comment which has been deleted but may still be
+// restored.
+type TrashItem struct {
+	Type      string    `json:"type"`
+	ID        uint      `json:"id"`
+	PostID    uint      `json:"postId"`
+	Title     string    `json:"title,omitempty"`
+	Body      string    `json:"body"`
+	DeletedAt time.Time `json:"deletedAt"`
+}
+
+// Types of TrashItem.
+const (
+	TrashItemPost    = "post"
+	TrashItemComment = "comment"
+)
@@ -0,0 +1,116 @@
+package postgres
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/willdady/postms/internal/errors"
+)
+
+// connectionRetryAfter and contentionRetryAfter are how long clients are asked
+// to wait before retrying when the database can not be reached, and when it is
+// overloaded or a transaction lost a race with another.
+const (
+	connectionRetryAfter = 5 * time.Second
+	contentionRetryAfter = time.Second
+)
+
+// foreignKeyDetail matches the detail of a foreign key violation, capturing
+// the column.
+var foreignKeyDetail = regexp.MustCompile(`^Key \((\w+)\)=\(.*\) is not present in table`)
+
+// foreignKeyFields maps foreign key columns to the JSON names of their fields.
+var foreignKeyFields = map[string]string{
+	"post_id":         "postId",
+	"parent_id":       "parentId",
+	"post_comment_id": "commentId",
+}
+
+// slugConstraints are the unique constraints which are violated when a slug is
+// taken by a concurrent write.
+var slugConstraints = map[string]bool{
+	"idx_posts_slug":  true,
+	"post_slugs_pkey": true,
+}
+
+// notFoundError returns the error of query, which fetched a single row, or
+// NotFound if there was no such row.
+func notFoundError(query *gorm.DB) error {
+	if query.RecordNotFound() {
+		return &errors.NotFound{}
+	}
+	return dbError(query.Error)
+}
+
+// dbError classifies an error returned by the database as an error of the
+// errors package where it is caused by the request or is transient. Other
+// errors, and errors which are already classified, are returned unchanged.
+func dbError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errs, ok := err.(gorm.Errors); ok {
+		for _, e := range errs {
+			if classified, ok := dbError(e).(errors.Error); ok {
+				return classified
+			}
+		}
+		return err
+	}
+	if _, ok := err.(errors.Error); ok {
+		return err
+	}
+	if pqErr, ok := err.(*pq.Error); ok {
+		return pqError(pqErr)
+	}
+	var netErr net.Error
+	if err == driver.ErrBadConn || err == sql.ErrConnDone || err == io.EOF || err == io.ErrUnexpectedEOF || stderrors.As(err, &netErr) {
+		return &errors.Unavailable{Code: "database_unavailable", Message: "Database is unavailable", RetryAfter: connectionRetryAfter}
+	}
+	return err
+}
+
+// pqError classifies an error reported by Postgres, returning it unchanged if
+// it is not one which is classified.
+func pqError(pqErr *pq.Error) error {
+	switch pqErr.Code.Name() {
+	case "unique_violation":
+		if slugConstraints[pqErr.Constraint] {
+			return &errors.SlugTaken{}
+		}
+		return &errors.Conflict{Code: "already_exists", Message: "Resource already exists"}
+	case "foreign_key_violation":
+		match := foreignKeyDetail.FindStringSubmatch(pqErr.Detail)
+		if match == nil {
+			// The row is referenced by another rather than referencing a
+			// missing one
+			return &errors.Conflict{Code: "still_referenced", Message: "Resource is still referenced"}
+		}
+		field, ok := foreignKeyFields[match[1]]
+		if !ok {
+			field = match[1]
+		}
+		return errors.InvalidField(field, "not_found", fmt.Sprintf("%s does not exist", field))
+	}
+	switch pqErr.Code.Class() {
+	// Connection exceptions and operator intervention, such as a shutdown
+	case "08", "57":
+		if pqErr.Code.Name() == "query_canceled" {
+			return &errors.Unavailable{Code: "database_busy", Message: "Database is busy", RetryAfter: contentionRetryAfter}
+		}
+		return &errors.Unavailable{Code: "database_unavailable", Message: "Database is unavailable", RetryAfter: connectionRetryAfter}
+	// Insufficient resources, such as too many connections, and transactions
+	// rolled back by serialization failures or deadlocks
+	case "53", "40":
+		return &errors.Unavailable{Code: "database_busy", Message: "Database is busy", RetryAfter: contentionRetryAfter}
+	}
+	return pqErr
+}
@@ -0,0 +1,44 @@
+package postgres
+
+import (
+	"database/sql/driver"
+	"net"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/willdady/postms/internal/errors"
+)
+
+func TestDBError(t *testing.T) {
+	cases := []struct {
+		err  error
+		code string
+	}{
+		{&pq.Error{Code: "23505", Constraint: "idx_posts_slug"}, "slug_taken"},
+		{&pq.Error{Code: "23505", Constraint: "post_votes_pkey"}, "already_exists"},
+		{&pq.Error{Code: "23503", Detail: `Key (post_id)=(5) is not present in table "posts".`}, "validation_failed"},
+		{&pq.Error{Code: "23503", Detail: `Key (id)=(5) is still referenced from table "x".`}, "still_referenced"},
+		{&pq.Error{Code: "08006"}, "database_unavailable"},
+		{&pq.Error{Code: "57P01"}, "database_unavailable"},
+		{&pq.Error{Code: "57014"}, "database_busy"},
+		{&pq.Error{Code: "53300"}, "database_busy"},
+		{&pq.Error{Code: "40P01"}, "database_busy"},
+		{driver.ErrBadConn, "database_unavailable"},
+		{&net.OpError{Op: "dial", Err: &net.DNSError{}}, "database_unavailable"},
+		{gorm.Errors{gorm.ErrRecordNotFound, &pq.Error{Code: "08006"}}, "database_unavailable"},
+		{&errors.SlugTaken{}, "slug_taken"},
+	}
+	for _, c := range cases {
+		e, ok := dbError(c.err).(errors.Error)
+		if !ok || e.ErrorCode() != c.code {
+			t.Errorf("dbError(%#v) = %#v, want %s", c.err, dbError(c.err), c.code)
+		}
+	}
+	if v, ok := dbError(&pq.Error{Code: "23503", Detail: `Key (post_comment_id)=(5) is not present in table "post_comments".`}).(*errors.Validation); !ok || v.Fields[0].Field != "commentId" {
+		t.Error(v)
+	}
+	if _, ok := dbError(&pq.Error{Code: "42601"}).(errors.Error); ok {
+		t.Error("syntax error classified")
+	}
+}
@@ -0,0 +1,99 @@
+package postgres
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/willdady/postms/internal/postms/services"
+)
+
+// IdempotencyStore is an implementation of services.IdempotencyStore backed by the
+// idempotency_keys table.
+type IdempotencyStore struct {
+	DB *gorm.DB
+}
+
+func NewIdempotencyStore(db *gorm.DB) *IdempotencyStore {
+	return &IdempotencyStore{DB: db}
+}
+
+// idempotencyKey is a row of the idempotency_keys table.
+type idempotencyKey struct {
+	Key         string `gorm:"primary_key"`
+	Fingerprint string
+	Status      int
+	Header      *string
+	Body        []byte
+	CreatedAt   time.Time
+}
+
+func (store *IdempotencyStore) Claim(key string, fingerprint string, expiredBefore time.Time) (services.IdempotencyRecord, bool, error) {
+	tx := store.DB.Begin()
+	if tx.Error != nil {
+		return services.IdempotencyRecord{}, false, dbError(tx.Error)
+	}
+	err := tx.Exec("DELETE FROM idempotency_keys WHERE key = ? AND created_at < ?", key, expiredBefore).Error
+	if err != nil {
+		tx.Rollback()
+		return services.IdempotencyRecord{}, false, dbError(err)
+	}
+	// A concurrent claim of the same key blocks the insert until it commits,
+	// after which the conflicting row is visible
+	now := time.Now()
+	result := tx.Exec(
+		"INSERT INTO idempotency_keys (key, fingerprint, created_at) VALUES (?, ?, ?) ON CONFLICT (key) DO NOTHING",
+		key, fingerprint, now)
+	if result.Error != nil {
+		tx.Rollback()
+		return services.IdempotencyRecord{}, false, dbError(result.Error)
+	}
+	if result.RowsAffected == 1 {
+		if err := tx.Commit().Error; err != nil {
+			return services.IdempotencyRecord{}, false, dbError(err)
+		}
+		return services.IdempotencyRecord{Key: key, Fingerprint: fingerprint, CreatedAt: now}, true, nil
+	}
+	row := idempotencyKey{}
+	if err := tx.Where("key = ?", key).First(&row).Error; err != nil {
+		tx.Rollback()
+		return services.IdempotencyRecord{}, false, dbError(err)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return services.IdempotencyRecord{}, false, dbError(err)
+	}
+	record := services.IdempotencyRecord{
+		Key:         row.Key,
+		Fingerprint: row.Fingerprint,
+		Status:      row.Status,
+		Body:        row.Body,
+		CreatedAt:   row.CreatedAt,
+	}
+	if row.Header != nil {
+		if err := json.Unmarshal([]byte(*row.Header), &record.Header); err != nil {
+			return services.IdempotencyRecord{}, false, err
+		}
+	}
+	return record, false, nil
+}
+
+func (store *IdempotencyStore) Complete(key string, status int, header http.Header, body []byte) error {
+	encodedHeader, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	err = store.DB.Exec(
+		"UPDATE idempotency_keys SET status = ?, header = ?, body = ? WHERE key = ?",
+		status, string(encodedHeader), body, key).Error
+	return dbError(err)
+}
+
+func (store *IdempotencyStore) Release(key string) error {
+	return dbError(store.DB.Exec("DELETE FROM idempotency_keys WHERE key = ? AND status = 0", key).Error)
+}
+
+func (store *IdempotencyStore) DeleteExpired(expiredBefore time.Time) (int64, error) {
+	result := store.DB.Exec("DELETE FROM idempotency_keys WHERE created_at < ?", expiredBefore)
+	return result.RowsAffected, dbError(result.Error)
+}
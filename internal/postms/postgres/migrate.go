@@ -0,0 +1,266 @@
+package postgres
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// postSearchDocument and postCommentSearchDocument are the expressions indexed
+// for full-text search by the migrations. Queries must use them verbatim for
+// the indexes to be used.
+const (
+	postSearchDocument        = "to_tsvector('english', coalesce(title, '') || ' ' || coalesce(body, ''))"
+	postCommentSearchDocument = "to_tsvector('english', coalesce(body, ''))"
+)
+
+// migrationsLock is the key of the advisory lock held while migrating, so that
+// replicas starting together do not migrate at once.
+const migrationsLock = 7260414
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is a versioned change to the schema. Up applies it and Down
+// reverts it.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus is a migration along with when it was applied, which is nil
+// if it is pending.
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// schemaMigration is a row of the schema_migrations table, recording an
+// applied migration.
+type schemaMigration struct {
+	Version   int64 `gorm:"primary_key"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// Migrations returns the migrations embedded in the binary ordered by version.
+func Migrations() ([]Migration, error) {
+	names, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int64]*Migration{}
+	for _, name := range names {
+		match := migrationFileName.FindStringSubmatch(path.Base(name))
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name %q", name)
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration file name %q", name)
+		}
+		content, err := migrationFiles.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		} else if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names, %q and %q", version, migration.Name, match[2])
+		}
+		if match[3] == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d must have both an up and a down file", migration.Version)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Migrate applies all pending migrations.
+func Migrate(db *gorm.DB) error {
+	_, err := MigrateUp(db)
+	return err
+}
+
+// MigrateUp applies all pending migrations in order, returning those applied.
+// Either all of them are applied or none are.
+func MigrateUp(db *gorm.DB) ([]Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	applied := []Migration{}
+	err = withMigrationsLock(db, func(tx *gorm.DB, versions map[int64]schemaMigration) error {
+		for _, migration := range migrations {
+			if _, ok := versions[migration.Version]; ok {
+				continue
+			}
+			if err := tx.Exec(migration.Up).Error; err != nil {
+				return fmt.Errorf("migration %d_%s failed: %v", migration.Version, migration.Name, err)
+			}
+			row := schemaMigration{Version: migration.Version, Name: migration.Name, AppliedAt: time.Now()}
+			if err := tx.Create(&row).Error; err != nil {
+				return err
+			}
+			applied = append(applied, migration)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// MigrateDown reverts the last steps applied migrations in reverse order,
+// returning those reverted. Either all of them are reverted or none are.
+func MigrateDown(db *gorm.DB, steps int) ([]Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	reverted := []Migration{}
+	err = withMigrationsLock(db, func(tx *gorm.DB, versions map[int64]schemaMigration) error {
+		for i := len(migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+			migration := migrations[i]
+			if _, ok := versions[migration.Version]; !ok {
+				continue
+			}
+			if err := tx.Exec(migration.Down).Error; err != nil {
+				return fmt.Errorf("reverting migration %d_%s failed: %v", migration.Version, migration.Name, err)
+			}
+			if err := tx.Delete(&schemaMigration{Version: migration.Version}).Error; err != nil {
+				return err
+			}
+			reverted = append(reverted, migration)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reverted, nil
+}
+
+// MigrationStatuses returns every migration along with whether it has been
+// applied. Migrations recorded as applied which are unknown to this binary,
+// for example because it is older than the database, are included without
+// their SQL. The database is only read, so every migration is pending if the
+// schema_migrations table does not exist yet.
+func MigrationStatuses(db *gorm.DB) ([]MigrationStatus, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	versions, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	statuses := []MigrationStatus{}
+	for _, migration := range migrations {
+		status := MigrationStatus{Migration: migration}
+		if row, ok := versions[migration.Version]; ok {
+			appliedAt := row.AppliedAt
+			status.AppliedAt = &appliedAt
+			delete(versions, migration.Version)
+		}
+		statuses = append(statuses, status)
+	}
+	for _, row := range versions {
+		appliedAt := row.AppliedAt
+		statuses = append(statuses, MigrationStatus{
+			Migration: Migration{Version: row.Version, Name: row.Name},
+			AppliedAt: &appliedAt,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+	return statuses, nil
+}
+
+// appliedMigrations returns the migrations recorded in the schema_migrations
+// table by version, without taking the migrations lock or creating the table.
+func appliedMigrations(db *gorm.DB) (map[int64]schemaMigration, error) {
+	var exists bool
+	if err := db.Raw("SELECT to_regclass('schema_migrations') IS NOT NULL").Row().Scan(&exists); err != nil {
+		return nil, err
+	}
+	versions := map[int64]schemaMigration{}
+	if !exists {
+		return versions, nil
+	}
+	rows := []schemaMigration{}
+	if err := db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		versions[row.Version] = row
+	}
+	return versions, nil
+}
+
+// withMigrationsLock calls fn in a transaction holding the migrations lock,
+// passing the applied migrations by version. The transaction is committed if
+// fn succeeds. As Postgres DDL is transactional a failed migration leaves the
+// schema untouched.
+func withMigrationsLock(db *gorm.DB, fn func(tx *gorm.DB, versions map[int64]schemaMigration) error) error {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", migrationsLock).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	// The table is created while holding the lock as concurrent CREATE TABLE IF
+	// NOT EXISTS statements may fail
+	err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version bigint PRIMARY KEY,
+			name text NOT NULL,
+			applied_at timestamp with time zone NOT NULL
+		)`).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	rows := []schemaMigration{}
+	if err := tx.Find(&rows).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	versions := map[int64]schemaMigration{}
+	for _, row := range rows {
+		versions[row.Version] = row
+	}
+	if err := fn(tx, versions); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS post_comment_revisions;
+DROP TABLE IF EXISTS post_revisions;
+DROP TABLE IF EXISTS post_saves;
+DROP TABLE IF EXISTS post_comment_votes;
+DROP TABLE IF EXISTS post_votes;
+DROP TABLE IF EXISTS post_comments;
+DROP TABLE IF EXISTS posts;
@@ -0,0 +1,191 @@
+-- The schema previously created by AutoMigrate. Everything is created only if
+-- missing so that databases created by the previous release are adopted. Its
+-- tables lack the columns added since, which are added to them here.
+
+CREATE TABLE IF NOT EXISTS posts (
+    id serial PRIMARY KEY,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    user_id text,
+    title text,
+    slug text,
+    body text,
+    tags varchar(64)[],
+    status text NOT NULL DEFAULT 'published',
+    published_at timestamp with time zone,
+    publish_at timestamp with time zone,
+    score integer NOT NULL DEFAULT 0,
+    upvotes integer NOT NULL DEFAULT 0,
+    downvotes integer NOT NULL DEFAULT 0,
+    comment_count integer NOT NULL DEFAULT 0,
+    hot double precision NOT NULL DEFAULT 0,
+    controversy double precision NOT NULL DEFAULT 0
+);
+ALTER TABLE posts
+    ADD COLUMN IF NOT EXISTS status text NOT NULL DEFAULT 'published',
+    ADD COLUMN IF NOT EXISTS published_at timestamp with time zone,
+    ADD COLUMN IF NOT EXISTS publish_at timestamp with time zone,
+    ADD COLUMN IF NOT EXISTS score integer NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS upvotes integer NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS downvotes integer NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS comment_count integer NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS hot double precision NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS controversy double precision NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS idx_posts_deleted_at ON posts (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_posts_user_id ON posts (user_id);
+CREATE INDEX IF NOT EXISTS idx_posts_status ON posts (status);
+CREATE INDEX IF NOT EXISTS idx_posts_publish_at ON posts (publish_at);
+CREATE INDEX IF NOT EXISTS idx_posts_hot ON posts (hot);
+CREATE INDEX IF NOT EXISTS idx_posts_controversy ON posts (controversy);
+CREATE INDEX IF NOT EXISTS idx_posts_search ON posts USING GIN (to_tsvector('english', coalesce(title, '') || ' ' || coalesce(body, '')));
+
+CREATE TABLE IF NOT EXISTS post_comments (
+    id serial PRIMARY KEY,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    user_id text,
+    post_id integer,
+    parent_id integer,
+    body text,
+    score integer NOT NULL DEFAULT 0,
+    edited_at timestamp with time zone,
+    edit_count integer NOT NULL DEFAULT 0
+);
+ALTER TABLE post_comments
+    ADD COLUMN IF NOT EXISTS parent_id integer,
+    ADD COLUMN IF NOT EXISTS score integer NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS edited_at timestamp with time zone,
+    ADD COLUMN IF NOT EXISTS edit_count integer NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS idx_post_comments_deleted_at ON post_comments (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_post_comments_user_id ON post_comments (user_id);
+CREATE INDEX IF NOT EXISTS idx_post_comments_post_id ON post_comments (post_id);
+CREATE INDEX IF NOT EXISTS idx_post_comments_parent_id ON post_comments (parent_id);
+CREATE INDEX IF NOT EXISTS idx_post_comments_search ON post_comments USING GIN (to_tsvector('english', coalesce(body, '')));
+
+CREATE TABLE IF NOT EXISTS post_votes (
+    created_at timestamp with time zone,
+    user_id text,
+    post_id integer,
+    value integer,
+    PRIMARY KEY (user_id, post_id)
+);
+-- The primary key of the previous release was malformed so its table has
+-- none. A user's duplicate votes are removed, keeping the last, before adding
+-- it.
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conrelid = 'post_votes'::regclass AND contype = 'p') THEN
+        DELETE FROM post_votes WHERE user_id IS NULL OR post_id IS NULL;
+        DELETE FROM post_votes a USING post_votes b
+        WHERE a.user_id = b.user_id AND a.post_id = b.post_id AND a.ctid < b.ctid;
+        ALTER TABLE post_votes ADD PRIMARY KEY (user_id, post_id);
+    END IF;
+END $$;
+CREATE INDEX IF NOT EXISTS idx_post_votes_post_id ON post_votes (post_id);
+
+CREATE TABLE IF NOT EXISTS post_comment_votes (
+    created_at timestamp with time zone,
+    user_id text,
+    post_comment_id integer,
+    value integer,
+    PRIMARY KEY (user_id, post_comment_id)
+);
+CREATE INDEX IF NOT EXISTS idx_post_comment_votes_post_comment_id ON post_comment_votes (post_comment_id);
+
+CREATE TABLE IF NOT EXISTS post_saves (
+    id serial PRIMARY KEY,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    user_id text,
+    post_id integer
+);
+CREATE INDEX IF NOT EXISTS idx_post_saves_deleted_at ON post_saves (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_post_saves_user_id ON post_saves (user_id);
+CREATE INDEX IF NOT EXISTS idx_post_saves_post_id ON post_saves (post_id);
+-- A user saves a post at most once, and unsaving it only marks the save as
+-- deleted. Duplicates are removed first, keeping a save which is not deleted.
+DELETE FROM post_saves a USING post_saves b
+WHERE a.user_id = b.user_id AND a.post_id = b.post_id
+    AND (a.deleted_at IS NOT NULL, a.id) > (b.deleted_at IS NOT NULL, b.id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_post_saves_user_id_post_id ON post_saves (user_id, post_id);
+
+CREATE TABLE IF NOT EXISTS post_revisions (
+    id serial PRIMARY KEY,
+    created_at timestamp with time zone,
+    post_id integer NOT NULL,
+    number integer NOT NULL,
+    title text,
+    body text,
+    tags varchar(64)[]
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_post_revisions_post_id_number ON post_revisions (post_id, number);
+
+CREATE TABLE IF NOT EXISTS post_comment_revisions (
+    id serial PRIMARY KEY,
+    created_at timestamp with time zone,
+    post_comment_id integer NOT NULL,
+    number integer NOT NULL,
+    body text
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_post_comment_revisions_post_comment_id_number ON post_comment_revisions (post_comment_id, number);
+
+-- Rows orphaned before the foreign keys existed would stop them being added,
+-- so are first cleaned up in the same way the foreign keys would have.
+UPDATE post_comments SET parent_id = NULL
+WHERE parent_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM post_comments p WHERE p.id = post_comments.parent_id);
+DELETE FROM post_comments WHERE NOT EXISTS (SELECT 1 FROM posts WHERE posts.id = post_comments.post_id);
+DELETE FROM post_votes WHERE NOT EXISTS (SELECT 1 FROM posts WHERE posts.id = post_votes.post_id);
+DELETE FROM post_comment_votes WHERE NOT EXISTS (SELECT 1 FROM post_comments WHERE post_comments.id = post_comment_votes.post_comment_id);
+DELETE FROM post_saves WHERE NOT EXISTS (SELECT 1 FROM posts WHERE posts.id = post_saves.post_id);
+DELETE FROM post_revisions WHERE NOT EXISTS (SELECT 1 FROM posts WHERE posts.id = post_revisions.post_id);
+DELETE FROM post_comment_revisions WHERE NOT EXISTS (SELECT 1 FROM post_comments WHERE post_comments.id = post_comment_revisions.post_comment_id);
+
+-- Rows are deleted along with what they refer to, except replies which are
+-- kept. The constraints are named as AutoMigrate named them.
+ALTER TABLE post_comments
+    DROP CONSTRAINT IF EXISTS post_comments_post_id_posts_id_foreign,
+    ADD CONSTRAINT post_comments_post_id_posts_id_foreign FOREIGN KEY (post_id) REFERENCES posts (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    DROP CONSTRAINT IF EXISTS post_comments_parent_id_post_comments_id_foreign,
+    ADD CONSTRAINT post_comments_parent_id_post_comments_id_foreign FOREIGN KEY (parent_id) REFERENCES post_comments (id) ON DELETE SET NULL ON UPDATE CASCADE;
+ALTER TABLE post_votes
+    DROP CONSTRAINT IF EXISTS post_votes_post_id_posts_id_foreign,
+    ADD CONSTRAINT post_votes_post_id_posts_id_foreign FOREIGN KEY (post_id) REFERENCES posts (id) ON DELETE CASCADE ON UPDATE CASCADE;
+ALTER TABLE post_comment_votes
+    DROP CONSTRAINT IF EXISTS post_comment_votes_post_comment_id_post_comments_id_foreign,
+    ADD CONSTRAINT post_comment_votes_post_comment_id_post_comments_id_foreign FOREIGN KEY (post_comment_id) REFERENCES post_comments (id) ON DELETE CASCADE ON UPDATE CASCADE;
+ALTER TABLE post_saves
+    DROP CONSTRAINT IF EXISTS post_saves_post_id_posts_id_foreign,
+    ADD CONSTRAINT post_saves_post_id_posts_id_foreign FOREIGN KEY (post_id) REFERENCES posts (id) ON DELETE CASCADE ON UPDATE CASCADE;
+ALTER TABLE post_revisions
+    DROP CONSTRAINT IF EXISTS post_revisions_post_id_posts_id_foreign,
+    ADD CONSTRAINT post_revisions_post_id_posts_id_foreign FOREIGN KEY (post_id) REFERENCES posts (id) ON DELETE CASCADE ON UPDATE CASCADE;
+ALTER TABLE post_comment_revisions
+    DROP CONSTRAINT IF EXISTS post_comment_revisions_post_comment_id_post_comments_id_foreign,
+    ADD CONSTRAINT post_comment_revisions_post_comment_id_post_comments_id_foreign FOREIGN KEY (post_comment_id) REFERENCES post_comments (id) ON DELETE CASCADE ON UPDATE CASCADE;
+
+-- Counters of adopted posts are calculated from their votes and comments, in
+-- the same way as models.Post.UpdateRanks.
+UPDATE posts SET
+    score = counts.score,
+    upvotes = counts.upvotes,
+    downvotes = counts.downvotes,
+    comment_count = (SELECT count(*) FROM post_comments WHERE post_comments.post_id = posts.id AND post_comments.deleted_at IS NULL)
+FROM (
+    SELECT p.id,
+        coalesce(sum(v.value), 0) AS score,
+        count(*) FILTER (WHERE v.value = 1) AS upvotes,
+        count(*) FILTER (WHERE v.value = -1) AS downvotes
+    FROM posts p LEFT JOIN post_votes v ON v.post_id = p.id
+    GROUP BY p.id
+) counts
+WHERE counts.id = posts.id;
+UPDATE posts SET
+    hot = sign(score) * log(greatest(abs(score), 1)) + (floor(extract(epoch FROM coalesce(created_at, now()))) - 1134028003) / 45000,
+    controversy = CASE
+        WHEN upvotes > 0 AND downvotes > 0
+        THEN power(upvotes + downvotes, least(upvotes, downvotes)::double precision / greatest(upvotes, downvotes))
+        ELSE 0
+    END;
@@ -0,0 +1,2 @@
+DROP TABLE post_slugs;
+DROP INDEX idx_posts_slug;
@@ -0,0 +1,36 @@
+-- Slugs were previously not unique. Posts without a slug are given one and
+-- later posts sharing a slug with an earlier one are given a numeric suffix.
+UPDATE posts SET slug = 'post' WHERE slug IS NULL OR slug = '';
+
+DO $$
+DECLARE
+    p record;
+    n integer;
+    candidate text;
+BEGIN
+    FOR p IN
+        SELECT id, slug FROM posts a
+        WHERE EXISTS (SELECT 1 FROM posts b WHERE b.slug = a.slug AND b.id < a.id)
+        ORDER BY id
+    LOOP
+        n := 2;
+        LOOP
+            candidate := p.slug || '-' || n;
+            EXIT WHEN NOT EXISTS (SELECT 1 FROM posts WHERE slug = candidate);
+            n := n + 1;
+        END LOOP;
+        UPDATE posts SET slug = candidate WHERE id = p.id;
+    END LOOP;
+END $$;
+
+CREATE UNIQUE INDEX idx_posts_slug ON posts (slug);
+
+CREATE TABLE post_slugs (
+    slug text PRIMARY KEY,
+    post_id integer NOT NULL REFERENCES posts (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    created_at timestamp with time zone
+);
+CREATE INDEX idx_post_slugs_post_id ON post_slugs (post_id);
+
+INSERT INTO post_slugs (slug, post_id, created_at)
+SELECT slug, id, now() FROM posts;
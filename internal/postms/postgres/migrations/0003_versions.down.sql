@@ -0,0 +1,2 @@
+ALTER TABLE post_comments DROP COLUMN version;
+ALTER TABLE posts DROP COLUMN version;
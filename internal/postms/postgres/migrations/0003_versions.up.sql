@@ -0,0 +1,2 @@
+ALTER TABLE posts ADD COLUMN version integer NOT NULL DEFAULT 1;
+ALTER TABLE post_comments ADD COLUMN version integer NOT NULL DEFAULT 1;
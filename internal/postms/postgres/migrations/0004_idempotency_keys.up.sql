@@ -0,0 +1,12 @@
+-- Responses to create requests made with an Idempotency-Key, which are
+-- replayed when the request is retried. A status of 0 marks a request which
+-- is still in progress.
+CREATE TABLE idempotency_keys (
+    key text PRIMARY KEY,
+    fingerprint text NOT NULL,
+    status integer NOT NULL DEFAULT 0,
+    header jsonb,
+    body bytea,
+    created_at timestamp with time zone NOT NULL
+);
+CREATE INDEX idx_idempotency_keys_created_at ON idempotency_keys (created_at);
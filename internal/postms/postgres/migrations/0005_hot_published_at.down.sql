@@ -0,0 +1,2 @@
+UPDATE posts SET
+    hot = sign(score) * log(greatest(abs(score), 1)) + (floor(extract(epoch FROM coalesce(created_at, now()))) - 1134028003) / 45000;
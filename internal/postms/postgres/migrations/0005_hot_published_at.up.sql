@@ -0,0 +1,4 @@
+-- Posts are aged from when they were published, or created if they have not
+-- been, in the same way as models.Post.UpdateRanks.
+UPDATE posts SET
+    hot = sign(score) * log(greatest(abs(score), 1)) + (floor(extract(epoch FROM coalesce(published_at, created_at, now()))) - 1134028003) / 45000;
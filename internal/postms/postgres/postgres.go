@@ -1,12 +1,14 @@
 package postgres
 
 import (
-	"encoding/base64"
+	"strings"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	"github.com/lib/pq"
 	"github.com/willdady/postms/internal/errors"
 	"github.com/willdady/postms/internal/postms/models"
+	"github.com/willdady/postms/internal/postms/services"
 	"github.com/willdady/postms/internal/utils"
 )
 
@@ -19,27 +21,346 @@ func NewPostService(db *gorm.DB) *PostService {
 }
 
 func (service *PostService) CreatePost(post *models.Post) error {
-	service.DB.Create(post)
-	return nil
+	post.ResetCounters()
+	post.CreatedAt = time.Now()
+	if post.Status == "" {
+		post.Status = models.PostStatusPublished
+	}
+	post.PublishedAt = nil
+	post.SetStatus(post.Status, post.CreatedAt)
+	post.UpdateRanks()
+	post.Version = 1
+	tx := service.DB.Begin()
+	if tx.Error != nil {
+		return dbError(tx.Error)
+	}
+	if err := setPostSlug(tx, post, "", false); err != nil {
+		tx.Rollback()
+		return dbError(err)
+	}
+	if err := tx.Create(post).Error; err != nil {
+		tx.Rollback()
+		return dbError(err)
+	}
+	if err := addPostSlug(tx, post); err != nil {
+		tx.Rollback()
+		return dbError(err)
+	}
+	if err := addPostRevision(tx, post); err != nil {
+		tx.Rollback()
+		return dbError(err)
+	}
+	return dbError(tx.Commit().Error)
 }
 
 func (service *PostService) UpdatePost(post *models.Post) error {
-	service.DB.Save(post)
-	return nil
+	// Counters are only ever changed by votes and comments and the status
+	// only by UpdatePostStatus
+	omit := append(append([]string{}, models.PostCounterColumns...), models.PostStatusColumns...)
+	tx := service.DB.Begin()
+	if tx.Error != nil {
+		return dbError(tx.Error)
+	}
+	existing := models.Post{}
+	if err := notFoundError(tx.Set("gorm:query_option", "FOR UPDATE").Where("id = ?", post.ID).First(&existing)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if post.Version != 0 && post.Version != existing.Version {
+		tx.Rollback()
+		return &errors.VersionMismatch{}
+	}
+	post.BeforeSave()
+	if err := setPostSlug(tx, post, existing.Slug, !models.IsPrivatePostStatus(existing.Status)); err != nil {
+		tx.Rollback()
+		return dbError(err)
+	}
+	if post.SameContent(&existing) {
+		*post = existing
+		return dbError(tx.Rollback().Error)
+	}
+	post.Version = existing.Version + 1
+	if err := tx.Omit(omit...).Save(post).Error; err != nil {
+		tx.Rollback()
+		return dbError(err)
+	}
+	if err := addPostSlug(tx, post); err != nil {
+		tx.Rollback()
+		return dbError(err)
+	}
+	if err := addPostRevision(tx, post); err != nil {
+		tx.Rollback()
+		return dbError(err)
+	}
+	return dbError(tx.Commit().Error)
+}
+
+// postSlugsLock is the key of the advisory locks held while choosing a slug,
+// paired with a hash of the slug base so only posts which could take the same
+// slug wait on each other.
+const postSlugsLock = 7260415
+
+// setPostSlug sets the slug of post as described by services.PostService,
+// where current is its slug before the change and frozen is true if it must
+// be kept unless replaced. The slug is recorded by addPostSlug once the post
+// has been written.
+func setPostSlug(tx *gorm.DB, post *models.Post, current string, frozen bool) error {
+	if post.Slug != "" && post.Slug != current {
+		// A slug with a numeric suffix could also be generated for another
+		// post from the base before the suffix, so that lock is taken too
+		bases := []string{post.Slug}
+		if i := strings.LastIndex(post.Slug, "-"); i > 0 && models.HasSlugBase(post.Slug, post.Slug[:i]) {
+			bases = append(bases, post.Slug[:i])
+		}
+		for _, base := range bases {
+			if err := lockPostSlugs(tx, base); err != nil {
+				return err
+			}
+		}
+		var count int
+		if err := tx.Model(&models.PostSlug{}).Where("slug = ? AND post_id <> ?", post.Slug, post.ID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return &errors.SlugTaken{}
+		}
+		return nil
+	}
+	if post.Slug != "" || (current != "" && frozen) {
+		post.Slug = current
+		return nil
+	}
+	base := models.SlugBase(post.Title)
+	if current != "" && models.HasSlugBase(current, base) {
+		post.Slug = current
+		return nil
+	}
+	if err := lockPostSlugs(tx, base); err != nil {
+		return err
+	}
+	// Slugs only contain letters, digits and hyphens so need no escaping
+	postSlugs := []models.PostSlug{}
+	err := tx.Where("(slug = ? OR slug LIKE ?) AND post_id <> ?", base, base+"-%", post.ID).Find(&postSlugs).Error
+	if err != nil {
+		return err
+	}
+	taken := map[string]bool{}
+	for _, s := range postSlugs {
+		taken[s.Slug] = true
+	}
+	for n := 1; ; n++ {
+		post.Slug = models.SlugCandidate(base, n)
+		if !taken[post.Slug] {
+			return nil
+		}
+	}
+}
+
+// lockPostSlugs takes the lock for choosing slugs with the given base until
+// the end of the transaction.
+func lockPostSlugs(tx *gorm.DB, base string) error {
+	return tx.Exec("SELECT pg_advisory_xact_lock(?, hashtext(?))", postSlugsLock, base).Error
+}
+
+// addPostSlug records the slug of post in its slug history, unless it has had
+// it before.
+func addPostSlug(tx *gorm.DB, post *models.Post) error {
+	return tx.Exec("INSERT INTO post_slugs (slug, post_id, created_at) VALUES (?, ?, ?) ON CONFLICT (slug) DO NOTHING", post.Slug, post.ID, time.Now()).Error
+}
+
+// addPostRevision records the current content of post as its next revision.
+// It must be called within the transaction which wrote the post, whose row
+// lock serialises revisions of the same post.
+func addPostRevision(tx *gorm.DB, post *models.Post) error {
+	var number int
+	err := tx.Model(&models.PostRevision{}).
+		Where("post_id = ?", post.ID).
+		Select("COALESCE(MAX(number), 0) + 1").
+		Row().Scan(&number)
+	if err != nil {
+		return err
+	}
+	revision := models.NewPostRevision(post, number)
+	return tx.Create(&revision).Error
+}
+
+func (service *PostService) UpdatePostStatus(post *models.Post, status string) error {
+	tx := service.DB.Begin()
+	if tx.Error != nil {
+		return dbError(tx.Error)
+	}
+	existing := models.Post{}
+	if err := notFoundError(tx.Set("gorm:query_option", "FOR UPDATE").Where("id = ?", post.ID).First(&existing)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	post.SetStatus(status, time.Now())
+	post.Version = existing.Version + 1
+	existing.PublishedAt = post.PublishedAt
+	existing.UpdateRanks()
+	post.Hot = existing.Hot
+	err := tx.Model(post).Updates(map[string]interface{}{
+		"status":       post.Status,
+		"published_at": post.PublishedAt,
+		"publish_at":   post.PublishAt,
+		"hot":          post.Hot,
+		"version":      post.Version,
+	}).Error
+	if err != nil {
+		tx.Rollback()
+		return dbError(err)
+	}
+	return dbError(tx.Commit().Error)
+}
+
+// publishScheduledPostsLock is the key of the advisory lock held while
+// publishing scheduled posts, so only one replica does so at a time.
+const publishScheduledPostsLock = 7260413
+
+func (service *PostService) PublishScheduledPosts(now time.Time) (int, error) {
+	tx := service.DB.Begin()
+	if tx.Error != nil {
+		return 0, dbError(tx.Error)
+	}
+	// The lock is released when the transaction ends. If another replica
+	// holds it there is nothing for us to do.
+	var locked bool
+	if err := tx.Raw("SELECT pg_try_advisory_xact_lock(?)", publishScheduledPostsLock).Row().Scan(&locked); err != nil {
+		tx.Rollback()
+		return 0, dbError(err)
+	}
+	if !locked {
+		tx.Rollback()
+		return 0, nil
+	}
+	// The posts are loaded so their hot ranks can be recalculated as of their
+	// publication
+	posts := []models.Post{}
+	query := tx.Set("gorm:query_option", "FOR UPDATE").Where("status = ? AND publish_at <= ?", models.PostStatusScheduled, now)
+	if err := query.Find(&posts).Error; err != nil {
+		tx.Rollback()
+		return 0, dbError(err)
+	}
+	for _, post := range posts {
+		// Posts are published as of the time they were scheduled for rather
+		// than whenever the publisher happened to run
+		post.PublishedAt = post.PublishAt
+		post.SetStatus(models.PostStatusPublished, now)
+		post.UpdateRanks()
+		err := tx.Model(&post).UpdateColumns(map[string]interface{}{
+			"status":       post.Status,
+			"published_at": post.PublishedAt,
+			"publish_at":   nil,
+			"hot":          post.Hot,
+			"updated_at":   now,
+			"version":      gorm.Expr("version + 1"),
+		}).Error
+		if err != nil {
+			tx.Rollback()
+			return 0, dbError(err)
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return 0, dbError(err)
+	}
+	return len(posts), nil
+}
+
+// adjustPostVoteCounts applies a vote changing from oldValue to newValue to the
+// counters of a post. It is called within the same transaction as the vote
+// change so the two stay consistent. Counter changes touch updated_at, but not
+// the version, so cached copies of the post are revalidated.
+func adjustPostVoteCounts(tx *gorm.DB, postID uint, oldValue int, newValue int) error {
+	score, upvotes, downvotes := models.VoteDelta(oldValue, newValue)
+	err := tx.Model(&models.Post{}).Where("id = ?", postID).UpdateColumns(map[string]interface{}{
+		"score":      gorm.Expr("score + ?", score),
+		"upvotes":    gorm.Expr("upvotes + ?", upvotes),
+		"downvotes":  gorm.Expr("downvotes + ?", downvotes),
+		"updated_at": time.Now(),
+	}).Error
+	if err != nil {
+		return err
+	}
+	// The row is locked by the update above so the ranks can be safely
+	// recalculated from the new counters.
+	post := models.Post{}
+	query := tx.Where("id = ?", postID).First(&post)
+	if query.RecordNotFound() {
+		return nil
+	}
+	if query.Error != nil {
+		return query.Error
+	}
+	post.UpdateRanks()
+	return tx.Model(&post).UpdateColumns(map[string]interface{}{
+		"hot":         post.Hot,
+		"controversy": post.Controversy,
+	}).Error
+}
+
+// adjustPostCommentCount adds delta to the comment count of a post. It is
+// called within the same transaction as the comment change.
+func adjustPostCommentCount(tx *gorm.DB, postID uint, delta int) error {
+	return tx.Model(&models.Post{}).Where("id = ?", postID).UpdateColumns(map[string]interface{}{
+		"comment_count": gorm.Expr("comment_count + ?", delta),
+		"updated_at":    time.Now(),
+	}).Error
 }
 
 func (service *PostService) DeletePost(post *models.Post) error {
 	if post.ID == 0 {
 		return &errors.DeleteIsMissingID{}
 	}
-	service.DB.Delete(post)
+	// Comments and saves are deleted along with the post, sharing its
+	// deletion time so RestorePost can tell them apart from those deleted
+	// earlier. Votes are kept but hidden while the post is deleted.
+	now := time.Now()
+	tx := service.DB.Begin()
+	if tx.Error != nil {
+		return dbError(tx.Error)
+	}
+	existing := models.Post{}
+	if err := notFoundError(tx.Set("gorm:query_option", "FOR UPDATE").Where("id = ?", post.ID).First(&existing)); err != nil {
+		tx.Rollback()
+		if _, ok := err.(*errors.NotFound); ok {
+			return nil
+		}
+		return err
+	}
+	if post.Version != 0 && post.Version != existing.Version {
+		tx.Rollback()
+		return &errors.VersionMismatch{}
+	}
+	if err := tx.Model(&existing).UpdateColumn("deleted_at", now).Error; err != nil {
+		tx.Rollback()
+		return dbError(err)
+	}
+	for _, model := range []interface{}{&models.PostComment{}, &models.PostSave{}} {
+		if err := tx.Model(model).Where("post_id = ?", post.ID).UpdateColumn("deleted_at", now).Error; err != nil {
+			tx.Rollback()
+			return dbError(err)
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return dbError(err)
+	}
+	post.DeletedAt = &now
 	return nil
 }
 
 func (service *PostService) GetPost(postID uint64) (models.Post, error) {
 	p := models.Post{}
-	if service.DB.Where("id = ?", postID).First(&p).RecordNotFound() {
-		return p, &errors.NotFound{}
+	if err := notFoundError(service.DB.Where("id = ?", postID).First(&p)); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+func (service *PostService) GetPostBySlug(slug string) (models.Post, error) {
+	p := models.Post{}
+	query := service.DB.Select("posts.*").Joins("JOIN post_slugs ON post_slugs.post_id = posts.id").Where("post_slugs.slug = ?", slug)
+	if err := notFoundError(query.First(&p)); err != nil {
+		return p, err
 	}
 	return p, nil
 }
@@ -48,133 +369,606 @@ func (service *PostService) PostExists(postID uint64) (bool, error) {
 	result := struct {
 		Exists bool
 	}{}
-	if err := service.DB.Raw("SELECT EXISTS(SELECT 1 FROM posts WHERE id=?) as exists", postID).Scan(&result).Error; err != nil {
-		return false, err
+	if err := service.DB.Raw("SELECT EXISTS(SELECT 1 FROM posts WHERE id=? AND deleted_at IS NULL) as exists", postID).Scan(&result).Error; err != nil {
+		return false, dbError(err)
 	}
 	return result.Exists, nil
 }
 
-func (service *PostService) GetPosts(cursor string, userID string, tag string) ([]models.Post, string, error) {
+// postSortColumns maps sort modes to the column posts are ranked by.
+var postSortColumns = map[string]string{
+	services.SortHot:           "hot",
+	services.SortTop:           "score",
+	services.SortControversial: "controversy",
+}
+
+func (service *PostService) GetPosts(postQuery services.PostQuery) ([]models.Post, string, error) {
 	posts := []models.Post{}
-	query := service.DB.Order("id desc")
-	if cursor != "" {
-		id, err := base64.StdEncoding.DecodeString(cursor)
+	column, ranked := postSortColumns[postQuery.Sort]
+	query := service.DB
+	if ranked {
+		query = query.Order(column + " desc")
+	}
+	query = query.Order("id desc")
+	if postQuery.Cursor != "" {
+		key, id, err := services.DecodePostCursor(postQuery.Cursor, postQuery.Sort)
 		if err != nil {
 			return posts, "", &errors.CursorDecodingError{}
 		}
-		query = query.Where("id <= ?", id)
+		if ranked {
+			query = query.Where(column+" < ? OR ("+column+" = ? AND id <= ?)", key, key, id)
+		} else {
+			query = query.Where("id <= ?", id)
+		}
 	}
-	if userID != "" {
-		query = query.Where("user_id = ?", userID)
+	status := postQuery.Status
+	if status == "" {
+		status = models.PostStatusPublished
+	}
+	if models.IsPrivatePostStatus(status) {
+		if postQuery.ViewerID == "" {
+			return posts, "", nil
+		}
+		query = query.Where("user_id = ?", postQuery.ViewerID)
 	}
-	if tag != "" {
-		query = query.Where("? = ANY(tags)", tag)
+	query = query.Where("status = ?", status)
+	if postQuery.UserID != "" {
+		query = query.Where("user_id = ?", postQuery.UserID)
+	}
+	if postQuery.Tag != "" {
+		query = query.Where("? = ANY(tags)", postQuery.Tag)
+	}
+	if postQuery.Sort == services.SortTop || postQuery.Sort == services.SortControversial {
+		if since, ok := services.WindowStart(postQuery.Window, time.Now()); ok {
+			query = query.Where("created_at >= ?", since)
+		}
 	}
 	// Note we over-fetch by 1 so we can check if there are more items
 	limit := 101
 	query = query.Limit(limit)
-	query.Find(&posts)
+	if err := query.Find(&posts).Error; err != nil {
+		return posts, "", dbError(err)
+	}
 	nextCursor := ""
 	if len(posts) == limit {
 		lastItem := posts[len(posts)-1]
-		nextCursor = utils.UintToBase64(lastItem.ID)
+		nextCursor = services.EncodePostCursor(lastItem, postQuery.Sort)
 		posts = posts[:len(posts)-1]
 	}
 	return posts, nextCursor, nil
 }
 
+func (service *PostService) GetPostRevisions(postID uint64, cursor string, limit int) ([]models.PostRevision, string, error) {
+	postRevisions := make([]models.PostRevision, 0)
+	query := service.DB.Where("post_id = ?", postID).Order("id desc")
+	if cursor != "" {
+		values, err := utils.DecodeCursor(cursor, 1)
+		if err != nil {
+			return postRevisions, "", &errors.CursorDecodingError{}
+		}
+		query = query.Where("id <= ?", values[0])
+	}
+	// Note we over-fetch by 1 so we can check if there are more items
+	if err := query.Limit(limit + 1).Find(&postRevisions).Error; err != nil {
+		return postRevisions, "", dbError(err)
+	}
+	nextCursor := ""
+	if len(postRevisions) == limit+1 {
+		nextCursor = utils.EncodeCursor(int64(postRevisions[limit].ID))
+		postRevisions = postRevisions[:limit]
+	}
+	return postRevisions, nextCursor, nil
+}
+
+func (service *PostService) GetPostRevision(postRevisionID uint64) (models.PostRevision, error) {
+	var postRevision models.PostRevision
+	if err := notFoundError(service.DB.First(&postRevision, postRevisionID)); err != nil {
+		return postRevision, err
+	}
+	return postRevision, nil
+}
+
 func (service *PostService) CreatePostComment(postComment *models.PostComment) error {
-	service.DB.Create(postComment)
-	return nil
+	postComment.EditedAt = nil
+	postComment.EditCount = 0
+	postComment.Version = 1
+	tx := service.DB.Begin()
+	if tx.Error != nil {
+		return dbError(tx.Error)
+	}
+	if err := tx.Create(postComment).Error; err != nil {
+		tx.Rollback()
+		return dbError(err)
+	}
+	revision := models.NewPostCommentRevision(postComment)
+	if err := tx.Create(&revision).Error; err != nil {
+		tx.Rollback()
+		return dbError(err)
+	}
+	if err := adjustPostCommentCount(tx, postComment.PostID, 1); err != nil {
+		tx.Rollback()
+		return dbError(err)
+	}
+	return dbError(tx.Commit().Error)
 }
 
 func (service *PostService) UpdatePostComment(postComment *models.PostComment) error {
-	service.DB.Save(postComment)
-	return nil
+	tx := service.DB.Begin()
+	if tx.Error != nil {
+		return dbError(tx.Error)
+	}
+	existing := models.PostComment{}
+	if err := notFoundError(tx.Set("gorm:query_option", "FOR UPDATE").Where("id = ?", postComment.ID).First(&existing)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if postComment.Version != 0 && postComment.Version != existing.Version {
+		tx.Rollback()
+		return &errors.VersionMismatch{}
+	}
+	postComment.EditedAt = existing.EditedAt
+	postComment.EditCount = existing.EditCount
+	postComment.Version = existing.Version
+	edited := postComment.Body != existing.Body
+	if edited {
+		now := time.Now()
+		postComment.EditedAt = &now
+		postComment.EditCount++
+		postComment.Version++
+	}
+	// The score is only ever changed by votes
+	if err := tx.Omit("score").Save(postComment).Error; err != nil {
+		tx.Rollback()
+		return dbError(err)
+	}
+	if edited {
+		// Comments written before revisions were recorded have no revision
+		// holding their original body, so record it before it is lost
+		previous := models.NewPostCommentRevision(&existing)
+		where := models.PostCommentRevision{PostCommentID: previous.PostCommentID, Number: previous.Number}
+		if err := tx.FirstOrCreate(&previous, where).Error; err != nil {
+			tx.Rollback()
+			return dbError(err)
+		}
+		revision := models.NewPostCommentRevision(postComment)
+		if err := tx.Create(&revision).Error; err != nil {
+			tx.Rollback()
+			return dbError(err)
+		}
+	}
+	return dbError(tx.Commit().Error)
+}
+
+func (service *PostService) GetPostCommentRevisions(postCommentID uint64, cursor string, limit int) ([]models.PostCommentRevision, string, error) {
+	postCommentRevisions := make([]models.PostCommentRevision, 0)
+	query := service.DB.Where("post_comment_id = ?", postCommentID).Order("id desc")
+	if cursor != "" {
+		values, err := utils.DecodeCursor(cursor, 1)
+		if err != nil {
+			return postCommentRevisions, "", &errors.CursorDecodingError{}
+		}
+		query = query.Where("id <= ?", values[0])
+	}
+	// Note we over-fetch by 1 so we can check if there are more items
+	if err := query.Limit(limit + 1).Find(&postCommentRevisions).Error; err != nil {
+		return postCommentRevisions, "", dbError(err)
+	}
+	nextCursor := ""
+	if len(postCommentRevisions) == limit+1 {
+		nextCursor = utils.EncodeCursor(int64(postCommentRevisions[limit].ID))
+		postCommentRevisions = postCommentRevisions[:limit]
+	}
+	return postCommentRevisions, nextCursor, nil
 }
 
 func (service *PostService) DeletePostComment(postComment *models.PostComment) error {
 	if postComment.ID == 0 {
 		return &errors.DeleteIsMissingID{}
 	}
-	service.DB.Delete(postComment)
-	return nil
+	tx := service.DB.Begin()
+	if tx.Error != nil {
+		return dbError(tx.Error)
+	}
+	if postComment.Version != 0 {
+		existing := models.PostComment{}
+		if err := notFoundError(tx.Set("gorm:query_option", "FOR UPDATE").Where("id = ?", postComment.ID).First(&existing)); err != nil {
+			tx.Rollback()
+			if _, ok := err.(*errors.NotFound); ok {
+				return nil
+			}
+			return err
+		}
+		if postComment.Version != existing.Version {
+			tx.Rollback()
+			return &errors.VersionMismatch{}
+		}
+	}
+	result := tx.Delete(postComment)
+	if result.Error != nil {
+		tx.Rollback()
+		return dbError(result.Error)
+	}
+	// Only decrement the count if the comment wasn't already deleted
+	if result.RowsAffected > 0 {
+		if err := adjustPostCommentCount(tx, postComment.PostID, -1); err != nil {
+			tx.Rollback()
+			return dbError(err)
+		}
+	}
+	return dbError(tx.Commit().Error)
 }
 
 func (service *PostService) GetPostComment(postCommentID uint64) (models.PostComment, error) {
 	p := models.PostComment{}
-	if service.DB.Where("id = ?", postCommentID).First(&p).RecordNotFound() {
-		return p, &errors.NotFound{}
+	if err := notFoundError(service.DB.Where("id = ?", postCommentID).First(&p)); err != nil {
+		return p, err
 	}
 	return p, nil
 }
 
-func (service *PostService) GetPostCommentsForPost(postID uint64) ([]models.PostComment, error) {
+func (service *PostService) GetPostCommentsForPost(postID uint64, parentID *uint64, cursor string, mode string, limit int) ([]models.PostComment, string, error) {
+	postComments := make([]models.PostComment, 0)
+	query := service.DB.Where("post_id = ?", postID)
+	if parentID != nil {
+		if *parentID == 0 {
+			query = query.Where("parent_id IS NULL")
+		} else {
+			query = query.Where("parent_id = ?", *parentID)
+		}
+	}
+	switch mode {
+	case services.SortOldest:
+		query = query.Order("id asc")
+	case services.SortTop:
+		query = query.Order("score desc").Order("id desc")
+	default:
+		query = query.Order("id desc")
+	}
+	if cursor != "" {
+		if mode == services.SortTop {
+			values, err := utils.DecodeCursor(cursor, 2)
+			if err != nil {
+				return postComments, "", &errors.CursorDecodingError{}
+			}
+			query = query.Where("score < ? OR (score = ? AND id <= ?)", values[0], values[0], values[1])
+		} else {
+			values, err := utils.DecodeCursor(cursor, 1)
+			if err != nil {
+				return postComments, "", &errors.CursorDecodingError{}
+			}
+			if mode == services.SortOldest {
+				query = query.Where("id >= ?", values[0])
+			} else {
+				query = query.Where("id <= ?", values[0])
+			}
+		}
+	}
+	// Note we over-fetch by 1 so we can check if there are more items
+	if err := query.Limit(limit + 1).Find(&postComments).Error; err != nil {
+		return postComments, "", dbError(err)
+	}
+	nextCursor := ""
+	if len(postComments) == limit+1 {
+		lastItem := postComments[len(postComments)-1]
+		if mode == services.SortTop {
+			nextCursor = utils.EncodeCursor(int64(lastItem.Score), int64(lastItem.ID))
+		} else {
+			nextCursor = utils.EncodeCursor(int64(lastItem.ID))
+		}
+		postComments = postComments[:len(postComments)-1]
+	}
+	return postComments, nextCursor, nil
+}
+
+func (service *PostService) GetPostCommentReplies(postID uint64, parentIDs []uint64, depth int) ([]models.PostComment, error) {
 	postComments := make([]models.PostComment, 0)
-	service.DB.Where("post_id = ?", postID).Order("id desc").Find(&postComments)
+	if len(parentIDs) == 0 {
+		return postComments, nil
+	}
+	args := []interface{}{postID, parentIDs}
+	depthCondition := ""
+	if depth >= 0 {
+		depthCondition = "AND thread.depth <= ?"
+		args = append(args, depth)
+	}
+	err := service.DB.Raw(`
+		WITH RECURSIVE thread AS (
+			SELECT post_comments.*, 1 AS depth FROM post_comments
+			WHERE post_id = ? AND parent_id IN (?) AND deleted_at IS NULL
+			UNION ALL
+			SELECT post_comments.*, thread.depth + 1 FROM post_comments
+			JOIN thread ON post_comments.parent_id = thread.id
+			WHERE post_comments.deleted_at IS NULL `+depthCondition+`
+		)
+		SELECT * FROM thread ORDER BY id desc`, args...).Scan(&postComments).Error
+	if err != nil {
+		return postComments, dbError(err)
+	}
 	return postComments, nil
 }
 
-func (service *PostService) GetPostVoteTotalForPost(postID uint64) int64 {
+// livePostVotes and livePostCommentVotes join votes to the post or comment
+// they are for, so votes are hidden while it is deleted.
+const (
+	livePostVotes        = "JOIN posts ON posts.id = post_votes.post_id AND posts.deleted_at IS NULL"
+	livePostCommentVotes = "JOIN post_comments ON post_comments.id = post_comment_votes.post_comment_id AND post_comments.deleted_at IS NULL"
+)
+
+func (service *PostService) GetPostVoteTotalForPost(postID uint64) (int64, error) {
 	result := struct {
 		Total int64
 	}{}
-	service.DB.Raw("SELECT SUM(value) as total FROM post_votes WHERE post_id = ?", postID).Scan(&result)
-	return result.Total
+	err := service.DB.Raw(`
+		SELECT SUM(v.value) as total FROM post_votes v JOIN posts p ON p.id = v.post_id
+		WHERE v.post_id = ? AND p.deleted_at IS NULL`, postID).Scan(&result).Error
+	if err != nil {
+		return 0, dbError(err)
+	}
+	return result.Total, nil
 }
 
 func (service *PostService) GetPostVote(postID uint64, userID string) (models.PostVote, error) {
 	pV := models.PostVote{}
-	if service.DB.Where("post_id = ?", postID).Where("user_id = ?", userID).First(&pV).RecordNotFound() {
-		return pV, &errors.NotFound{}
+	query := service.DB.Select("post_votes.*").Joins(livePostVotes).Where("post_votes.post_id = ?", postID).Where("post_votes.user_id = ?", userID)
+	if err := notFoundError(query.First(&pV)); err != nil {
+		return pV, err
 	}
 	return pV, nil
 }
 
-func (service *PostService) GetPostVoteUsersForPost(postID uint64) []string {
+func (service *PostService) GetPostVoteUsersForPost(postID uint64) ([]string, error) {
 	postVotes := []models.PostVote{}
-	service.DB.Select("DISTINCT user_id").Where("post_id = ?", postID).Find(&postVotes)
 	userIDs := make([]string, 0)
+	query := service.DB.Select("DISTINCT post_votes.user_id").Joins(livePostVotes).Where("post_votes.post_id = ?", postID).Order("post_votes.user_id")
+	if err := query.Find(&postVotes).Error; err != nil {
+		return userIDs, dbError(err)
+	}
 	for _, pV := range postVotes {
 		userIDs = append(userIDs, pV.UserID)
 	}
-	return userIDs
+	return userIDs, nil
 }
 
-func (service *PostService) CreatePostVote(postVote *models.PostVote) error {
-	service.DB.Create(postVote)
-	return nil
+// CreatePostVote inserts the vote or, if the user has already voted on the
+// post, changes its value. A concurrent vote by the same user waits on the
+// primary key for this one to commit, then changes its value in turn.
+func (service *PostService) CreatePostVote(postVote *models.PostVote) (bool, error) {
+	tx := service.DB.Begin()
+	if tx.Error != nil {
+		return false, dbError(tx.Error)
+	}
+	for {
+		postVote.CreatedAt = time.Now()
+		result := tx.Exec(
+			"INSERT INTO post_votes (created_at, user_id, post_id, value) VALUES (?, ?, ?, ?) ON CONFLICT (user_id, post_id) DO NOTHING",
+			postVote.CreatedAt, postVote.UserID, postVote.PostID, postVote.Value)
+		if result.Error != nil {
+			tx.Rollback()
+			return false, dbError(result.Error)
+		}
+		if result.RowsAffected == 1 {
+			if err := adjustPostVoteCounts(tx, postVote.PostID, 0, postVote.Value); err != nil {
+				tx.Rollback()
+				return false, dbError(err)
+			}
+			if err := tx.Commit().Error; err != nil {
+				return false, dbError(err)
+			}
+			return true, nil
+		}
+		// The existing vote is locked so the counters are adjusted from the
+		// value being replaced. If it was retracted since the insert the
+		// insert is tried again.
+		existing := models.PostVote{}
+		query := tx.Set("gorm:query_option", "FOR UPDATE").Where("post_id = ?", postVote.PostID).Where("user_id = ?", postVote.UserID).First(&existing)
+		if query.RecordNotFound() {
+			continue
+		}
+		if query.Error != nil {
+			tx.Rollback()
+			return false, dbError(query.Error)
+		}
+		postVote.CreatedAt = existing.CreatedAt
+		if existing.Value != postVote.Value {
+			query = tx.Model(&models.PostVote{}).Where("post_id = ?", postVote.PostID).Where("user_id = ?", postVote.UserID)
+			if err := query.Update("value", postVote.Value).Error; err != nil {
+				tx.Rollback()
+				return false, dbError(err)
+			}
+			if err := adjustPostVoteCounts(tx, postVote.PostID, existing.Value, postVote.Value); err != nil {
+				tx.Rollback()
+				return false, dbError(err)
+			}
+		}
+		if err := tx.Commit().Error; err != nil {
+			return false, dbError(err)
+		}
+		return false, nil
+	}
+}
+
+func (service *PostService) DeletePostVote(postVote *models.PostVote) error {
+	tx := service.DB.Begin()
+	if tx.Error != nil {
+		return dbError(tx.Error)
+	}
+	existing := models.PostVote{}
+	query := tx.Set("gorm:query_option", "FOR UPDATE").Where("post_id = ?", postVote.PostID).Where("user_id = ?", postVote.UserID)
+	if err := notFoundError(query.First(&existing)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	query = tx.Where("post_id = ?", postVote.PostID).Where("user_id = ?", postVote.UserID)
+	if err := query.Delete(&models.PostVote{}).Error; err != nil {
+		tx.Rollback()
+		return dbError(err)
+	}
+	if err := adjustPostVoteCounts(tx, postVote.PostID, existing.Value, 0); err != nil {
+		tx.Rollback()
+		return dbError(err)
+	}
+	return dbError(tx.Commit().Error)
+}
+
+func (service *PostService) GetPostCommentVoteTotalForPostComment(postCommentID uint64) (int64, error) {
+	result := struct {
+		Total int64
+	}{}
+	err := service.DB.Raw(`
+		SELECT SUM(v.value) as total FROM post_comment_votes v JOIN post_comments c ON c.id = v.post_comment_id
+		WHERE v.post_comment_id = ? AND c.deleted_at IS NULL`, postCommentID).Scan(&result).Error
+	if err != nil {
+		return 0, dbError(err)
+	}
+	return result.Total, nil
+}
+
+func (service *PostService) GetPostCommentVote(postCommentID uint64, userID string) (models.PostCommentVote, error) {
+	pCV := models.PostCommentVote{}
+	query := service.DB.Select("post_comment_votes.*").Joins(livePostCommentVotes).Where("post_comment_votes.post_comment_id = ?", postCommentID).Where("post_comment_votes.user_id = ?", userID)
+	if err := notFoundError(query.First(&pCV)); err != nil {
+		return pCV, err
+	}
+	return pCV, nil
+}
+
+func (service *PostService) GetPostCommentVoteUsersForPostComment(postCommentID uint64) ([]string, error) {
+	postCommentVotes := []models.PostCommentVote{}
+	userIDs := make([]string, 0)
+	query := service.DB.Select("DISTINCT post_comment_votes.user_id").Joins(livePostCommentVotes).Where("post_comment_votes.post_comment_id = ?", postCommentID).Order("post_comment_votes.user_id")
+	if err := query.Find(&postCommentVotes).Error; err != nil {
+		return userIDs, dbError(err)
+	}
+	for _, pCV := range postCommentVotes {
+		userIDs = append(userIDs, pCV.UserID)
+	}
+	return userIDs, nil
+}
+
+// adjustPostCommentScore adds delta to the score of a comment. It is called
+// within the same transaction as the vote change so the two stay consistent.
+func adjustPostCommentScore(tx *gorm.DB, postCommentID uint, delta int) error {
+	return tx.Model(&models.PostComment{}).Where("id = ?", postCommentID).UpdateColumns(map[string]interface{}{
+		"score":      gorm.Expr("score + ?", delta),
+		"updated_at": time.Now(),
+	}).Error
+}
+
+// CreatePostCommentVote inserts the vote or, if the user has already voted on
+// the comment, changes its value, in the same way as CreatePostVote.
+func (service *PostService) CreatePostCommentVote(postCommentVote *models.PostCommentVote) (bool, error) {
+	tx := service.DB.Begin()
+	if tx.Error != nil {
+		return false, dbError(tx.Error)
+	}
+	for {
+		postCommentVote.CreatedAt = time.Now()
+		result := tx.Exec(
+			"INSERT INTO post_comment_votes (created_at, user_id, post_comment_id, value) VALUES (?, ?, ?, ?) ON CONFLICT (user_id, post_comment_id) DO NOTHING",
+			postCommentVote.CreatedAt, postCommentVote.UserID, postCommentVote.PostCommentID, postCommentVote.Value)
+		if result.Error != nil {
+			tx.Rollback()
+			return false, dbError(result.Error)
+		}
+		if result.RowsAffected == 1 {
+			if err := adjustPostCommentScore(tx, postCommentVote.PostCommentID, postCommentVote.Value); err != nil {
+				tx.Rollback()
+				return false, dbError(err)
+			}
+			if err := tx.Commit().Error; err != nil {
+				return false, dbError(err)
+			}
+			return true, nil
+		}
+		existing := models.PostCommentVote{}
+		query := tx.Set("gorm:query_option", "FOR UPDATE").Where("post_comment_id = ?", postCommentVote.PostCommentID).Where("user_id = ?", postCommentVote.UserID).First(&existing)
+		if query.RecordNotFound() {
+			continue
+		}
+		if query.Error != nil {
+			tx.Rollback()
+			return false, dbError(query.Error)
+		}
+		postCommentVote.CreatedAt = existing.CreatedAt
+		if existing.Value != postCommentVote.Value {
+			query = tx.Model(&models.PostCommentVote{}).Where("post_comment_id = ?", postCommentVote.PostCommentID).Where("user_id = ?", postCommentVote.UserID)
+			if err := query.Update("value", postCommentVote.Value).Error; err != nil {
+				tx.Rollback()
+				return false, dbError(err)
+			}
+			if err := adjustPostCommentScore(tx, postCommentVote.PostCommentID, postCommentVote.Value-existing.Value); err != nil {
+				tx.Rollback()
+				return false, dbError(err)
+			}
+		}
+		if err := tx.Commit().Error; err != nil {
+			return false, dbError(err)
+		}
+		return false, nil
+	}
+}
+
+func (service *PostService) DeletePostCommentVote(postCommentVote *models.PostCommentVote) error {
+	tx := service.DB.Begin()
+	if tx.Error != nil {
+		return dbError(tx.Error)
+	}
+	existing := models.PostCommentVote{}
+	query := tx.Set("gorm:query_option", "FOR UPDATE").Where("post_comment_id = ?", postCommentVote.PostCommentID).Where("user_id = ?", postCommentVote.UserID)
+	if err := notFoundError(query.First(&existing)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	query = tx.Where("post_comment_id = ?", postCommentVote.PostCommentID).Where("user_id = ?", postCommentVote.UserID)
+	if err := query.Delete(&models.PostCommentVote{}).Error; err != nil {
+		tx.Rollback()
+		return dbError(err)
+	}
+	if err := adjustPostCommentScore(tx, postCommentVote.PostCommentID, -existing.Value); err != nil {
+		tx.Rollback()
+		return dbError(err)
+	}
+	return dbError(tx.Commit().Error)
 }
 
 func (service *PostService) CreatePostSave(postSave *models.PostSave) (models.PostSave, bool, error) {
 	existingPostSave := models.PostSave{}
-	service.DB.Unscoped().Where("post_id = ?", postSave.PostID).Where("user_id = ?", postSave.UserID).First(&existingPostSave)
+	query := service.DB.Unscoped().Where("post_id = ?", postSave.PostID).Where("user_id = ?", postSave.UserID).First(&existingPostSave)
+	if query.Error != nil && !query.RecordNotFound() {
+		return existingPostSave, false, dbError(query.Error)
+	}
 	if existingPostSave.ID > 0 {
-		service.DB.Unscoped().Model(&existingPostSave).Update("deleted_at", nil)
+		if err := service.DB.Unscoped().Model(&existingPostSave).Update("deleted_at", nil).Error; err != nil {
+			return existingPostSave, false, dbError(err)
+		}
 		return existingPostSave, false, nil
 	}
-	service.DB.Create(postSave)
+	if err := service.DB.Create(postSave).Error; err != nil {
+		return *postSave, false, dbError(err)
+	}
 	return *postSave, true, nil
 }
 
 func (service *PostService) GetPostSave(postSaveID uint64) (models.PostSave, error) {
 	results := models.PostSave{}
-	if service.DB.Where("id = ?", postSaveID).First(&results).RecordNotFound() {
-		return results, &errors.NotFound{}
+	if err := notFoundError(service.DB.Where("id = ?", postSaveID).First(&results)); err != nil {
+		return results, err
 	}
 	return results, nil
 }
 
 func (service *PostService) GetPostSaves(postID uint64, userID string) ([]models.PostSave, error) {
 	results := []models.PostSave{}
-	var query *gorm.DB
+	query := service.DB.Order("id")
 	if postID > 0 {
-		query = service.DB.Where("post_id = ?", postID)
+		query = query.Where("post_id = ?", postID)
 	}
 	if userID != "" {
-		query = service.DB.Where("user_id = ?", userID)
+		query = query.Where("user_id = ?", userID)
+	}
+	if err := query.Find(&results).Error; err != nil {
+		return results, dbError(err)
 	}
-	query.Find(&results)
 	return results, nil
 }
 
@@ -182,12 +976,85 @@ func (service *PostService) DeletePostSave(postSave *models.PostSave) error {
 	if postSave.ID == 0 {
 		return &errors.DeleteIsMissingID{}
 	}
-	service.DB.Delete(postSave)
-	return nil
+	return dbError(service.DB.Delete(postSave).Error)
 }
 
 func (service *PostService) GetTags() ([]string, error) {
 	tags := pq.StringArray{}
-	service.DB.Raw("SELECT array_agg(DISTINCT flattags) FROM posts, unnest(tags) as flattags").Row().Scan(&tags)
+	err := service.DB.Raw("SELECT array_agg(DISTINCT flattags) FROM posts, unnest(tags) as flattags WHERE deleted_at IS NULL AND status NOT IN ('draft', 'scheduled')").Row().Scan(&tags)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	if tags == nil {
+		// array_agg returns NULL when there are no tags
+		return []string{}, nil
+	}
 	return tags, nil
 }
+
+// searchHeadlineOptions configures the snippets returned by Search.
+const searchHeadlineOptions = "StartSel=<mark>, StopSel=</mark>, MaxWords=35, MinWords=15, MaxFragments=2"
+
+// searchHeadlineBody is the body of a search result escaped as HTML, which is
+// highlighted so that the only markup in snippets are the <mark> tags. The
+// parser reads the entities as single tokens so words are still matched.
+const searchHeadlineBody = "replace(replace(replace(body, '&', '&amp;'), '<', '&lt;'), '>', '&gt;')"
+
+func (service *PostService) Search(query string, kind string, cursor string, limit int) ([]models.SearchResult, string, error) {
+	results := make([]models.SearchResult, 0)
+	where := ""
+	var cursorArgs []interface{}
+	if cursor != "" {
+		first, err := services.DecodeSearchCursor(cursor)
+		if err != nil {
+			return results, "", &errors.CursorDecodingError{}
+		}
+		where = "WHERE (rank, type, id) <= (?, ?, ?)"
+		cursorArgs = []interface{}{first.Rank, first.Type, first.ID}
+	}
+	var selects []string
+	var args []interface{}
+	if kind == "" || kind == models.SearchResultPost {
+		selects = append(selects, `
+			SELECT 'post' AS type, id, id AS post_id, title, body, ts_rank(`+postSearchDocument+`, query)::float8 AS rank
+			FROM posts, websearch_to_tsquery('english', ?) query
+			WHERE deleted_at IS NULL AND status NOT IN ('draft', 'scheduled') AND `+postSearchDocument+` @@ query`)
+		args = append(args, query)
+	}
+	if kind == "" || kind == models.SearchResultComment {
+		selects = append(selects, `
+			SELECT 'comment' AS type, id, post_id, '' AS title, body, ts_rank(`+postCommentSearchDocument+`, query)::float8 AS rank
+			FROM post_comments, websearch_to_tsquery('english', ?) query
+			WHERE deleted_at IS NULL AND `+postCommentSearchDocument+` @@ query
+				AND EXISTS (SELECT 1 FROM posts WHERE posts.id = post_comments.post_id AND posts.status NOT IN ('draft', 'scheduled'))`)
+		args = append(args, query)
+	}
+	if len(selects) == 0 {
+		return results, "", nil
+	}
+	// Snippets are only generated for the page of results as ts_headline is
+	// expensive. Ranks are compared as double precision, in which they are
+	// returned, so that the cursor matches them exactly. Note we over-fetch by
+	// 1 so we can check if there are more items.
+	args = append([]interface{}{query}, args...)
+	args = append(args, cursorArgs...)
+	args = append(args, limit+1)
+	err := service.DB.Raw(`
+		SELECT type, id, post_id, title, rank,
+			ts_headline('english', `+searchHeadlineBody+`, websearch_to_tsquery('english', ?), '`+searchHeadlineOptions+`') AS snippet
+		FROM (
+			SELECT * FROM (`+strings.Join(selects, " UNION ALL ")+`) ranked `+where+`
+			ORDER BY rank DESC, type DESC, id DESC
+			LIMIT ?
+		) matches
+		ORDER BY rank DESC, type DESC, id DESC`, args...).Scan(&results).Error
+	if err != nil {
+		return results, "", dbError(err)
+	}
+	nextCursor := ""
+	if len(results) == limit+1 {
+		nextCursor = services.EncodeSearchCursor(results[limit])
+		results = results[:limit]
+	}
+	return results, nextCursor, nil
+}
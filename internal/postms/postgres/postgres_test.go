@@ -0,0 +1,150 @@
+package postgres
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/willdady/postms/internal/postms/services"
+	"github.com/willdady/postms/internal/postms/services/servicestest"
+	"github.com/willdady/postms/internal/utils"
+)
+
+// testSchema is the schema the tests run in. It is dropped and recreated for
+// every test so the rest of the database is left untouched.
+const testSchema = "postms_test"
+
+// testConnectionString returns the connection string of the database to test
+// against, or an empty string if none is configured. DATABASE_URL is used if
+// set, otherwise the PG_* variables read by the server if PG_HOST is set.
+func testConnectionString(t *testing.T) string {
+	if databaseURL := os.Getenv("DATABASE_URL"); databaseURL != "" {
+		u, err := url.Parse(databaseURL)
+		if err != nil {
+			t.Fatalf("Invalid DATABASE_URL: %v", err)
+		}
+		query := u.Query()
+		query.Set("search_path", testSchema)
+		u.RawQuery = query.Encode()
+		return u.String()
+	}
+	if os.Getenv("PG_HOST") == "" {
+		return ""
+	}
+	return fmt.Sprintf("host=%v port=%v user=%v dbname=%v password=%v sslmode=%v search_path=%v",
+		os.Getenv("PG_HOST"),
+		utils.Getenv("PG_PORT", "5432"),
+		utils.Getenv("PG_USER", "postgres"),
+		utils.Getenv("PG_DB", "postgres"),
+		utils.Getenv("PG_PASSWORD", "mysecretpassword"),
+		utils.Getenv("PG_SSL_MODE", "disable"),
+		testSchema)
+}
+
+// openTestDB connects to the test database, skipping the test if none is
+// configured, and migrates a new, empty test schema.
+func openTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	connectionString := testConnectionString(t)
+	if connectionString == "" {
+		t.Skip("Set DATABASE_URL or PG_HOST to test against Postgres")
+	}
+	db, err := gorm.Open("postgres", connectionString)
+	if err != nil {
+		t.Fatalf("Failed to connect to database: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec("DROP SCHEMA IF EXISTS " + testSchema + " CASCADE")
+		db.Close()
+	})
+	if err := db.Exec("DROP SCHEMA IF EXISTS " + testSchema + " CASCADE").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("CREATE SCHEMA " + testSchema).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(db); err != nil {
+		t.Fatalf("Migrate() returned error: %v", err)
+	}
+	return db
+}
+
+func TestPostService(t *testing.T) {
+	if testConnectionString(t) == "" {
+		t.Skip("Set DATABASE_URL or PG_HOST to test against Postgres")
+	}
+	servicestest.Run(t, func(t *testing.T) services.PostService {
+		return NewPostService(openTestDB(t))
+	})
+}
+
+func TestMigrateDown(t *testing.T) {
+	db := openTestDB(t)
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reverted, err := MigrateDown(db, len(migrations))
+	if err != nil {
+		t.Fatalf("MigrateDown() returned error: %v", err)
+	}
+	if len(reverted) != len(migrations) {
+		t.Errorf("MigrateDown() reverted %d migrations, want %d", len(reverted), len(migrations))
+	}
+	applied, err := MigrateUp(db)
+	if err != nil {
+		t.Fatalf("MigrateUp() returned error: %v", err)
+	}
+	if len(applied) != len(migrations) {
+		t.Errorf("MigrateUp() applied %d migrations, want %d", len(applied), len(migrations))
+	}
+}
+
+func TestMigrationStatuses(t *testing.T) {
+	db := openTestDB(t)
+	statuses, err := MigrationStatuses(db)
+	if err != nil {
+		t.Fatalf("MigrationStatuses() returned error: %v", err)
+	}
+	for _, status := range statuses {
+		if status.AppliedAt == nil {
+			t.Errorf("expected migration %d to be applied", status.Version)
+		}
+	}
+
+	// Without the schema_migrations table every migration is pending, and the
+	// table is not created
+	if err := db.Exec("DROP TABLE schema_migrations").Error; err != nil {
+		t.Fatal(err)
+	}
+	statuses, err = MigrationStatuses(db)
+	if err != nil {
+		t.Fatalf("MigrationStatuses() returned error: %v", err)
+	}
+	for _, status := range statuses {
+		if status.AppliedAt != nil {
+			t.Errorf("expected migration %d to be pending", status.Version)
+		}
+	}
+	if db.HasTable("schema_migrations") {
+		t.Error("expected MigrationStatuses() not to create schema_migrations")
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatalf("Migrations() returned error: %v", err)
+	}
+	if len(migrations) == 0 || migrations[0].Name != "initial" {
+		t.Fatalf("Migrations() = %v, want the initial migration first", migrations)
+	}
+	for i, migration := range migrations {
+		if migration.Version != int64(i+1) {
+			t.Errorf("Migration %s has version %d, want %d", migration.Name, migration.Version, i+1)
+		}
+	}
+}
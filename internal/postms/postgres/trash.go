@@ -0,0 +1,311 @@
+package postgres
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/willdady/postms/internal/errors"
+	"github.com/willdady/postms/internal/postms/models"
+	"github.com/willdady/postms/internal/postms/services"
+)
+
+func (service *PostService) GetTrash(userID string, cursor string, limit int) ([]models.TrashItem, string, error) {
+	items := make([]models.TrashItem, 0)
+	where := ""
+	args := []interface{}{userID, userID}
+	if cursor != "" {
+		first, err := services.DecodeTrashCursor(cursor)
+		if err != nil {
+			return items, "", &errors.CursorDecodingError{}
+		}
+		where = "WHERE (deleted_at, type, id) <= (?, ?, ?)"
+		args = append(args, first.DeletedAt, first.Type, first.ID)
+	}
+	// Note we over-fetch by 1 so we can check if there are more items
+	args = append(args, limit+1)
+	err := service.DB.Raw(`
+		SELECT * FROM (
+			SELECT 'post' AS type, id, id AS post_id, title, body, deleted_at
+			FROM posts
+			WHERE user_id = ? AND deleted_at IS NOT NULL
+			UNION ALL
+			SELECT 'comment' AS type, c.id, c.post_id, '' AS title, c.body, c.deleted_at
+			FROM post_comments c JOIN posts p ON p.id = c.post_id
+			WHERE c.user_id = ? AND c.deleted_at IS NOT NULL AND p.deleted_at IS NULL
+		) trash `+where+`
+		ORDER BY deleted_at DESC, type DESC, id DESC
+		LIMIT ?`, args...).Scan(&items).Error
+	if err != nil {
+		return items, "", dbError(err)
+	}
+	nextCursor := ""
+	if len(items) == limit+1 {
+		nextCursor = services.EncodeTrashCursor(items[limit])
+		items = items[:limit]
+	}
+	return items, nextCursor, nil
+}
+
+func (service *PostService) GetDeletedPost(postID uint64) (models.Post, error) {
+	p := models.Post{}
+	query := service.DB.Unscoped().Where("id = ? AND deleted_at IS NOT NULL", postID)
+	if err := notFoundError(query.First(&p)); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+func (service *PostService) GetDeletedPostComment(postCommentID uint64) (models.PostComment, error) {
+	p := models.PostComment{}
+	query := service.DB.Unscoped().Where("id = ? AND deleted_at IS NOT NULL", postCommentID)
+	if err := notFoundError(query.First(&p)); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// recountPostComments sets the comment count of a post to its number of
+// comments which are not deleted.
+func recountPostComments(tx *gorm.DB, postID uint) error {
+	count := gorm.Expr("(SELECT COUNT(*) FROM post_comments WHERE post_id = ? AND deleted_at IS NULL)", postID)
+	return tx.Model(&models.Post{}).Where("id = ?", postID).UpdateColumns(map[string]interface{}{
+		"comment_count": count,
+		"updated_at":    time.Now(),
+	}).Error
+}
+
+func (service *PostService) RestorePost(postID uint64) error {
+	tx := service.DB.Begin()
+	if tx.Error != nil {
+		return dbError(tx.Error)
+	}
+	post := models.Post{}
+	query := tx.Unscoped().Set("gorm:query_option", "FOR UPDATE").Where("id = ? AND deleted_at IS NOT NULL", postID)
+	if err := notFoundError(query.First(&post)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	query = tx.Unscoped().Model(&models.Post{}).Where("id = ?", post.ID)
+	if err := query.UpdateColumn("deleted_at", nil).Error; err != nil {
+		tx.Rollback()
+		return dbError(err)
+	}
+	// Comments and saves deleted along with the post share its deletion time
+	for _, model := range []interface{}{&models.PostComment{}, &models.PostSave{}} {
+		query := tx.Unscoped().Model(model).Where("post_id = ? AND deleted_at = ?", post.ID, *post.DeletedAt)
+		if err := query.UpdateColumn("deleted_at", nil).Error; err != nil {
+			tx.Rollback()
+			return dbError(err)
+		}
+	}
+	if err := recountPostComments(tx, post.ID); err != nil {
+		tx.Rollback()
+		return dbError(err)
+	}
+	return dbError(tx.Commit().Error)
+}
+
+func (service *PostService) RestorePostComment(postCommentID uint64) error {
+	tx := service.DB.Begin()
+	if tx.Error != nil {
+		return dbError(tx.Error)
+	}
+	postComment := models.PostComment{}
+	query := tx.Unscoped().Set("gorm:query_option", "FOR UPDATE").Where("id = ? AND deleted_at IS NOT NULL", postCommentID)
+	if err := notFoundError(query.First(&postComment)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	// Lock the post so it can not be deleted while the comment is restored
+	query = tx.Set("gorm:query_option", "FOR SHARE").Where("id = ?", postComment.PostID)
+	if err := notFoundError(query.First(&models.Post{})); err != nil {
+		tx.Rollback()
+		if _, ok := err.(*errors.NotFound); ok {
+			return &errors.RestoreParentIsDeleted{}
+		}
+		return err
+	}
+	query = tx.Unscoped().Model(&models.PostComment{}).Where("id = ?", postComment.ID)
+	if err := query.UpdateColumn("deleted_at", nil).Error; err != nil {
+		tx.Rollback()
+		return dbError(err)
+	}
+	if err := adjustPostCommentCount(tx, postComment.PostID, 1); err != nil {
+		tx.Rollback()
+		return dbError(err)
+	}
+	return dbError(tx.Commit().Error)
+}
+
+func (service *PostService) PurgePost(postID uint64) error {
+	tx := service.DB.Begin()
+	if tx.Error != nil {
+		return dbError(tx.Error)
+	}
+	post := models.Post{}
+	if err := notFoundError(tx.Unscoped().Set("gorm:query_option", "FOR UPDATE").Where("id = ?", postID).First(&post)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := purgePosts(tx, []uint{post.ID}, &services.PurgeReport{}); err != nil {
+		tx.Rollback()
+		return dbError(err)
+	}
+	return dbError(tx.Commit().Error)
+}
+
+func (service *PostService) PurgePostComment(postCommentID uint64) error {
+	tx := service.DB.Begin()
+	if tx.Error != nil {
+		return dbError(tx.Error)
+	}
+	postComment := models.PostComment{}
+	if err := notFoundError(tx.Unscoped().Set("gorm:query_option", "FOR UPDATE").Where("id = ?", postCommentID).First(&postComment)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := purgePostComments(tx, []uint{postComment.ID}, &services.PurgeReport{}); err != nil {
+		tx.Rollback()
+		return dbError(err)
+	}
+	if postComment.DeletedAt == nil {
+		if err := adjustPostCommentCount(tx, postComment.PostID, -1); err != nil {
+			tx.Rollback()
+			return dbError(err)
+		}
+	}
+	return dbError(tx.Commit().Error)
+}
+
+// purgeDelete describes rows to delete when purging, matched by a condition on
+// the IDs being purged, and where to count them in a PurgeReport.
+type purgeDelete struct {
+	model interface{}
+	where string
+	count *int
+}
+
+func execPurgeDeletes(tx *gorm.DB, ids []uint, deletes []purgeDelete) error {
+	for _, d := range deletes {
+		result := tx.Unscoped().Where(d.where, ids).Delete(d.model)
+		if result.Error != nil {
+			return result.Error
+		}
+		*d.count += int(result.RowsAffected)
+	}
+	return nil
+}
+
+// purgePosts permanently deletes posts along with everything belonging to
+// them, counting what was deleted in report.
+func purgePosts(tx *gorm.DB, postIDs []uint, report *services.PurgeReport) error {
+	// Rows are deleted before those they refer to. Slugs are left to the
+	// cascade of their foreign key.
+	comments := "post_comment_id IN (SELECT id FROM post_comments WHERE post_id IN (?))"
+	return execPurgeDeletes(tx, postIDs, []purgeDelete{
+		{&models.PostCommentVote{}, comments, &report.PostCommentVotes},
+		{&models.PostCommentRevision{}, comments, &report.PostCommentRevisions},
+		{&models.PostComment{}, "post_id IN (?)", &report.PostComments},
+		{&models.PostVote{}, "post_id IN (?)", &report.PostVotes},
+		{&models.PostSave{}, "post_id IN (?)", &report.PostSaves},
+		{&models.PostRevision{}, "post_id IN (?)", &report.PostRevisions},
+		{&models.Post{}, "id IN (?)", &report.Posts},
+	})
+}
+
+// purgePostComments permanently deletes comments along with their votes and
+// revisions, counting what was deleted in report. Replies are moved up to the
+// nearest ancestor which is not being deleted rather than lost.
+func purgePostComments(tx *gorm.DB, postCommentIDs []uint, report *services.PurgeReport) error {
+	for {
+		// Each pass moves replies up one level
+		result := tx.Exec(`
+			UPDATE post_comments c SET parent_id = d.parent_id
+			FROM post_comments d
+			WHERE c.parent_id = d.id AND d.id IN (?) AND c.id NOT IN (?)`, postCommentIDs, postCommentIDs)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			break
+		}
+	}
+	return execPurgeDeletes(tx, postCommentIDs, []purgeDelete{
+		{&models.PostCommentVote{}, "post_comment_id IN (?)", &report.PostCommentVotes},
+		{&models.PostCommentRevision{}, "post_comment_id IN (?)", &report.PostCommentRevisions},
+		{&models.PostComment{}, "id IN (?)", &report.PostComments},
+	})
+}
+
+// purgePostSaves permanently deletes saves, counting them in report.
+func purgePostSaves(tx *gorm.DB, postSaveIDs []uint, report *services.PurgeReport) error {
+	return execPurgeDeletes(tx, postSaveIDs, []purgeDelete{
+		{&models.PostSave{}, "id IN (?)", &report.PostSaves},
+	})
+}
+
+func (service *PostService) PurgeDeleted(before time.Time, batchSize int) (services.PurgeReport, error) {
+	report := services.PurgeReport{}
+	// Posts are purged first as doing so also purges their comments and saves
+	tables := []struct {
+		name  string
+		purge func(tx *gorm.DB, ids []uint, report *services.PurgeReport) error
+	}{
+		{"posts", purgePosts},
+		{"post_comments", purgePostComments},
+		{"post_saves", purgePostSaves},
+	}
+	for _, table := range tables {
+		for {
+			count, err := service.purgeBatch(table.name, before, batchSize, table.purge, &report)
+			if err != nil {
+				return report, dbError(err)
+			}
+			if count < batchSize {
+				break
+			}
+		}
+	}
+	return report, nil
+}
+
+// purgeBatch purges at most batchSize rows of table deleted before the given
+// time in a single transaction, returning how many rows were selected.
+func (service *PostService) purgeBatch(table string, before time.Time, batchSize int, purge func(tx *gorm.DB, ids []uint, report *services.PurgeReport) error, report *services.PurgeReport) (int, error) {
+	tx := service.DB.Begin()
+	if tx.Error != nil {
+		return 0, dbError(tx.Error)
+	}
+	// SKIP LOCKED lets several replicas purge at once without waiting on
+	// each other, or on rows which are being restored
+	rows, err := tx.Raw("SELECT id FROM "+table+" WHERE deleted_at < ? ORDER BY id LIMIT ? FOR UPDATE SKIP LOCKED", before, batchSize).Rows()
+	if err != nil {
+		tx.Rollback()
+		return 0, dbError(err)
+	}
+	ids := []uint{}
+	for rows.Next() {
+		var id uint
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return 0, dbError(err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if len(ids) == 0 {
+		tx.Rollback()
+		return 0, nil
+	}
+	batch := services.PurgeReport{}
+	if err := purge(tx, ids, &batch); err != nil {
+		tx.Rollback()
+		return 0, dbError(err)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return 0, dbError(err)
+	}
+	report.Add(batch)
+	return len(ids), nil
+}
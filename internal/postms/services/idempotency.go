@@ -0,0 +1,36 @@
+package services
+
+import (
+	"net/http"
+	"time"
+)
+
+// IdempotencyRecord is a request made with an Idempotency-Key along with its
+// response. Status is 0 while the request is in progress.
+type IdempotencyRecord struct {
+	Key         string
+	Fingerprint string
+	Status      int
+	Header      http.Header
+	Body        []byte
+	CreatedAt   time.Time
+}
+
+// IdempotencyStore stores the responses to requests made with an
+// Idempotency-Key so that retries of them can be answered without repeating
+// the request. It must be safe for concurrent use.
+type IdempotencyStore interface {
+	// Claim records that a request with the given key and fingerprint is in
+	// progress, returning true. If the key is already recorded and was created
+	// after expiredBefore its record is returned instead, along with false.
+	// Expired records are replaced.
+	Claim(key string, fingerprint string, expiredBefore time.Time) (IdempotencyRecord, bool, error)
+	// Complete stores the response to the request claiming key.
+	Complete(key string, status int, header http.Header, body []byte) error
+	// Release forgets the request claiming key if it has not been completed,
+	// so that it may be retried.
+	Release(key string) error
+	// DeleteExpired removes records created before expiredBefore, returning
+	// how many were removed.
+	DeleteExpired(expiredBefore time.Time) (int64, error)
+}
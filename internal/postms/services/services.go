@@ -1,28 +1,159 @@
 package services
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/willdady/postms/internal/postms/models"
 )
 
+// PostQuery selects a page of posts. Empty fields are not used to filter.
+type PostQuery struct {
+	Cursor string
+	UserID string
+	Tag    string
+	// Sort is one of SortNewest (the default), SortHot, SortTop or
+	// SortControversial.
+	Sort string
+	// Window limits SortTop and SortControversial to recent posts.
+	Window string
+	// Status selects posts with the given status, defaulting to published.
+	// Drafts and scheduled posts are only returned when they belong to
+	// ViewerID.
+	Status   string
+	ViewerID string
+}
+
+// PurgeReport counts the rows permanently deleted by a purge.
+type PurgeReport struct {
+	Posts                int `json:"posts"`
+	PostComments         int `json:"comments"`
+	PostSaves            int `json:"saves"`
+	PostVotes            int `json:"postVotes"`
+	PostCommentVotes     int `json:"commentVotes"`
+	PostRevisions        int `json:"postRevisions"`
+	PostCommentRevisions int `json:"commentRevisions"`
+}
+
+// Add adds the counts of other to r.
+func (r *PurgeReport) Add(other PurgeReport) {
+	r.Posts += other.Posts
+	r.PostComments += other.PostComments
+	r.PostSaves += other.PostSaves
+	r.PostVotes += other.PostVotes
+	r.PostCommentVotes += other.PostCommentVotes
+	r.PostRevisions += other.PostRevisions
+	r.PostCommentRevisions += other.PostCommentRevisions
+}
+
+func (r PurgeReport) String() string {
+	return fmt.Sprintf(
+		"%d posts, %d comments, %d saves, %d post votes, %d comment votes, %d post revisions, %d comment revisions",
+		r.Posts, r.PostComments, r.PostSaves, r.PostVotes, r.PostCommentVotes, r.PostRevisions, r.PostCommentRevisions)
+}
+
 type PostService interface {
+	// CreatePost and UpdatePost set the slug of the post. A slug given in the
+	// post which differs from its current one replaces it, returning
+	// *errors.SlugTaken if another post has or has had it. Otherwise the slug
+	// is kept if given, and without one it is generated from the title with a
+	// numeric suffix if already taken. Published and archived posts keep their
+	// slug rather than generating a new one. Previous slugs are kept so
+	// GetPostBySlug still finds the post.
+	//
+	// UpdatePost and DeletePost, along with UpdatePostComment and
+	// DeletePostComment, check a non-zero Version against the current version
+	// and return *errors.VersionMismatch if they differ. Writes set Version to
+	// the new version. UpdatePost leaves a post whose title, slug, body and
+	// tags are unchanged as it is, without a new version or revision.
 	CreatePost(post *models.Post) error
 	UpdatePost(post *models.Post) error
 	DeletePost(post *models.Post) error
+	UpdatePostStatus(post *models.Post, status string) error
+	// PublishScheduledPosts publishes every scheduled post whose PublishAt is
+	// not after now, returning how many were published. It is safe to call
+	// concurrently from several replicas.
+	PublishScheduledPosts(now time.Time) (int, error)
 	GetPost(postID uint64) (models.Post, error)
+	// GetPostBySlug returns the post identified by slug, which may be one of
+	// its previous slugs rather than its current one.
+	GetPostBySlug(slug string) (models.Post, error)
 	PostExists(postID uint64) (bool, error)
-	GetPosts(cursor string, userID string, tag string) ([]models.Post, string, error)
+	GetPosts(query PostQuery) ([]models.Post, string, error)
+	// GetPostRevisions returns a page of at most limit revisions of a post,
+	// newest first. A revision is recorded by CreatePost and every
+	// UpdatePost.
+	GetPostRevisions(postID uint64, cursor string, limit int) ([]models.PostRevision, string, error)
+	GetPostRevision(postRevisionID uint64) (models.PostRevision, error)
 	CreatePostComment(postComment *models.PostComment) error
+	// UpdatePostComment saves a comment. Changing its body counts as an edit,
+	// recording a revision and updating EditedAt and EditCount.
 	UpdatePostComment(postComment *models.PostComment) error
 	DeletePostComment(postComment *models.PostComment) error
 	GetPostComment(postCommentID uint64) (models.PostComment, error)
-	GetPostCommentsForPost(postID uint64) ([]models.PostComment, error)
-	GetPostVoteTotalForPost(postID uint64) int64
+	// GetPostCommentRevisions returns a page of at most limit revisions of a
+	// comment, newest first.
+	GetPostCommentRevisions(postCommentID uint64, cursor string, limit int) ([]models.PostCommentRevision, string, error)
+	// GetPostCommentsForPost returns a page of at most limit comments ordered
+	// by mode. When parentID is not nil only direct replies to it (or
+	// top-level comments when it is 0) are returned.
+	GetPostCommentsForPost(postID uint64, parentID *uint64, cursor string, mode string, limit int) ([]models.PostComment, string, error)
+	// GetPostCommentReplies returns the comments nested beneath parentIDs up
+	// to depth+1 levels deep, or at any depth when depth is negative. The
+	// extra level lets BuildPostCommentThreads detect truncated threads.
+	GetPostCommentReplies(postID uint64, parentIDs []uint64, depth int) ([]models.PostComment, error)
+	GetPostVoteTotalForPost(postID uint64) (int64, error)
 	GetPostVote(postID uint64, userID string) (models.PostVote, error)
-	GetPostVoteUsersForPost(postID uint64) []string
-	CreatePostVote(postVote *models.PostVote) error
+	GetPostVoteUsersForPost(postID uint64) ([]string, error)
+	// CreatePostVote records a user's vote on a post or, if they have already
+	// voted on it, changes the value of their vote, returning true if the vote
+	// is new. The post's counters are adjusted from the value replaced, even
+	// when the same user votes concurrently.
+	CreatePostVote(postVote *models.PostVote) (bool, error)
+	DeletePostVote(postVote *models.PostVote) error
+	GetPostCommentVoteTotalForPostComment(postCommentID uint64) (int64, error)
+	GetPostCommentVote(postCommentID uint64, userID string) (models.PostCommentVote, error)
+	GetPostCommentVoteUsersForPostComment(postCommentID uint64) ([]string, error)
+	// CreatePostCommentVote records a user's vote on a comment or changes the
+	// value of their existing vote, in the same way as CreatePostVote.
+	CreatePostCommentVote(postCommentVote *models.PostCommentVote) (bool, error)
+	DeletePostCommentVote(postCommentVote *models.PostCommentVote) error
 	CreatePostSave(postSave *models.PostSave) (models.PostSave, bool, error)
 	GetPostSave(postSaveID uint64) (models.PostSave, error)
 	GetPostSaves(postID uint64, userID string) ([]models.PostSave, error)
 	DeletePostSave(postSave *models.PostSave) error
+	// GetTags returns the tags of every post visible to everyone, so not
+	// drafts or scheduled posts.
 	GetTags() ([]string, error)
+	// GetTrash returns a page of at most limit posts and comments deleted by
+	// a user, most recently deleted first. Comments on deleted posts are
+	// omitted as they are restored along with the post.
+	GetTrash(userID string, cursor string, limit int) ([]models.TrashItem, string, error)
+	// GetDeletedPost and GetDeletedPostComment return a post or comment which
+	// is in the trash, failing with *errors.NotFound otherwise.
+	GetDeletedPost(postID uint64) (models.Post, error)
+	GetDeletedPostComment(postCommentID uint64) (models.PostComment, error)
+	// RestorePost undeletes a post along with the comments and saves which
+	// were deleted with it.
+	RestorePost(postID uint64) error
+	// RestorePostComment undeletes a comment. It fails with
+	// RestoreParentIsDeleted while the comment's post is deleted.
+	RestorePostComment(postCommentID uint64) error
+	// PurgePost permanently deletes a post, whether or not it is in the
+	// trash, along with its comments, votes, saves and revisions.
+	PurgePost(postID uint64) error
+	// PurgePostComment permanently deletes a comment along with its votes and
+	// revisions. Its replies are moved up to its parent.
+	PurgePostComment(postCommentID uint64) error
+	// PurgeDeleted permanently deletes the posts, comments and saves which
+	// were deleted before the given time, along with everything belonging to
+	// them. Rows are deleted in batches of at most batchSize so tables are
+	// never locked for long. It is safe to call concurrently from several
+	// replicas.
+	PurgeDeleted(before time.Time, batchSize int) (PurgeReport, error)
+	// Search returns a page of at most limit posts and comments matching
+	// query, ordered by relevance. kind restricts results to one of the
+	// models.SearchResult types when not empty. Drafts and scheduled posts,
+	// and comments on them, are never returned.
+	Search(query string, kind string, cursor string, limit int) ([]models.SearchResult, string, error)
 }
@@ -0,0 +1,1953 @@
+// Package servicestest provides a conformance suite which every
+// implementation of services.PostService is expected to pass.
+//
+// A backend is tested by calling Run from one of its own tests, passing a
+// function which returns a new, empty service:
+//
+//	func TestPostService(t *testing.T) {
+//		servicestest.Run(t, func(t *testing.T) services.PostService {
+//			return memory.NewPostService()
+//		})
+//	}
+package servicestest
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/willdady/postms/internal/errors"
+	"github.com/willdady/postms/internal/postms/models"
+	"github.com/willdady/postms/internal/postms/services"
+	"github.com/willdady/postms/internal/utils"
+)
+
+// Factory returns a new PostService containing no data. It is called once per
+// subtest.
+type Factory func(t *testing.T) services.PostService
+
+// Run runs the full conformance suite against the services returned by
+// newService.
+func Run(t *testing.T, newService Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, service services.PostService)
+	}{
+		{"CreatePost", testCreatePost},
+		{"UpdatePost", testUpdatePost},
+		{"DeletePost", testDeletePost},
+		{"PostSlugs", testPostSlugs},
+		{"Versions", testVersions},
+		{"GetPostsPagination", testGetPostsPagination},
+		{"GetPostsFilters", testGetPostsFilters},
+		{"GetPostsRanked", testGetPostsRanked},
+		{"PostStatus", testPostStatus},
+		{"ScheduledPosts", testScheduledPosts},
+		{"PostRevisions", testPostRevisions},
+		{"PostCommentRevisions", testPostCommentRevisions},
+		{"Trash", testTrash},
+		{"TrashPages", testTrashPages},
+		{"DeletePostCascade", testDeletePostCascade},
+		{"PurgeDeleted", testPurgeDeleted},
+		{"PostComments", testPostComments},
+		{"PostCommentReplies", testPostCommentReplies},
+		{"PostCommentsPagination", testPostCommentsPagination},
+		{"PostVotes", testPostVotes},
+		{"CreatePostVoteTwice", testCreatePostVoteTwice},
+		{"PostCommentVotes", testPostCommentVotes},
+		{"CreatePostCommentVoteTwice", testCreatePostCommentVoteTwice},
+		{"PostCounters", testPostCounters},
+		{"PostSaves", testPostSaves},
+		{"GetTags", testGetTags},
+		{"Search", testSearch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newService(t))
+		})
+	}
+}
+
+func mustCreatePost(t *testing.T, service services.PostService, userID string, title string, tags ...string) models.Post {
+	t.Helper()
+	post := models.Post{UserID: userID, Title: title, Body: "Body of " + title, Tags: tags}
+	if err := service.CreatePost(&post); err != nil {
+		t.Fatalf("CreatePost() returned error: %v", err)
+	}
+	return post
+}
+
+func mustGetPostVoteTotal(t *testing.T, service services.PostService, postID uint) int64 {
+	t.Helper()
+	total, err := service.GetPostVoteTotalForPost(uint64(postID))
+	if err != nil {
+		t.Fatalf("GetPostVoteTotalForPost() returned error: %v", err)
+	}
+	return total
+}
+
+func mustGetPostVoteUsers(t *testing.T, service services.PostService, postID uint) []string {
+	t.Helper()
+	userIDs, err := service.GetPostVoteUsersForPost(uint64(postID))
+	if err != nil {
+		t.Fatalf("GetPostVoteUsersForPost() returned error: %v", err)
+	}
+	return userIDs
+}
+
+func mustGetPostCommentVoteTotal(t *testing.T, service services.PostService, postCommentID uint) int64 {
+	t.Helper()
+	total, err := service.GetPostCommentVoteTotalForPostComment(uint64(postCommentID))
+	if err != nil {
+		t.Fatalf("GetPostCommentVoteTotalForPostComment() returned error: %v", err)
+	}
+	return total
+}
+
+func mustGetPostCommentVoteUsers(t *testing.T, service services.PostService, postCommentID uint) []string {
+	t.Helper()
+	userIDs, err := service.GetPostCommentVoteUsersForPostComment(uint64(postCommentID))
+	if err != nil {
+		t.Fatalf("GetPostCommentVoteUsersForPostComment() returned error: %v", err)
+	}
+	return userIDs
+}
+
+func mustCreatePostComment(t *testing.T, service services.PostService, postID uint, userID string, body string) models.PostComment {
+	t.Helper()
+	return mustCreatePostReply(t, service, postID, nil, userID, body)
+}
+
+func mustCreatePostReply(t *testing.T, service services.PostService, postID uint, parent *models.PostComment, userID string, body string) models.PostComment {
+	t.Helper()
+	postComment := models.PostComment{PostID: postID, UserID: userID, Body: body}
+	if parent != nil {
+		parentID := parent.ID
+		postComment.ParentID = &parentID
+	}
+	if err := service.CreatePostComment(&postComment); err != nil {
+		t.Fatalf("CreatePostComment() returned error: %v", err)
+	}
+	return postComment
+}
+
+func assertNotFound(t *testing.T, err error) {
+	t.Helper()
+	if _, ok := err.(*errors.NotFound); !ok {
+		t.Fatalf("expected *errors.NotFound, got %#v", err)
+	}
+}
+
+func postIDs(posts []models.Post) []uint {
+	ids := make([]uint, 0, len(posts))
+	for _, p := range posts {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+func testCreatePost(t *testing.T, service services.PostService) {
+	post := mustCreatePost(t, service, "user-1", "Hello World", "Go", "go", "Web Dev")
+	if post.ID == 0 {
+		t.Fatal("expected CreatePost to assign an ID")
+	}
+	if post.CreatedAt.IsZero() || post.UpdatedAt.IsZero() {
+		t.Fatal("expected CreatePost to set CreatedAt and UpdatedAt")
+	}
+	if post.Slug != "hello-world" {
+		t.Errorf("expected slug %q, got %q", "hello-world", post.Slug)
+	}
+	if !reflect.DeepEqual([]string(post.Tags), []string{"go", "web-dev"}) {
+		t.Errorf("expected tags to be slugified and de-duplicated, got %v", post.Tags)
+	}
+	second := mustCreatePost(t, service, "user-1", "Second")
+	if second.ID <= post.ID {
+		t.Errorf("expected IDs to increase, got %d after %d", second.ID, post.ID)
+	}
+
+	got, err := service.GetPost(uint64(post.ID))
+	if err != nil {
+		t.Fatalf("GetPost() returned error: %v", err)
+	}
+	if got.Title != post.Title || got.Body != post.Body || got.UserID != post.UserID || got.Slug != post.Slug {
+		t.Errorf("GetPost() = %+v, want %+v", got, post)
+	}
+	exists, err := service.PostExists(uint64(post.ID))
+	if err != nil || !exists {
+		t.Errorf("PostExists() = %v, %v, want true, nil", exists, err)
+	}
+
+	_, err = service.GetPost(uint64(second.ID + 100))
+	assertNotFound(t, err)
+	exists, err = service.PostExists(uint64(second.ID + 100))
+	if err != nil || exists {
+		t.Errorf("PostExists() = %v, %v, want false, nil", exists, err)
+	}
+}
+
+func testUpdatePost(t *testing.T, service services.PostService) {
+	post := mustCreatePost(t, service, "user-1", "Original", "one")
+	post.Title = "Updated Title"
+	post.Body = "Updated body"
+	post.Tags = []string{"Two"}
+	if err := service.UpdatePost(&post); err != nil {
+		t.Fatalf("UpdatePost() returned error: %v", err)
+	}
+	got, err := service.GetPost(uint64(post.ID))
+	if err != nil {
+		t.Fatalf("GetPost() returned error: %v", err)
+	}
+	if got.Title != "Updated Title" || got.Body != "Updated body" {
+		t.Errorf("expected update to be persisted, got %+v", got)
+	}
+	if got.Slug != "original" {
+		t.Errorf("expected published post to keep slug %q, got %q", "original", got.Slug)
+	}
+	if !reflect.DeepEqual([]string(got.Tags), []string{"two"}) {
+		t.Errorf("expected tags [two], got %v", got.Tags)
+	}
+	if got.UpdatedAt.Before(got.CreatedAt) {
+		t.Errorf("expected UpdatedAt %v to not be before CreatedAt %v", got.UpdatedAt, got.CreatedAt)
+	}
+}
+
+func testDeletePost(t *testing.T, service services.PostService) {
+	if err := service.DeletePost(&models.Post{}); err == nil {
+		t.Fatal("expected DeletePost to fail for a post without an ID")
+	} else if _, ok := err.(*errors.DeleteIsMissingID); !ok {
+		t.Fatalf("expected *errors.DeleteIsMissingID, got %#v", err)
+	}
+	post := mustCreatePost(t, service, "user-1", "Doomed")
+	if err := service.DeletePost(&post); err != nil {
+		t.Fatalf("DeletePost() returned error: %v", err)
+	}
+	_, err := service.GetPost(uint64(post.ID))
+	assertNotFound(t, err)
+	exists, err := service.PostExists(uint64(post.ID))
+	if err != nil || exists {
+		t.Errorf("PostExists() = %v, %v for deleted post, want false, nil", exists, err)
+	}
+	posts, _, err := service.GetPosts(services.PostQuery{})
+	if err != nil {
+		t.Fatalf("GetPosts() returned error: %v", err)
+	}
+	if len(posts) != 0 {
+		t.Errorf("expected deleted post to be excluded from GetPosts, got %v", postIDs(posts))
+	}
+}
+
+func testPostSlugs(t *testing.T, service services.PostService) {
+	first := mustCreatePost(t, service, "user-1", "Hello World")
+	second := models.Post{UserID: "user-1", Title: "Hello, world!", Body: "Body", Status: models.PostStatusDraft}
+	if err := service.CreatePost(&second); err != nil {
+		t.Fatalf("CreatePost() returned error: %v", err)
+	}
+	if first.Slug != "hello-world" || second.Slug != "hello-world-2" {
+		t.Fatalf("expected slugs hello-world and hello-world-2, got %q and %q", first.Slug, second.Slug)
+	}
+	untitled := mustCreatePost(t, service, "user-1", "!!!")
+	if untitled.Slug != "post" {
+		t.Errorf("expected slug %q for a title without letters, got %q", "post", untitled.Slug)
+	}
+
+	got, err := service.GetPostBySlug("hello-world-2")
+	if err != nil {
+		t.Fatalf("GetPostBySlug() returned error: %v", err)
+	}
+	if got.ID != second.ID {
+		t.Errorf("expected post %d, got %d", second.ID, got.ID)
+	}
+	_, err = service.GetPostBySlug("missing")
+	assertNotFound(t, err)
+
+	update := func(post *models.Post, title string, slug string) {
+		t.Helper()
+		post.Title = title
+		post.Slug = slug
+		if err := service.UpdatePost(post); err != nil {
+			t.Fatalf("UpdatePost() returned error: %v", err)
+		}
+	}
+
+	// Without a slug, a draft keeps its slug, suffix included, while it still
+	// matches the title and otherwise generates a new one
+	update(&second, "Hello world", "")
+	if second.Slug != "hello-world-2" {
+		t.Errorf("expected slug to be kept, got %q", second.Slug)
+	}
+	update(&second, "Renamed", "")
+	if second.Slug != "renamed" {
+		t.Errorf("expected slug %q, got %q", "renamed", second.Slug)
+	}
+	for _, slug := range []string{"renamed", "hello-world-2"} {
+		got, err := service.GetPostBySlug(slug)
+		if err != nil {
+			t.Fatalf("GetPostBySlug(%q) returned error: %v", slug, err)
+		}
+		if got.ID != second.ID || got.Slug != "renamed" {
+			t.Errorf("expected GetPostBySlug(%q) to return post %d with slug renamed, got post %d with slug %q", slug, second.ID, got.ID, got.Slug)
+		}
+	}
+
+	// Giving the current slug keeps it
+	update(&second, "Something Else", "renamed")
+	if second.Slug != "renamed" {
+		t.Errorf("expected slug %q to be kept, got %q", "renamed", second.Slug)
+	}
+
+	// Old slugs are never given to other posts, but a post may take back its own
+	third := mustCreatePost(t, service, "user-2", "Hello World")
+	if third.Slug != "hello-world-3" {
+		t.Errorf("expected slug %q, got %q", "hello-world-3", third.Slug)
+	}
+	update(&second, "Hello World", "")
+	if second.Slug != "hello-world-2" {
+		t.Errorf("expected post to take back slug %q, got %q", "hello-world-2", second.Slug)
+	}
+
+	// Published posts keep their slug when renamed unless given a new one
+	update(&first, "A New Title", "")
+	if first.Slug != "hello-world" {
+		t.Errorf("expected published post to keep slug %q, got %q", "hello-world", first.Slug)
+	}
+	update(&first, "A New Title", "a-new-title")
+	if first.Slug != "a-new-title" {
+		t.Errorf("expected slug %q, got %q", "a-new-title", first.Slug)
+	}
+	got, err = service.GetPostBySlug("hello-world")
+	if err != nil {
+		t.Fatalf("GetPostBySlug() returned error: %v", err)
+	}
+	if got.ID != first.ID || got.Slug != "a-new-title" {
+		t.Errorf("expected old slug to find post %d with slug a-new-title, got post %d with slug %q", first.ID, got.ID, got.Slug)
+	}
+
+	// Slugs which another post has, or has had, can not be taken
+	for _, slug := range []string{"renamed", "hello-world-2"} {
+		post := third
+		post.Slug = slug
+		if _, ok := service.UpdatePost(&post).(*errors.SlugTaken); !ok {
+			t.Errorf("expected *errors.SlugTaken when taking slug %q", slug)
+		}
+	}
+	created := models.Post{UserID: "user-1", Title: "Hello World", Body: "Body", Slug: "hello-world"}
+	if _, ok := service.CreatePost(&created).(*errors.SlugTaken); !ok {
+		t.Errorf("expected *errors.SlugTaken when creating a post with a taken slug")
+	}
+	created = models.Post{UserID: "user-1", Title: "Hello World", Body: "Body", Slug: "custom"}
+	if err := service.CreatePost(&created); err != nil {
+		t.Fatalf("CreatePost() returned error: %v", err)
+	}
+	if created.Slug != "custom" {
+		t.Errorf("expected slug %q, got %q", "custom", created.Slug)
+	}
+
+	if err := service.DeletePost(&first); err != nil {
+		t.Fatalf("DeletePost() returned error: %v", err)
+	}
+	_, err = service.GetPostBySlug("a-new-title")
+	assertNotFound(t, err)
+}
+
+func assertVersionMismatch(t *testing.T, err error) {
+	t.Helper()
+	if _, ok := err.(*errors.VersionMismatch); !ok {
+		t.Fatalf("expected *errors.VersionMismatch, got %#v", err)
+	}
+}
+
+func testVersions(t *testing.T, service services.PostService) {
+	post := mustCreatePost(t, service, "user-1", "Post")
+	if post.Version != 1 {
+		t.Fatalf("expected new post to be version 1, got %d", post.Version)
+	}
+	// Saving a post without changing its content is not counted
+	post.Version = 0
+	post.Score = 1000
+	if err := service.UpdatePost(&post); err != nil {
+		t.Fatalf("UpdatePost() returned error: %v", err)
+	}
+	if post.Version != 1 || post.Score != 0 {
+		t.Errorf("expected unchanged post to stay version 1, got %+v", post)
+	}
+	if revisions, _, err := service.GetPostRevisions(uint64(post.ID), "", 10); err != nil || len(revisions) != 1 {
+		t.Errorf("expected no revision for an unchanged post, got %v, %v", revisions, err)
+	}
+	post.Version = 0
+	post.Title = "Edited"
+	if err := service.UpdatePost(&post); err != nil {
+		t.Fatalf("UpdatePost() returned error: %v", err)
+	}
+	if post.Version != 2 {
+		t.Errorf("expected version 2, got %d", post.Version)
+	}
+	stale := post
+	stale.Version = 1
+	assertVersionMismatch(t, service.UpdatePost(&stale))
+	post.Body = "Edited"
+	if err := service.UpdatePost(&post); err != nil {
+		t.Fatalf("UpdatePost() with the current version returned error: %v", err)
+	}
+	if err := service.UpdatePostStatus(&post, models.PostStatusArchived); err != nil {
+		t.Fatalf("UpdatePostStatus() returned error: %v", err)
+	}
+	if post.Version != 4 {
+		t.Errorf("expected version 4 after changing status, got %d", post.Version)
+	}
+
+	// Votes and comments change counters but not the version
+	if _, err := service.CreatePostVote(&models.PostVote{PostID: post.ID, UserID: "user-2", Value: 1}); err != nil {
+		t.Fatalf("CreatePostVote() returned error: %v", err)
+	}
+	postComment := mustCreatePostComment(t, service, post.ID, "user-2", "Comment")
+	got, err := service.GetPost(uint64(post.ID))
+	if err != nil {
+		t.Fatalf("GetPost() returned error: %v", err)
+	}
+	if got.Version != 4 {
+		t.Errorf("expected version 4 after voting and commenting, got %d", got.Version)
+	}
+
+	if postComment.Version != 1 {
+		t.Fatalf("expected new comment to be version 1, got %d", postComment.Version)
+	}
+	// Only changes to the body are counted
+	if err := service.UpdatePostComment(&postComment); err != nil {
+		t.Fatalf("UpdatePostComment() returned error: %v", err)
+	}
+	if postComment.Version != 1 {
+		t.Errorf("expected unchanged comment to stay version 1, got %d", postComment.Version)
+	}
+	postComment.Body = "Edited"
+	if err := service.UpdatePostComment(&postComment); err != nil {
+		t.Fatalf("UpdatePostComment() returned error: %v", err)
+	}
+	if postComment.Version != 2 {
+		t.Errorf("expected version 2, got %d", postComment.Version)
+	}
+	staleComment := postComment
+	staleComment.Version = 1
+	staleComment.Body = "Clobbered"
+	assertVersionMismatch(t, service.UpdatePostComment(&staleComment))
+	assertVersionMismatch(t, service.DeletePostComment(&staleComment))
+	if err := service.DeletePostComment(&postComment); err != nil {
+		t.Fatalf("DeletePostComment() returned error: %v", err)
+	}
+
+	stale.Version = 3
+	assertVersionMismatch(t, service.DeletePost(&stale))
+	if _, err := service.GetPost(uint64(post.ID)); err != nil {
+		t.Fatalf("expected post to survive a delete with a stale version, got %v", err)
+	}
+	if err := service.DeletePost(&post); err != nil {
+		t.Fatalf("DeletePost() returned error: %v", err)
+	}
+}
+
+func testGetPostsPagination(t *testing.T, service services.PostService) {
+	posts, nextCursor, err := service.GetPosts(services.PostQuery{})
+	if err != nil {
+		t.Fatalf("GetPosts() returned error: %v", err)
+	}
+	if len(posts) != 0 || nextCursor != "" {
+		t.Fatalf("expected no posts and no cursor, got %d posts and cursor %q", len(posts), nextCursor)
+	}
+
+	// Exactly one page of posts must not produce a cursor.
+	created := make([]models.Post, 0, 205)
+	for i := 0; i < 100; i++ {
+		created = append(created, mustCreatePost(t, service, "user-1", fmt.Sprintf("Post %d", i)))
+	}
+	posts, nextCursor, err = service.GetPosts(services.PostQuery{})
+	if err != nil {
+		t.Fatalf("GetPosts() returned error: %v", err)
+	}
+	if len(posts) != 100 || nextCursor != "" {
+		t.Fatalf("expected 100 posts and no cursor, got %d posts and cursor %q", len(posts), nextCursor)
+	}
+
+	for i := 100; i < 205; i++ {
+		created = append(created, mustCreatePost(t, service, "user-1", fmt.Sprintf("Post %d", i)))
+	}
+	var pages [][]models.Post
+	cursor := ""
+	for {
+		posts, nextCursor, err = service.GetPosts(services.PostQuery{Cursor: cursor})
+		if err != nil {
+			t.Fatalf("GetPosts(%q) returned error: %v", cursor, err)
+		}
+		pages = append(pages, posts)
+		if nextCursor == "" {
+			break
+		}
+		if len(pages) > 3 {
+			t.Fatal("expected pagination to terminate after 3 pages")
+		}
+		cursor = nextCursor
+	}
+	if len(pages) != 3 || len(pages[0]) != 100 || len(pages[1]) != 100 || len(pages[2]) != 5 {
+		sizes := make([]int, 0, len(pages))
+		for _, page := range pages {
+			sizes = append(sizes, len(page))
+		}
+		t.Fatalf("expected pages of sizes [100 100 5], got %v", sizes)
+	}
+	var all []uint
+	for _, page := range pages {
+		all = append(all, postIDs(page)...)
+	}
+	want := make([]uint, 0, len(created))
+	for i := len(created) - 1; i >= 0; i-- {
+		want = append(want, created[i].ID)
+	}
+	if !reflect.DeepEqual(all, want) {
+		t.Errorf("expected every post exactly once in descending ID order")
+	}
+
+	if _, _, err := service.GetPosts(services.PostQuery{Cursor: "not base64!"}); err == nil {
+		t.Error("expected an invalid cursor to return an error")
+	} else if _, ok := err.(*errors.CursorDecodingError); !ok {
+		t.Errorf("expected *errors.CursorDecodingError, got %#v", err)
+	}
+}
+
+func testGetPostsFilters(t *testing.T, service services.PostService) {
+	a := mustCreatePost(t, service, "user-a", "A", "news", "go")
+	b := mustCreatePost(t, service, "user-b", "B", "go")
+	c := mustCreatePost(t, service, "user-a", "C", "sport")
+
+	tests := []struct {
+		userID string
+		tag    string
+		want   []uint
+	}{
+		{"", "", []uint{c.ID, b.ID, a.ID}},
+		{"user-a", "", []uint{c.ID, a.ID}},
+		{"", "go", []uint{b.ID, a.ID}},
+		{"user-a", "go", []uint{a.ID}},
+		{"user-c", "", []uint{}},
+		{"", "missing", []uint{}},
+	}
+	for _, tt := range tests {
+		posts, nextCursor, err := service.GetPosts(services.PostQuery{UserID: tt.userID, Tag: tt.tag})
+		if err != nil {
+			t.Fatalf("GetPosts(%q, %q) returned error: %v", tt.userID, tt.tag, err)
+		}
+		if got := postIDs(posts); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("GetPosts(%q, %q) = %v, want %v", tt.userID, tt.tag, got, tt.want)
+		}
+		if nextCursor != "" {
+			t.Errorf("GetPosts(%q, %q) returned unexpected cursor %q", tt.userID, tt.tag, nextCursor)
+		}
+	}
+}
+
+func testGetPostsRanked(t *testing.T, service services.PostService) {
+	// Give each post a different mix of upvotes and downvotes, with enough
+	// posts to span two pages.
+	created := make(map[uint]bool)
+	for i := 0; i < 120; i++ {
+		post := mustCreatePost(t, service, "user-1", fmt.Sprintf("Post %d", i))
+		created[post.ID] = true
+		for j := 0; j < i%4+i%3; j++ {
+			value := 1
+			if j >= i%4 {
+				value = -1
+			}
+			vote := models.PostVote{PostID: post.ID, UserID: fmt.Sprintf("user-%d", j), Value: value}
+			if _, err := service.CreatePostVote(&vote); err != nil {
+				t.Fatalf("CreatePostVote() returned error: %v", err)
+			}
+		}
+	}
+
+	for _, mode := range []string{services.SortNewest, services.SortHot, services.SortTop, services.SortControversial} {
+		var all []models.Post
+		cursor := ""
+		for pages := 1; ; pages++ {
+			posts, nextCursor, err := service.GetPosts(services.PostQuery{Cursor: cursor, Sort: mode, Window: services.WindowDay})
+			if err != nil {
+				t.Fatalf("GetPosts(%q) returned error: %v", mode, err)
+			}
+			all = append(all, posts...)
+			if nextCursor == "" {
+				if pages != 2 {
+					t.Errorf("sort %q: expected 2 pages, got %d", mode, pages)
+				}
+				break
+			}
+			if pages > 2 {
+				t.Fatalf("sort %q: expected pagination to terminate", mode)
+			}
+			cursor = nextCursor
+		}
+		if len(all) != len(created) {
+			t.Fatalf("sort %q: expected %d posts, got %d", mode, len(created), len(all))
+		}
+		seen := make(map[uint]bool)
+		for i, post := range all {
+			if seen[post.ID] || !created[post.ID] {
+				t.Fatalf("sort %q: unexpected or duplicate post %d", mode, post.ID)
+			}
+			seen[post.ID] = true
+			if i == 0 {
+				continue
+			}
+			prev := all[i-1]
+			a, b := services.PostSortKey(prev, mode), services.PostSortKey(post, mode)
+			if a < b || (a == b && prev.ID < post.ID) {
+				t.Errorf("sort %q: post %d ranked above post %d out of order", mode, prev.ID, post.ID)
+			}
+		}
+	}
+
+	// Ranks are derived from votes.
+	posts, _, err := service.GetPosts(services.PostQuery{Sort: services.SortTop})
+	if err != nil {
+		t.Fatalf("GetPosts() returned error: %v", err)
+	}
+	if posts[0].Score != 3 {
+		t.Errorf("expected the top post to have a score of 3, got %d", posts[0].Score)
+	}
+	posts, _, err = service.GetPosts(services.PostQuery{Sort: services.SortControversial})
+	if err != nil {
+		t.Fatalf("GetPosts() returned error: %v", err)
+	}
+	if posts[0].Upvotes != posts[0].Downvotes || posts[0].Upvotes != 2 {
+		t.Errorf("expected the most controversial post to have 2 upvotes and 2 downvotes, got %d and %d", posts[0].Upvotes, posts[0].Downvotes)
+	}
+	if _, _, err := service.GetPosts(services.PostQuery{Cursor: utils.UintToBase64(1), Sort: services.SortHot}); err == nil {
+		t.Error("expected a cursor for a different sort to return an error")
+	}
+}
+
+func testPostStatus(t *testing.T, service services.PostService) {
+	published := mustCreatePost(t, service, "user-1", "Published")
+	if published.Status != models.PostStatusPublished || published.PublishedAt == nil {
+		t.Errorf("expected posts to be published by default, got status %q published at %v", published.Status, published.PublishedAt)
+	}
+	draft := models.Post{UserID: "user-1", Title: "Draft", Body: "Unfinished", Status: models.PostStatusDraft}
+	if err := service.CreatePost(&draft); err != nil {
+		t.Fatalf("CreatePost() returned error: %v", err)
+	}
+	if draft.PublishedAt != nil {
+		t.Errorf("expected a draft to have no publish time, got %v", draft.PublishedAt)
+	}
+
+	list := func(query services.PostQuery) []uint {
+		t.Helper()
+		posts, _, err := service.GetPosts(query)
+		if err != nil {
+			t.Fatalf("GetPosts(%+v) returned error: %v", query, err)
+		}
+		return postIDs(posts)
+	}
+	tests := []struct {
+		query services.PostQuery
+		want  []uint
+	}{
+		{services.PostQuery{}, []uint{published.ID}},
+		{services.PostQuery{ViewerID: "user-1"}, []uint{published.ID}},
+		{services.PostQuery{Status: models.PostStatusDraft}, []uint{}},
+		{services.PostQuery{Status: models.PostStatusDraft, ViewerID: "user-2"}, []uint{}},
+		{services.PostQuery{Status: models.PostStatusDraft, ViewerID: "user-1"}, []uint{draft.ID}},
+		{services.PostQuery{Status: models.PostStatusArchived}, []uint{}},
+	}
+	for _, tt := range tests {
+		if got := list(tt.query); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("GetPosts(%+v) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+	if results, _, err := service.Search("unfinished", "", "", 100); err != nil || len(results) != 0 {
+		t.Errorf("expected drafts to be excluded from search, got %+v, %v", results, err)
+	}
+	mustCreatePostComment(t, service, draft.ID, "user-1", "An unpolished comment")
+	if results, _, err := service.Search("unpolished", "", "", 100); err != nil || len(results) != 0 {
+		t.Errorf("expected comments on drafts to be excluded from search, got %+v, %v", results, err)
+	}
+	secret := models.Post{UserID: "user-1", Title: "Tagged draft", Body: "Body", Tags: []string{"secret"}, Status: models.PostStatusDraft}
+	if err := service.CreatePost(&secret); err != nil {
+		t.Fatalf("CreatePost() returned error: %v", err)
+	}
+	if tags, err := service.GetTags(); err != nil || len(tags) != 0 {
+		t.Errorf("expected the tags of drafts to be excluded, got %v, %v", tags, err)
+	}
+	if err := service.DeletePost(&secret); err != nil {
+		t.Fatalf("DeletePost() returned error: %v", err)
+	}
+
+	// Updating a post does not change its status.
+	draft.Title = "Draft (edited)"
+	draft.Status = models.PostStatusPublished
+	if err := service.UpdatePost(&draft); err != nil {
+		t.Fatalf("UpdatePost() returned error: %v", err)
+	}
+	got, err := service.GetPost(uint64(draft.ID))
+	if err != nil {
+		t.Fatalf("GetPost() returned error: %v", err)
+	}
+	if got.Status != models.PostStatusDraft {
+		t.Errorf("expected UpdatePost to leave the status as draft, got %q", got.Status)
+	}
+
+	if err := service.UpdatePostStatus(&got, models.PostStatusPublished); err != nil {
+		t.Fatalf("UpdatePostStatus() returned error: %v", err)
+	}
+	got, err = service.GetPost(uint64(draft.ID))
+	if err != nil {
+		t.Fatalf("GetPost() returned error: %v", err)
+	}
+	if got.Status != models.PostStatusPublished || got.PublishedAt == nil {
+		t.Errorf("expected post to be published, got status %q published at %v", got.Status, got.PublishedAt)
+	}
+	if want := models.HotRank(got.Score, *got.PublishedAt); got.Hot != want {
+		t.Errorf("expected hot rank %v as of publishing, got %v", want, got.Hot)
+	}
+	if ids := list(services.PostQuery{}); !reflect.DeepEqual(ids, []uint{draft.ID, published.ID}) {
+		t.Errorf("expected published posts [%d %d], got %v", draft.ID, published.ID, ids)
+	}
+
+	if err := service.UpdatePostStatus(&got, models.PostStatusArchived); err != nil {
+		t.Fatalf("UpdatePostStatus() returned error: %v", err)
+	}
+	if ids := list(services.PostQuery{Status: models.PostStatusArchived}); !reflect.DeepEqual(ids, []uint{draft.ID}) {
+		t.Errorf("expected archived posts [%d], got %v", draft.ID, ids)
+	}
+	got, err = service.GetPost(uint64(draft.ID))
+	if err != nil {
+		t.Fatalf("GetPost() returned error: %v", err)
+	}
+	if got.PublishedAt == nil {
+		t.Error("expected archiving to keep the publish time")
+	}
+
+	if err := service.UpdatePostStatus(&got, models.PostStatusDraft); err != nil {
+		t.Fatalf("UpdatePostStatus() returned error: %v", err)
+	}
+	got, err = service.GetPost(uint64(draft.ID))
+	if err != nil {
+		t.Fatalf("GetPost() returned error: %v", err)
+	}
+	if got.Status != models.PostStatusDraft || got.PublishedAt != nil {
+		t.Errorf("expected post to be unpublished, got status %q published at %v", got.Status, got.PublishedAt)
+	}
+}
+
+func testScheduledPosts(t *testing.T, service services.PostService) {
+	now := time.Now().Truncate(time.Second)
+	publishAt := now.Add(time.Hour)
+	post := models.Post{UserID: "user-1", Title: "Scheduled", Body: "Coming soon", Status: models.PostStatusScheduled, PublishAt: &publishAt}
+	if err := service.CreatePost(&post); err != nil {
+		t.Fatalf("CreatePost() returned error: %v", err)
+	}
+	if post.PublishedAt != nil {
+		t.Errorf("expected a scheduled post to have no publish time, got %v", post.PublishedAt)
+	}
+
+	posts, _, err := service.GetPosts(services.PostQuery{})
+	if err != nil {
+		t.Fatalf("GetPosts() returned error: %v", err)
+	}
+	if len(posts) != 0 {
+		t.Errorf("expected scheduled posts to be hidden, got %v", postIDs(posts))
+	}
+	posts, _, err = service.GetPosts(services.PostQuery{Status: models.PostStatusScheduled, ViewerID: "user-1"})
+	if err != nil {
+		t.Fatalf("GetPosts() returned error: %v", err)
+	}
+	if ids := postIDs(posts); !reflect.DeepEqual(ids, []uint{post.ID}) {
+		t.Errorf("expected author to see scheduled posts [%d], got %v", post.ID, ids)
+	}
+
+	if count, err := service.PublishScheduledPosts(now); err != nil || count != 0 {
+		t.Errorf("PublishScheduledPosts() before publishAt = %d, %v, want 0", count, err)
+	}
+	got, err := service.GetPost(uint64(post.ID))
+	if err != nil {
+		t.Fatalf("GetPost() returned error: %v", err)
+	}
+	if got.Status != models.PostStatusScheduled {
+		t.Errorf("expected post to still be scheduled, got %q", got.Status)
+	}
+
+	if count, err := service.PublishScheduledPosts(publishAt.Add(time.Minute)); err != nil || count != 1 {
+		t.Errorf("PublishScheduledPosts() after publishAt = %d, %v, want 1", count, err)
+	}
+	got, err = service.GetPost(uint64(post.ID))
+	if err != nil {
+		t.Fatalf("GetPost() returned error: %v", err)
+	}
+	if got.Status != models.PostStatusPublished {
+		t.Errorf("expected post to be published, got %q", got.Status)
+	}
+	if got.PublishedAt == nil || !got.PublishedAt.Equal(publishAt) {
+		t.Errorf("expected post to be published at %v, got %v", publishAt, got.PublishedAt)
+	}
+	if got.PublishAt != nil {
+		t.Errorf("expected publishAt to be cleared, got %v", got.PublishAt)
+	}
+	// Posts are aged from when they were published rather than created
+	if want := models.HotRank(got.Score, publishAt); got.Hot != want {
+		t.Errorf("expected hot rank %v as of publishAt, got %v", want, got.Hot)
+	}
+	if count, err := service.PublishScheduledPosts(publishAt.Add(time.Minute)); err != nil || count != 0 {
+		t.Errorf("PublishScheduledPosts() when nothing is due = %d, %v, want 0", count, err)
+	}
+
+	// The publish time is only set by publishing
+	future := now.Add(24 * time.Hour)
+	post = models.Post{UserID: "user-1", Title: "Published", Body: "Now", PublishedAt: &future}
+	if err := service.CreatePost(&post); err != nil {
+		t.Fatalf("CreatePost() returned error: %v", err)
+	}
+	got, err = service.GetPost(uint64(post.ID))
+	if err != nil {
+		t.Fatalf("GetPost() returned error: %v", err)
+	}
+	if got.PublishedAt == nil || got.PublishedAt.After(time.Now()) {
+		t.Errorf("expected post to be published now, got %v", got.PublishedAt)
+	}
+	if want := models.HotRank(got.Score, *got.PublishedAt); got.Hot != want {
+		t.Errorf("expected hot rank %v as of publishing, got %v", want, got.Hot)
+	}
+}
+
+func testPostRevisions(t *testing.T, service services.PostService) {
+	post := mustCreatePost(t, service, "user-1", "First")
+	other := mustCreatePost(t, service, "user-1", "Other")
+	for _, title := range []string{"Second", "Third"} {
+		post.Title = title
+		post.Tags = []string{title}
+		if err := service.UpdatePost(&post); err != nil {
+			t.Fatalf("UpdatePost() returned error: %v", err)
+		}
+	}
+
+	revisions, cursor, err := service.GetPostRevisions(uint64(post.ID), "", 2)
+	if err != nil {
+		t.Fatalf("GetPostRevisions() returned error: %v", err)
+	}
+	if cursor == "" {
+		t.Error("expected a next cursor")
+	}
+	more, next, err := service.GetPostRevisions(uint64(post.ID), cursor, 2)
+	if err != nil {
+		t.Fatalf("GetPostRevisions() returned error: %v", err)
+	}
+	if next != "" {
+		t.Errorf("expected no next cursor, got %q", next)
+	}
+	revisions = append(revisions, more...)
+	var got []string
+	for _, r := range revisions {
+		if r.PostID != post.ID {
+			t.Errorf("expected revision %d to belong to post %d, got %d", r.ID, post.ID, r.PostID)
+		}
+		got = append(got, fmt.Sprintf("%d:%s:%v", r.Number, r.Title, []string(r.Tags)))
+	}
+	want := []string{"3:Third:[third]", "2:Second:[second]", "1:First:[]"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected revisions %v, got %v", want, got)
+	}
+
+	revision, err := service.GetPostRevision(uint64(revisions[1].ID))
+	if err != nil {
+		t.Fatalf("GetPostRevision() returned error: %v", err)
+	}
+	if revision.Title != "Second" || revision.Number != 2 {
+		t.Errorf("expected revision 2 titled Second, got %+v", revision)
+	}
+	_, err = service.GetPostRevision(uint64(revisions[0].ID) + 1000)
+	assertNotFound(t, err)
+
+	otherRevisions, _, err := service.GetPostRevisions(uint64(other.ID), "", 100)
+	if err != nil {
+		t.Fatalf("GetPostRevisions() returned error: %v", err)
+	}
+	if len(otherRevisions) != 1 || otherRevisions[0].Number != 1 {
+		t.Errorf("expected other post to have a single revision, got %+v", otherRevisions)
+	}
+}
+
+func testPostCommentRevisions(t *testing.T, service services.PostService) {
+	post := mustCreatePost(t, service, "user-1", "Post")
+	postComment := mustCreatePostComment(t, service, post.ID, "user-2", "First")
+	if postComment.EditCount != 0 || postComment.EditedAt != nil {
+		t.Errorf("expected a new comment to be unedited, got edit count %d edited at %v", postComment.EditCount, postComment.EditedAt)
+	}
+
+	// Saving without changing the body is not an edit.
+	if err := service.UpdatePostComment(&postComment); err != nil {
+		t.Fatalf("UpdatePostComment() returned error: %v", err)
+	}
+	for _, body := range []string{"Second", "Third"} {
+		postComment.Body = body
+		if err := service.UpdatePostComment(&postComment); err != nil {
+			t.Fatalf("UpdatePostComment() returned error: %v", err)
+		}
+	}
+	got, err := service.GetPostComment(uint64(postComment.ID))
+	if err != nil {
+		t.Fatalf("GetPostComment() returned error: %v", err)
+	}
+	if got.EditCount != 2 || got.EditedAt == nil {
+		t.Errorf("expected comment to have been edited twice, got edit count %d edited at %v", got.EditCount, got.EditedAt)
+	}
+
+	revisions, cursor, err := service.GetPostCommentRevisions(uint64(postComment.ID), "", 2)
+	if err != nil {
+		t.Fatalf("GetPostCommentRevisions() returned error: %v", err)
+	}
+	more, next, err := service.GetPostCommentRevisions(uint64(postComment.ID), cursor, 2)
+	if err != nil {
+		t.Fatalf("GetPostCommentRevisions() returned error: %v", err)
+	}
+	if cursor == "" || next != "" {
+		t.Errorf("expected revisions to span two pages, got cursors %q and %q", cursor, next)
+	}
+	var bodies []string
+	for _, r := range append(revisions, more...) {
+		bodies = append(bodies, fmt.Sprintf("%d:%s", r.Number, r.Body))
+	}
+	if want := []string{"3:Third", "2:Second", "1:First"}; !reflect.DeepEqual(bodies, want) {
+		t.Errorf("expected revisions %v, got %v", want, bodies)
+	}
+}
+
+func testTrash(t *testing.T, service services.PostService) {
+	post := mustCreatePost(t, service, "user-1", "Post")
+	theirs := mustCreatePostComment(t, service, post.ID, "user-2", "Theirs")
+	mine := mustCreatePostComment(t, service, post.ID, "user-1", "Mine")
+	reply := mustCreatePostReply(t, service, post.ID, &mine, "user-2", "Reply")
+
+	trash := func(userID string) []string {
+		t.Helper()
+		items, _, err := service.GetTrash(userID, "", 100)
+		if err != nil {
+			t.Fatalf("GetTrash() returned error: %v", err)
+		}
+		got := []string{}
+		for _, item := range items {
+			got = append(got, fmt.Sprintf("%s:%d", item.Type, item.ID))
+		}
+		return got
+	}
+	commentCount := func() int {
+		t.Helper()
+		got, err := service.GetPost(uint64(post.ID))
+		if err != nil {
+			t.Fatalf("GetPost() returned error: %v", err)
+		}
+		return got.CommentCount
+	}
+
+	if err := service.DeletePostComment(&theirs); err != nil {
+		t.Fatalf("DeletePostComment() returned error: %v", err)
+	}
+	if got, want := trash("user-2"), []string{fmt.Sprintf("comment:%d", theirs.ID)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected trash %v, got %v", want, got)
+	}
+	if got, err := service.GetDeletedPostComment(uint64(theirs.ID)); err != nil || got.UserID != "user-2" {
+		t.Errorf("expected GetDeletedPostComment() to return the deleted comment, got %+v, %v", got, err)
+	}
+	_, err := service.GetDeletedPostComment(uint64(mine.ID))
+	assertNotFound(t, err)
+	_, err = service.GetDeletedPost(uint64(post.ID))
+	assertNotFound(t, err)
+	if err := service.RestorePostComment(uint64(theirs.ID)); err != nil {
+		t.Fatalf("RestorePostComment() returned error: %v", err)
+	}
+	if got := trash("user-2"); len(got) != 0 {
+		t.Errorf("expected empty trash after restoring, got %v", got)
+	}
+	if got := commentCount(); got != 3 {
+		t.Errorf("expected 3 comments after restoring, got %d", got)
+	}
+	if err := service.RestorePostComment(uint64(theirs.ID)); err == nil {
+		t.Error("expected an error restoring a comment which is not in the trash")
+	}
+
+	// Comments deleted before their post are not restored with it and can
+	// not be restored while it is in the trash.
+	if err := service.DeletePostComment(&theirs); err != nil {
+		t.Fatalf("DeletePostComment() returned error: %v", err)
+	}
+	if err := service.DeletePost(&post); err != nil {
+		t.Fatalf("DeletePost() returned error: %v", err)
+	}
+	if got, want := trash("user-1"), []string{fmt.Sprintf("post:%d", post.ID)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected trash %v, got %v", want, got)
+	}
+	if got, err := service.GetDeletedPost(uint64(post.ID)); err != nil || got.UserID != "user-1" {
+		t.Errorf("expected GetDeletedPost() to return the deleted post, got %+v, %v", got, err)
+	}
+	if got := trash("user-2"); len(got) != 0 {
+		t.Errorf("expected comments on a deleted post to be omitted from the trash, got %v", got)
+	}
+	if _, ok := service.RestorePostComment(uint64(theirs.ID)).(*errors.RestoreParentIsDeleted); !ok {
+		t.Error("expected RestoreParentIsDeleted restoring a comment on a deleted post")
+	}
+	if err := service.RestorePost(uint64(post.ID)); err != nil {
+		t.Fatalf("RestorePost() returned error: %v", err)
+	}
+	if got := commentCount(); got != 2 {
+		t.Errorf("expected 2 comments after restoring the post, got %d", got)
+	}
+	_, err = service.GetPostComment(uint64(theirs.ID))
+	assertNotFound(t, err)
+	_, err = service.GetDeletedPost(uint64(post.ID))
+	assertNotFound(t, err)
+
+	// Purging a comment moves its replies up to its parent.
+	if err := service.PurgePostComment(uint64(mine.ID)); err != nil {
+		t.Fatalf("PurgePostComment() returned error: %v", err)
+	}
+	got, err := service.GetPostComment(uint64(reply.ID))
+	if err != nil {
+		t.Fatalf("GetPostComment() returned error: %v", err)
+	}
+	if got.ParentID != nil {
+		t.Errorf("expected reply to become a top-level comment, got parent %d", *got.ParentID)
+	}
+	if got := commentCount(); got != 1 {
+		t.Errorf("expected 1 comment after purging, got %d", got)
+	}
+	if err := service.PurgePostComment(uint64(theirs.ID)); err != nil {
+		t.Fatalf("PurgePostComment() returned error: %v", err)
+	}
+	if got := trash("user-2"); len(got) != 0 {
+		t.Errorf("expected purged comments to leave the trash, got %v", got)
+	}
+
+	if err := service.PurgePost(uint64(post.ID)); err != nil {
+		t.Fatalf("PurgePost() returned error: %v", err)
+	}
+	_, err = service.GetPost(uint64(post.ID))
+	assertNotFound(t, err)
+	_, err = service.GetPostComment(uint64(reply.ID))
+	assertNotFound(t, err)
+	if revisions, _, err := service.GetPostRevisions(uint64(post.ID), "", 100); err != nil || len(revisions) != 0 {
+		t.Errorf("expected revisions to be purged, got %v, %v", revisions, err)
+	}
+	assertNotFound(t, service.PurgePost(uint64(post.ID)))
+	assertNotFound(t, service.RestorePost(uint64(post.ID)))
+}
+
+func testTrashPages(t *testing.T, service services.PostService) {
+	post := mustCreatePost(t, service, "user-1", "Post")
+	want := []string{}
+	for i := 0; i < 3; i++ {
+		postComment := mustCreatePostComment(t, service, post.ID, "user-1", "Comment")
+		if err := service.DeletePostComment(&postComment); err != nil {
+			t.Fatalf("DeletePostComment() returned error: %v", err)
+		}
+		want = append([]string{fmt.Sprintf("comment:%d", postComment.ID)}, want...)
+	}
+	other := mustCreatePost(t, service, "user-1", "Other")
+	if err := service.DeletePost(&other); err != nil {
+		t.Fatalf("DeletePost() returned error: %v", err)
+	}
+	want = append([]string{fmt.Sprintf("post:%d", other.ID)}, want...)
+
+	got := []string{}
+	cursor := ""
+	for page := 0; page < len(want); page++ {
+		items, nextCursor, err := service.GetTrash("user-1", cursor, 1)
+		if err != nil {
+			t.Fatalf("GetTrash() returned error: %v", err)
+		}
+		for _, item := range items {
+			got = append(got, fmt.Sprintf("%s:%d", item.Type, item.ID))
+		}
+		// Items leaving the first page do not shift the next one
+		if page == 0 {
+			if err := service.RestorePost(uint64(other.ID)); err != nil {
+				t.Fatalf("RestorePost() returned error: %v", err)
+			}
+		}
+		if cursor = nextCursor; cursor == "" {
+			break
+		}
+	}
+	if !reflect.DeepEqual(got, want) || cursor != "" {
+		t.Errorf("expected pages of trash %v, got %v with cursor %q", want, got, cursor)
+	}
+	if _, _, err := service.GetTrash("user-1", "bm90IGEgY3Vyc29y", 1); err == nil {
+		t.Error("expected an error listing the trash with an invalid cursor")
+	}
+}
+
+func testDeletePostCascade(t *testing.T, service services.PostService) {
+	post := mustCreatePost(t, service, "user-1", "Post")
+	postComment := mustCreatePostComment(t, service, post.ID, "user-2", "Comment")
+	if _, err := service.CreatePostVote(&models.PostVote{PostID: post.ID, UserID: "user-2", Value: 1}); err != nil {
+		t.Fatalf("CreatePostVote() returned error: %v", err)
+	}
+	if _, err := service.CreatePostCommentVote(&models.PostCommentVote{PostCommentID: postComment.ID, UserID: "user-1", Value: 1}); err != nil {
+		t.Fatalf("CreatePostCommentVote() returned error: %v", err)
+	}
+	if _, _, err := service.CreatePostSave(&models.PostSave{PostID: post.ID, UserID: "user-2"}); err != nil {
+		t.Fatalf("CreatePostSave() returned error: %v", err)
+	}
+
+	check := func(visible bool) {
+		t.Helper()
+		want := 0
+		if visible {
+			want = 1
+		}
+		postComments, _, err := service.GetPostCommentsForPost(uint64(post.ID), nil, "", services.SortNewest, 100)
+		if err != nil {
+			t.Fatalf("GetPostCommentsForPost() returned error: %v", err)
+		}
+		if len(postComments) != want {
+			t.Errorf("expected %d comments, got %d", want, len(postComments))
+		}
+		postSaves, err := service.GetPostSaves(uint64(post.ID), "")
+		if err != nil {
+			t.Fatalf("GetPostSaves() returned error: %v", err)
+		}
+		if len(postSaves) != want {
+			t.Errorf("expected %d saves, got %d", want, len(postSaves))
+		}
+		if got := mustGetPostVoteTotal(t, service, post.ID); got != int64(want) {
+			t.Errorf("expected post vote total %d, got %d", want, got)
+		}
+		if got := mustGetPostVoteUsers(t, service, post.ID); len(got) != want {
+			t.Errorf("expected %d post voters, got %v", want, got)
+		}
+		if _, err := service.GetPostVote(uint64(post.ID), "user-2"); (err == nil) != visible {
+			t.Errorf("expected post vote visible %v, got error %v", visible, err)
+		}
+		if got := mustGetPostCommentVoteTotal(t, service, postComment.ID); got != int64(want) {
+			t.Errorf("expected comment vote total %d, got %d", want, got)
+		}
+		if got := mustGetPostCommentVoteUsers(t, service, postComment.ID); len(got) != want {
+			t.Errorf("expected %d comment voters, got %v", want, got)
+		}
+		if _, err := service.GetPostCommentVote(uint64(postComment.ID), "user-1"); (err == nil) != visible {
+			t.Errorf("expected comment vote visible %v, got error %v", visible, err)
+		}
+	}
+
+	check(true)
+	if err := service.DeletePost(&post); err != nil {
+		t.Fatalf("DeletePost() returned error: %v", err)
+	}
+	check(false)
+	if err := service.RestorePost(uint64(post.ID)); err != nil {
+		t.Fatalf("RestorePost() returned error: %v", err)
+	}
+	check(true)
+}
+
+func testPurgeDeleted(t *testing.T, service services.PostService) {
+	deleted := mustCreatePost(t, service, "user-1", "Deleted")
+	mustCreatePostComment(t, service, deleted.ID, "user-2", "On a deleted post")
+	kept := mustCreatePost(t, service, "user-1", "Kept")
+	postComment := mustCreatePostComment(t, service, kept.ID, "user-2", "Deleted comment")
+	reply := mustCreatePostReply(t, service, kept.ID, &postComment, "user-3", "Reply")
+	if _, err := service.CreatePostVote(&models.PostVote{PostID: deleted.ID, UserID: "user-2", Value: 1}); err != nil {
+		t.Fatalf("CreatePostVote() returned error: %v", err)
+	}
+	postSave, _, err := service.CreatePostSave(&models.PostSave{PostID: kept.ID, UserID: "user-2"})
+	if err != nil {
+		t.Fatalf("CreatePostSave() returned error: %v", err)
+	}
+	if err := service.DeletePost(&deleted); err != nil {
+		t.Fatalf("DeletePost() returned error: %v", err)
+	}
+	if err := service.DeletePostComment(&postComment); err != nil {
+		t.Fatalf("DeletePostComment() returned error: %v", err)
+	}
+	if err := service.DeletePostSave(&postSave); err != nil {
+		t.Fatalf("DeletePostSave() returned error: %v", err)
+	}
+
+	report, err := service.PurgeDeleted(time.Now().Add(-time.Hour), 1)
+	if err != nil {
+		t.Fatalf("PurgeDeleted() returned error: %v", err)
+	}
+	if report != (services.PurgeReport{}) {
+		t.Errorf("expected nothing to be purged before the retention period, got %v", report)
+	}
+	assertNotFound(t, service.RestorePost(uint64(kept.ID)))
+
+	report, err = service.PurgeDeleted(time.Now().Add(time.Second), 1)
+	if err != nil {
+		t.Fatalf("PurgeDeleted() returned error: %v", err)
+	}
+	want := services.PurgeReport{
+		Posts:                1,
+		PostComments:         2,
+		PostSaves:            1,
+		PostVotes:            1,
+		PostRevisions:        1,
+		PostCommentRevisions: 2,
+	}
+	if report != want {
+		t.Errorf("PurgeDeleted() = %v, want %v", report, want)
+	}
+	assertNotFound(t, service.RestorePost(uint64(deleted.ID)))
+	assertNotFound(t, service.RestorePostComment(uint64(postComment.ID)))
+	got, err := service.GetPostComment(uint64(reply.ID))
+	if err != nil {
+		t.Fatalf("GetPostComment() returned error: %v", err)
+	}
+	if got.ParentID != nil {
+		t.Errorf("expected reply to become a top-level comment, got parent %d", *got.ParentID)
+	}
+	if _, err := service.GetPost(uint64(kept.ID)); err != nil {
+		t.Errorf("expected kept post to remain, got %v", err)
+	}
+}
+
+func testPostComments(t *testing.T, service services.PostService) {
+	post := mustCreatePost(t, service, "user-1", "Commented")
+	other := mustCreatePost(t, service, "user-1", "Other")
+	first := mustCreatePostComment(t, service, post.ID, "user-2", "First")
+	second := mustCreatePostComment(t, service, post.ID, "user-3", "Second")
+	mustCreatePostComment(t, service, other.ID, "user-2", "Elsewhere")
+	if first.ID == 0 || second.ID <= first.ID {
+		t.Fatalf("expected increasing comment IDs, got %d and %d", first.ID, second.ID)
+	}
+
+	got, err := service.GetPostComment(uint64(first.ID))
+	if err != nil {
+		t.Fatalf("GetPostComment() returned error: %v", err)
+	}
+	if got.Body != "First" || got.PostID != post.ID || got.UserID != "user-2" {
+		t.Errorf("GetPostComment() = %+v, want %+v", got, first)
+	}
+
+	got.Body = "First (edited)"
+	if err := service.UpdatePostComment(&got); err != nil {
+		t.Fatalf("UpdatePostComment() returned error: %v", err)
+	}
+	got, err = service.GetPostComment(uint64(first.ID))
+	if err != nil {
+		t.Fatalf("GetPostComment() returned error: %v", err)
+	}
+	if got.Body != "First (edited)" {
+		t.Errorf("expected updated body, got %q", got.Body)
+	}
+
+	comments, _, err := service.GetPostCommentsForPost(uint64(post.ID), nil, "", services.SortNewest, 100)
+	if err != nil {
+		t.Fatalf("GetPostCommentsForPost() returned error: %v", err)
+	}
+	if len(comments) != 2 || comments[0].ID != second.ID || comments[1].ID != first.ID {
+		t.Errorf("expected comments [%d %d], got %+v", second.ID, first.ID, comments)
+	}
+
+	if err := service.DeletePostComment(&models.PostComment{}); err == nil {
+		t.Error("expected DeletePostComment to fail for a comment without an ID")
+	}
+	if err := service.DeletePostComment(&second); err != nil {
+		t.Fatalf("DeletePostComment() returned error: %v", err)
+	}
+	_, err = service.GetPostComment(uint64(second.ID))
+	assertNotFound(t, err)
+	comments, _, err = service.GetPostCommentsForPost(uint64(post.ID), nil, "", services.SortNewest, 100)
+	if err != nil {
+		t.Fatalf("GetPostCommentsForPost() returned error: %v", err)
+	}
+	if len(comments) != 1 || comments[0].ID != first.ID {
+		t.Errorf("expected only comment %d to remain, got %+v", first.ID, comments)
+	}
+
+	comments, _, err = service.GetPostCommentsForPost(uint64(other.ID+100), nil, "", services.SortNewest, 100)
+	if err != nil {
+		t.Fatalf("GetPostCommentsForPost() returned error: %v", err)
+	}
+	if comments == nil || len(comments) != 0 {
+		t.Errorf("expected an empty, non-nil slice, got %#v", comments)
+	}
+}
+
+func commentIDs(postComments []models.PostComment) []uint {
+	ids := make([]uint, 0, len(postComments))
+	for _, p := range postComments {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+func testPostCommentReplies(t *testing.T, service services.PostService) {
+	post := mustCreatePost(t, service, "user-1", "Threaded")
+	// root1
+	//   reply1
+	//     reply2
+	//       reply3
+	//   deleted
+	//     hidden
+	// root2
+	root1 := mustCreatePostComment(t, service, post.ID, "user-1", "root1")
+	reply1 := mustCreatePostReply(t, service, post.ID, &root1, "user-2", "reply1")
+	reply2 := mustCreatePostReply(t, service, post.ID, &reply1, "user-1", "reply2")
+	reply3 := mustCreatePostReply(t, service, post.ID, &reply2, "user-2", "reply3")
+	deleted := mustCreatePostReply(t, service, post.ID, &root1, "user-3", "deleted")
+	mustCreatePostReply(t, service, post.ID, &deleted, "user-3", "hidden")
+	root2 := mustCreatePostComment(t, service, post.ID, "user-3", "root2")
+	if err := service.DeletePostComment(&deleted); err != nil {
+		t.Fatalf("DeletePostComment() returned error: %v", err)
+	}
+
+	got, err := service.GetPostComment(uint64(reply1.ID))
+	if err != nil {
+		t.Fatalf("GetPostComment() returned error: %v", err)
+	}
+	if got.ParentID == nil || *got.ParentID != root1.ID {
+		t.Errorf("expected ParentID %d, got %v", root1.ID, got.ParentID)
+	}
+
+	tests := []struct {
+		parentIDs []uint64
+		depth     int
+		want      []uint
+	}{
+		{[]uint64{uint64(root1.ID), uint64(root2.ID)}, -1, []uint{reply3.ID, reply2.ID, reply1.ID}},
+		{[]uint64{uint64(root1.ID)}, 0, []uint{reply1.ID}},
+		{[]uint64{uint64(root1.ID)}, 1, []uint{reply2.ID, reply1.ID}},
+		{[]uint64{uint64(reply1.ID)}, -1, []uint{reply3.ID, reply2.ID}},
+		{[]uint64{uint64(reply1.ID)}, 5, []uint{reply3.ID, reply2.ID}},
+		{[]uint64{uint64(reply3.ID)}, -1, []uint{}},
+		{[]uint64{}, -1, []uint{}},
+	}
+	for _, tt := range tests {
+		postComments, err := service.GetPostCommentReplies(uint64(post.ID), tt.parentIDs, tt.depth)
+		if err != nil {
+			t.Fatalf("GetPostCommentReplies(%v, %d) returned error: %v", tt.parentIDs, tt.depth, err)
+		}
+		if got := commentIDs(postComments); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("GetPostCommentReplies(%v, %d) = %v, want %v", tt.parentIDs, tt.depth, got, tt.want)
+		}
+	}
+
+	topLevel := uint64(0)
+	roots, _, err := service.GetPostCommentsForPost(uint64(post.ID), &topLevel, "", services.SortNewest, 100)
+	if err != nil {
+		t.Fatalf("GetPostCommentsForPost() returned error: %v", err)
+	}
+	if got := commentIDs(roots); !reflect.DeepEqual(got, []uint{root2.ID, root1.ID}) {
+		t.Fatalf("expected top-level comments [%d %d], got %v", root2.ID, root1.ID, got)
+	}
+	parentID := uint64(reply1.ID)
+	direct, _, err := service.GetPostCommentsForPost(uint64(post.ID), &parentID, "", services.SortNewest, 100)
+	if err != nil {
+		t.Fatalf("GetPostCommentsForPost() returned error: %v", err)
+	}
+	if got := commentIDs(direct); !reflect.DeepEqual(got, []uint{reply2.ID}) {
+		t.Errorf("expected direct replies [%d], got %v", reply2.ID, got)
+	}
+
+	postComments, err := service.GetPostCommentReplies(uint64(post.ID), []uint64{uint64(root2.ID), uint64(root1.ID)}, 0)
+	if err != nil {
+		t.Fatalf("GetPostCommentReplies() returned error: %v", err)
+	}
+	threads := services.BuildPostCommentThreads(roots, postComments, 1, services.SortNewest)
+	if len(threads) != 2 || threads[0].ID != root2.ID || threads[1].ID != root1.ID {
+		t.Fatalf("expected threads rooted at [%d %d], got %+v", root2.ID, root1.ID, threads)
+	}
+	if threads[0].MoreReplies || !threads[1].MoreReplies || len(threads[1].Replies) != 0 {
+		t.Errorf("expected only root1 to be marked with more replies, got %+v", threads)
+	}
+}
+
+func testPostCommentsPagination(t *testing.T, service services.PostService) {
+	post := mustCreatePost(t, service, "user-1", "Popular")
+	created := make([]uint, 0, 25)
+	for i := 0; i < 25; i++ {
+		created = append(created, mustCreatePostComment(t, service, post.ID, "user-2", fmt.Sprintf("Comment %d", i)).ID)
+	}
+	reversed := make([]uint, 0, len(created))
+	for i := len(created) - 1; i >= 0; i-- {
+		reversed = append(reversed, created[i])
+	}
+
+	tests := []struct {
+		sort string
+		want []uint
+	}{
+		{services.SortNewest, reversed},
+		{services.SortOldest, created},
+		// Without votes every comment has the same score, so ties fall back
+		// to the newest comment first.
+		{services.SortTop, reversed},
+	}
+	for _, tt := range tests {
+		var all []uint
+		var sizes []int
+		cursor := ""
+		for {
+			page, nextCursor, err := service.GetPostCommentsForPost(uint64(post.ID), nil, cursor, tt.sort, 10)
+			if err != nil {
+				t.Fatalf("GetPostCommentsForPost(%q, %q) returned error: %v", cursor, tt.sort, err)
+			}
+			all = append(all, commentIDs(page)...)
+			sizes = append(sizes, len(page))
+			if nextCursor == "" || len(sizes) > 3 {
+				break
+			}
+			cursor = nextCursor
+		}
+		if !reflect.DeepEqual(sizes, []int{10, 10, 5}) {
+			t.Errorf("sort %q: expected pages of sizes [10 10 5], got %v", tt.sort, sizes)
+		}
+		if !reflect.DeepEqual(all, tt.want) {
+			t.Errorf("sort %q: got %v, want %v", tt.sort, all, tt.want)
+		}
+	}
+
+	page, nextCursor, err := service.GetPostCommentsForPost(uint64(post.ID), nil, "", services.SortNewest, 25)
+	if err != nil {
+		t.Fatalf("GetPostCommentsForPost() returned error: %v", err)
+	}
+	if len(page) != 25 || nextCursor != "" {
+		t.Errorf("expected a full final page without a cursor, got %d comments and cursor %q", len(page), nextCursor)
+	}
+	if _, _, err := service.GetPostCommentsForPost(uint64(post.ID), nil, "not base64!", services.SortNewest, 10); err == nil {
+		t.Error("expected an invalid cursor to return an error")
+	} else if _, ok := err.(*errors.CursorDecodingError); !ok {
+		t.Errorf("expected *errors.CursorDecodingError, got %#v", err)
+	}
+}
+
+func testPostVotes(t *testing.T, service services.PostService) {
+	post := mustCreatePost(t, service, "user-1", "Voted")
+	other := mustCreatePost(t, service, "user-1", "Other")
+
+	if total := mustGetPostVoteTotal(t, service, post.ID); total != 0 {
+		t.Errorf("expected total of 0 without votes, got %d", total)
+	}
+	if users := mustGetPostVoteUsers(t, service, post.ID); users == nil || len(users) != 0 {
+		t.Errorf("expected an empty, non-nil slice of users, got %#v", users)
+	}
+	_, err := service.GetPostVote(uint64(post.ID), "user-2")
+	assertNotFound(t, err)
+
+	votes := []models.PostVote{
+		{PostID: post.ID, UserID: "user-2", Value: 1},
+		{PostID: post.ID, UserID: "user-3", Value: 1},
+		{PostID: post.ID, UserID: "user-4", Value: -1},
+		{PostID: other.ID, UserID: "user-2", Value: -1},
+	}
+	for i := range votes {
+		isNew, err := service.CreatePostVote(&votes[i])
+		if err != nil {
+			t.Fatalf("CreatePostVote() returned error: %v", err)
+		}
+		if !isNew {
+			t.Errorf("CreatePostVote() returned false for a new vote")
+		}
+	}
+	if total := mustGetPostVoteTotal(t, service, post.ID); total != 1 {
+		t.Errorf("expected total of 1, got %d", total)
+	}
+	if total := mustGetPostVoteTotal(t, service, other.ID); total != -1 {
+		t.Errorf("expected total of -1, got %d", total)
+	}
+	users := mustGetPostVoteUsers(t, service, post.ID)
+	sort.Strings(users)
+	if !reflect.DeepEqual(users, []string{"user-2", "user-3", "user-4"}) {
+		t.Errorf("expected voters [user-2 user-3 user-4], got %v", users)
+	}
+	vote, err := service.GetPostVote(uint64(post.ID), "user-4")
+	if err != nil {
+		t.Fatalf("GetPostVote() returned error: %v", err)
+	}
+	if vote.Value != -1 || vote.PostID != post.ID || vote.UserID != "user-4" {
+		t.Errorf("GetPostVote() = %+v, want value -1", vote)
+	}
+
+	vote.Value = 1
+	if _, err := service.CreatePostVote(&vote); err != nil {
+		t.Fatalf("CreatePostVote() returned error: %v", err)
+	}
+	if vote, err = service.GetPostVote(uint64(post.ID), "user-4"); err != nil || vote.Value != 1 {
+		t.Errorf("GetPostVote() = %+v, %v after update, want value 1", vote, err)
+	}
+	if total := mustGetPostVoteTotal(t, service, post.ID); total != 3 {
+		t.Errorf("expected total of 3 after changing a vote, got %d", total)
+	}
+
+	if err := service.DeletePostVote(&vote); err != nil {
+		t.Fatalf("DeletePostVote() returned error: %v", err)
+	}
+	_, err = service.GetPostVote(uint64(post.ID), "user-4")
+	assertNotFound(t, err)
+	if total := mustGetPostVoteTotal(t, service, post.ID); total != 2 {
+		t.Errorf("expected total of 2 after retracting a vote, got %d", total)
+	}
+	users = mustGetPostVoteUsers(t, service, post.ID)
+	sort.Strings(users)
+	if !reflect.DeepEqual(users, []string{"user-2", "user-3"}) {
+		t.Errorf("expected voters [user-2 user-3], got %v", users)
+	}
+	assertNotFound(t, service.DeletePostVote(&vote))
+}
+
+func testCreatePostVoteTwice(t *testing.T, service services.PostService) {
+	post := mustCreatePost(t, service, "user-1", "Voted twice")
+	assertCounters := func(score int, upvotes int, downvotes int) {
+		t.Helper()
+		got, err := service.GetPost(uint64(post.ID))
+		if err != nil {
+			t.Fatalf("GetPost() returned error: %v", err)
+		}
+		if got.Score != score || got.Upvotes != upvotes || got.Downvotes != downvotes {
+			t.Errorf("expected score %d, upvotes %d and downvotes %d, got %d, %d and %d",
+				score, upvotes, downvotes, got.Score, got.Upvotes, got.Downvotes)
+		}
+	}
+
+	first := models.PostVote{PostID: post.ID, UserID: "user-2", Value: 1}
+	if isNew, err := service.CreatePostVote(&first); err != nil || !isNew {
+		t.Fatalf("CreatePostVote() = %v, %v, want true", isNew, err)
+	}
+	assertCounters(1, 1, 0)
+
+	// Voting again changes the existing vote rather than adding another
+	second := models.PostVote{PostID: post.ID, UserID: "user-2", Value: -1}
+	isNew, err := service.CreatePostVote(&second)
+	if err != nil || isNew {
+		t.Fatalf("CreatePostVote() = %v, %v for an existing vote, want false", isNew, err)
+	}
+	// Times may be stored with less precision than they are created with
+	if d := second.CreatedAt.Sub(first.CreatedAt); second.Value != -1 || d < -time.Millisecond || d > time.Millisecond {
+		t.Errorf("CreatePostVote() set %+v, want value -1 created at %v", second, first.CreatedAt)
+	}
+	assertCounters(-1, 0, 1)
+	if vote, err := service.GetPostVote(uint64(post.ID), "user-2"); err != nil || vote.Value != -1 {
+		t.Errorf("GetPostVote() = %+v, %v, want value -1", vote, err)
+	}
+	if users := mustGetPostVoteUsers(t, service, post.ID); !reflect.DeepEqual(users, []string{"user-2"}) {
+		t.Errorf("expected voters [user-2], got %v", users)
+	}
+
+	// Voting the same way again changes nothing
+	third := models.PostVote{PostID: post.ID, UserID: "user-2", Value: -1}
+	if isNew, err := service.CreatePostVote(&third); err != nil || isNew {
+		t.Fatalf("CreatePostVote() = %v, %v for an unchanged vote, want false", isNew, err)
+	}
+	assertCounters(-1, 0, 1)
+}
+
+func testPostCommentVotes(t *testing.T, service services.PostService) {
+	post := mustCreatePost(t, service, "user-1", "Discussed")
+	first := mustCreatePostComment(t, service, post.ID, "user-1", "First")
+	second := mustCreatePostComment(t, service, post.ID, "user-1", "Second")
+	third := mustCreatePostComment(t, service, post.ID, "user-1", "Third")
+
+	assertScore := func(postComment models.PostComment, want int) {
+		t.Helper()
+		if total := mustGetPostCommentVoteTotal(t, service, postComment.ID); total != int64(want) {
+			t.Errorf("expected total of %d for comment %d, got %d", want, postComment.ID, total)
+		}
+		got, err := service.GetPostComment(uint64(postComment.ID))
+		if err != nil {
+			t.Fatalf("GetPostComment() returned error: %v", err)
+		}
+		if got.Score != want {
+			t.Errorf("expected score of %d for comment %d, got %d", want, postComment.ID, got.Score)
+		}
+	}
+
+	assertScore(first, 0)
+	if users := mustGetPostCommentVoteUsers(t, service, first.ID); users == nil || len(users) != 0 {
+		t.Errorf("expected an empty, non-nil slice of users, got %#v", users)
+	}
+	_, err := service.GetPostCommentVote(uint64(first.ID), "user-2")
+	assertNotFound(t, err)
+
+	votes := []models.PostCommentVote{
+		{PostCommentID: first.ID, UserID: "user-2", Value: 1},
+		{PostCommentID: first.ID, UserID: "user-3", Value: 1},
+		{PostCommentID: third.ID, UserID: "user-2", Value: 1},
+		{PostCommentID: second.ID, UserID: "user-2", Value: -1},
+	}
+	for i := range votes {
+		if _, err := service.CreatePostCommentVote(&votes[i]); err != nil {
+			t.Fatalf("CreatePostCommentVote() returned error: %v", err)
+		}
+	}
+	assertScore(first, 2)
+	assertScore(second, -1)
+	assertScore(third, 1)
+	users := mustGetPostCommentVoteUsers(t, service, first.ID)
+	sort.Strings(users)
+	if !reflect.DeepEqual(users, []string{"user-2", "user-3"}) {
+		t.Errorf("expected voters [user-2 user-3], got %v", users)
+	}
+
+	// Updating a comment must not clobber its score.
+	got, err := service.GetPostComment(uint64(first.ID))
+	if err != nil {
+		t.Fatalf("GetPostComment() returned error: %v", err)
+	}
+	got.Body = "First (edited)"
+	got.Score = 100
+	if err := service.UpdatePostComment(&got); err != nil {
+		t.Fatalf("UpdatePostComment() returned error: %v", err)
+	}
+	assertScore(first, 2)
+
+	top, _, err := service.GetPostCommentsForPost(uint64(post.ID), nil, "", services.SortTop, 100)
+	if err != nil {
+		t.Fatalf("GetPostCommentsForPost() returned error: %v", err)
+	}
+	if got := commentIDs(top); !reflect.DeepEqual(got, []uint{first.ID, third.ID, second.ID}) {
+		t.Errorf("expected top comments [%d %d %d], got %v", first.ID, third.ID, second.ID, got)
+	}
+	page, nextCursor, err := service.GetPostCommentsForPost(uint64(post.ID), nil, "", services.SortTop, 1)
+	if err != nil {
+		t.Fatalf("GetPostCommentsForPost() returned error: %v", err)
+	}
+	page2, _, err := service.GetPostCommentsForPost(uint64(post.ID), nil, nextCursor, services.SortTop, 2)
+	if err != nil {
+		t.Fatalf("GetPostCommentsForPost() returned error: %v", err)
+	}
+	if got := commentIDs(append(page, page2...)); !reflect.DeepEqual(got, []uint{first.ID, third.ID, second.ID}) {
+		t.Errorf("expected paginated top comments [%d %d %d], got %v", first.ID, third.ID, second.ID, got)
+	}
+
+	vote, err := service.GetPostCommentVote(uint64(first.ID), "user-3")
+	if err != nil {
+		t.Fatalf("GetPostCommentVote() returned error: %v", err)
+	}
+	vote.Value = -1
+	if _, err := service.CreatePostCommentVote(&vote); err != nil {
+		t.Fatalf("CreatePostCommentVote() returned error: %v", err)
+	}
+	assertScore(first, 0)
+	if err := service.DeletePostCommentVote(&vote); err != nil {
+		t.Fatalf("DeletePostCommentVote() returned error: %v", err)
+	}
+	assertScore(first, 1)
+	_, err = service.GetPostCommentVote(uint64(first.ID), "user-3")
+	assertNotFound(t, err)
+	assertNotFound(t, service.DeletePostCommentVote(&vote))
+}
+
+func testCreatePostCommentVoteTwice(t *testing.T, service services.PostService) {
+	post := mustCreatePost(t, service, "user-1", "Discussed")
+	postComment := mustCreatePostComment(t, service, post.ID, "user-1", "Voted twice")
+	assertScore := func(want int) {
+		t.Helper()
+		got, err := service.GetPostComment(uint64(postComment.ID))
+		if err != nil {
+			t.Fatalf("GetPostComment() returned error: %v", err)
+		}
+		if got.Score != want {
+			t.Errorf("expected score %d, got %d", want, got.Score)
+		}
+	}
+
+	first := models.PostCommentVote{PostCommentID: postComment.ID, UserID: "user-2", Value: 1}
+	if isNew, err := service.CreatePostCommentVote(&first); err != nil || !isNew {
+		t.Fatalf("CreatePostCommentVote() = %v, %v, want true", isNew, err)
+	}
+	assertScore(1)
+
+	// Voting again changes the existing vote rather than adding another
+	second := models.PostCommentVote{PostCommentID: postComment.ID, UserID: "user-2", Value: -1}
+	isNew, err := service.CreatePostCommentVote(&second)
+	if err != nil || isNew {
+		t.Fatalf("CreatePostCommentVote() = %v, %v for an existing vote, want false", isNew, err)
+	}
+	if d := second.CreatedAt.Sub(first.CreatedAt); second.Value != -1 || d < -time.Millisecond || d > time.Millisecond {
+		t.Errorf("CreatePostCommentVote() set %+v, want value -1 created at %v", second, first.CreatedAt)
+	}
+	assertScore(-1)
+	if total := mustGetPostCommentVoteTotal(t, service, postComment.ID); total != -1 {
+		t.Errorf("expected total of -1, got %d", total)
+	}
+	if users := mustGetPostCommentVoteUsers(t, service, postComment.ID); !reflect.DeepEqual(users, []string{"user-2"}) {
+		t.Errorf("expected voters [user-2], got %v", users)
+	}
+
+	// Voting the same way again changes nothing
+	third := models.PostCommentVote{PostCommentID: postComment.ID, UserID: "user-2", Value: -1}
+	if isNew, err := service.CreatePostCommentVote(&third); err != nil || isNew {
+		t.Fatalf("CreatePostCommentVote() = %v, %v for an unchanged vote, want false", isNew, err)
+	}
+	assertScore(-1)
+}
+
+func testPostCounters(t *testing.T, service services.PostService) {
+	post := models.Post{UserID: "user-1", Title: "Counted", Body: "Body", Score: 99, Upvotes: 99, Downvotes: 99, CommentCount: 99}
+	if err := service.CreatePost(&post); err != nil {
+		t.Fatalf("CreatePost() returned error: %v", err)
+	}
+	assertCounters := func(score int, upvotes int, downvotes int, commentCount int) {
+		t.Helper()
+		got, err := service.GetPost(uint64(post.ID))
+		if err != nil {
+			t.Fatalf("GetPost() returned error: %v", err)
+		}
+		if got.Score != score || got.Upvotes != upvotes || got.Downvotes != downvotes || got.CommentCount != commentCount {
+			t.Errorf("expected score %d, upvotes %d, downvotes %d and comment count %d, got %d, %d, %d and %d",
+				score, upvotes, downvotes, commentCount, got.Score, got.Upvotes, got.Downvotes, got.CommentCount)
+		}
+		posts, _, err := service.GetPosts(services.PostQuery{})
+		if err != nil {
+			t.Fatalf("GetPosts() returned error: %v", err)
+		}
+		if len(posts) != 1 || posts[0].Score != got.Score || posts[0].CommentCount != got.CommentCount {
+			t.Errorf("expected GetPosts to return the same counters as GetPost, got %+v", posts)
+		}
+	}
+	assertCounters(0, 0, 0, 0)
+
+	votes := []models.PostVote{
+		{PostID: post.ID, UserID: "user-2", Value: 1},
+		{PostID: post.ID, UserID: "user-3", Value: 1},
+		{PostID: post.ID, UserID: "user-4", Value: -1},
+	}
+	for i := range votes {
+		if _, err := service.CreatePostVote(&votes[i]); err != nil {
+			t.Fatalf("CreatePostVote() returned error: %v", err)
+		}
+	}
+	assertCounters(1, 2, 1, 0)
+	votes[0].Value = -1
+	if _, err := service.CreatePostVote(&votes[0]); err != nil {
+		t.Fatalf("CreatePostVote() returned error: %v", err)
+	}
+	assertCounters(-1, 1, 2, 0)
+	if err := service.DeletePostVote(&votes[2]); err != nil {
+		t.Fatalf("DeletePostVote() returned error: %v", err)
+	}
+	assertCounters(0, 1, 1, 0)
+
+	first := mustCreatePostComment(t, service, post.ID, "user-2", "First")
+	mustCreatePostReply(t, service, post.ID, &first, "user-3", "Reply")
+	assertCounters(0, 1, 1, 2)
+	if err := service.DeletePostComment(&first); err != nil {
+		t.Fatalf("DeletePostComment() returned error: %v", err)
+	}
+	assertCounters(0, 1, 1, 1)
+	// Deleting an already deleted comment must not change the count.
+	if err := service.DeletePostComment(&first); err != nil {
+		t.Fatalf("DeletePostComment() returned error: %v", err)
+	}
+	assertCounters(0, 1, 1, 1)
+
+	// Updating a post must not clobber its counters.
+	got, err := service.GetPost(uint64(post.ID))
+	if err != nil {
+		t.Fatalf("GetPost() returned error: %v", err)
+	}
+	got.Title = "Renamed"
+	got.ResetCounters()
+	if err := service.UpdatePost(&got); err != nil {
+		t.Fatalf("UpdatePost() returned error: %v", err)
+	}
+	assertCounters(0, 1, 1, 1)
+}
+
+func testPostSaves(t *testing.T, service services.PostService) {
+	post := mustCreatePost(t, service, "user-1", "Saved")
+	other := mustCreatePost(t, service, "user-1", "Other")
+
+	save, isNew, err := service.CreatePostSave(&models.PostSave{PostID: post.ID, UserID: "user-2"})
+	if err != nil {
+		t.Fatalf("CreatePostSave() returned error: %v", err)
+	}
+	if !isNew || save.ID == 0 {
+		t.Fatalf("expected a new save with an ID, got %+v (new: %v)", save, isNew)
+	}
+	again, isNew, err := service.CreatePostSave(&models.PostSave{PostID: post.ID, UserID: "user-2"})
+	if err != nil {
+		t.Fatalf("CreatePostSave() returned error: %v", err)
+	}
+	if isNew || again.ID != save.ID {
+		t.Errorf("expected the existing save %d to be returned, got %+v (new: %v)", save.ID, again, isNew)
+	}
+	if _, _, err := service.CreatePostSave(&models.PostSave{PostID: post.ID, UserID: "user-3"}); err != nil {
+		t.Fatalf("CreatePostSave() returned error: %v", err)
+	}
+	if _, _, err := service.CreatePostSave(&models.PostSave{PostID: other.ID, UserID: "user-2"}); err != nil {
+		t.Fatalf("CreatePostSave() returned error: %v", err)
+	}
+
+	assertSaves := func(postID uint64, userID string, want int) {
+		t.Helper()
+		saves, err := service.GetPostSaves(postID, userID)
+		if err != nil {
+			t.Fatalf("GetPostSaves(%d, %q) returned error: %v", postID, userID, err)
+		}
+		if len(saves) != want {
+			t.Errorf("GetPostSaves(%d, %q) returned %d saves, want %d", postID, userID, len(saves), want)
+		}
+		for _, s := range saves {
+			if (postID > 0 && uint64(s.PostID) != postID) || (userID != "" && s.UserID != userID) {
+				t.Errorf("GetPostSaves(%d, %q) returned non-matching save %+v", postID, userID, s)
+			}
+		}
+	}
+	assertSaves(uint64(post.ID), "", 2)
+	assertSaves(0, "user-2", 2)
+	assertSaves(uint64(post.ID), "user-2", 1)
+
+	if err := service.DeletePostSave(&save); err != nil {
+		t.Fatalf("DeletePostSave() returned error: %v", err)
+	}
+	_, err = service.GetPostSave(uint64(save.ID))
+	assertNotFound(t, err)
+	assertSaves(uint64(post.ID), "", 1)
+
+	// Saving again restores the soft-deleted save rather than creating a new one.
+	restored, isNew, err := service.CreatePostSave(&models.PostSave{PostID: post.ID, UserID: "user-2"})
+	if err != nil {
+		t.Fatalf("CreatePostSave() returned error: %v", err)
+	}
+	if isNew || restored.ID != save.ID || restored.DeletedAt != nil {
+		t.Errorf("expected save %d to be restored, got %+v (new: %v)", save.ID, restored, isNew)
+	}
+	if _, err := service.GetPostSave(uint64(save.ID)); err != nil {
+		t.Errorf("GetPostSave() returned error for restored save: %v", err)
+	}
+	assertSaves(uint64(post.ID), "", 2)
+
+	if err := service.DeletePostSave(&models.PostSave{}); err == nil {
+		t.Error("expected DeletePostSave to fail for a save without an ID")
+	}
+}
+
+func testGetTags(t *testing.T, service services.PostService) {
+	tags, err := service.GetTags()
+	if err != nil {
+		t.Fatalf("GetTags() returned error: %v", err)
+	}
+	if tags == nil || len(tags) != 0 {
+		t.Errorf("expected an empty, non-nil slice of tags, got %#v", tags)
+	}
+	mustCreatePost(t, service, "user-1", "One", "Go", "databases")
+	mustCreatePost(t, service, "user-1", "Two", "go", "web")
+	deleted := mustCreatePost(t, service, "user-1", "Three", "gone")
+	if err := service.DeletePost(&deleted); err != nil {
+		t.Fatalf("DeletePost() returned error: %v", err)
+	}
+	tags, err = service.GetTags()
+	if err != nil {
+		t.Fatalf("GetTags() returned error: %v", err)
+	}
+	if !reflect.DeepEqual(tags, []string{"databases", "go", "web"}) {
+		t.Errorf("expected tags [databases go web], got %v", tags)
+	}
+}
+
+func testSearch(t *testing.T, service services.PostService) {
+	postgres := mustCreatePost(t, service, "user-1", "Databases", "Tags")
+	postgres.Body = "Postgres is a relational database with excellent full text search."
+	if err := service.UpdatePost(&postgres); err != nil {
+		t.Fatalf("UpdatePost() returned error: %v", err)
+	}
+	gardening := mustCreatePost(t, service, "user-1", "Gardening")
+	comment := mustCreatePostComment(t, service, gardening.ID, "user-2", "I keep my seed catalogue in a database.")
+	deleted := mustCreatePostComment(t, service, gardening.ID, "user-2", "Another database comment.")
+	if err := service.DeletePostComment(&deleted); err != nil {
+		t.Fatalf("DeletePostComment() returned error: %v", err)
+	}
+
+	type match struct {
+		Type string
+		ID   uint
+	}
+	search := func(query string, kind string) []match {
+		t.Helper()
+		results, _, err := service.Search(query, kind, "", 100)
+		if err != nil {
+			t.Fatalf("Search(%q, %q) returned error: %v", query, kind, err)
+		}
+		matches := make([]match, 0, len(results))
+		for _, result := range results {
+			matches = append(matches, match{result.Type, result.ID})
+			if result.Type == models.SearchResultComment && result.PostID != gardening.ID {
+				t.Errorf("expected comment result to reference post %d, got %d", gardening.ID, result.PostID)
+			}
+		}
+		sort.Slice(matches, func(i, j int) bool { return matches[i].Type < matches[j].Type })
+		return matches
+	}
+
+	tests := []struct {
+		query string
+		kind  string
+		want  []match
+	}{
+		{"database", "", []match{{models.SearchResultComment, comment.ID}, {models.SearchResultPost, postgres.ID}}},
+		{"database", models.SearchResultPost, []match{{models.SearchResultPost, postgres.ID}}},
+		{"database", models.SearchResultComment, []match{{models.SearchResultComment, comment.ID}}},
+		{"postgres search", "", []match{{models.SearchResultPost, postgres.ID}}},
+		{"gardening", "", []match{{models.SearchResultPost, gardening.ID}}},
+		{"postgres gardening", "", []match{}},
+		{"unicorn", "", []match{}},
+	}
+	for _, tt := range tests {
+		if got := search(tt.query, tt.kind); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Search(%q, %q) = %v, want %v", tt.query, tt.kind, got, tt.want)
+		}
+	}
+
+	results, _, err := service.Search("postgres", "", "", 100)
+	if err != nil {
+		t.Fatalf("Search() returned error: %v", err)
+	}
+	if len(results) != 1 || !strings.Contains(results[0].Snippet, "<mark>Postgres</mark>") {
+		t.Errorf("expected a highlighted snippet, got %+v", results)
+	}
+	if results[0].Title != "Databases" {
+		t.Errorf("expected post result to include its title, got %q", results[0].Title)
+	}
+
+	// Snippets are rendered as HTML so the markup of bodies must be escaped
+	script := mustCreatePostComment(t, service, gardening.ID, "user-2", `<script>alert("compost")</script> & compost`)
+	results, _, err = service.Search("compost", "", "", 100)
+	if err != nil {
+		t.Fatalf("Search() returned error: %v", err)
+	}
+	if len(results) != 1 || results[0].ID != script.ID {
+		t.Fatalf("expected the comment containing markup, got %+v", results)
+	}
+	if snippet := strings.NewReplacer("<mark>", "", "</mark>", "").Replace(results[0].Snippet); strings.ContainsAny(snippet, "<>") || !strings.Contains(snippet, "&lt;script&gt;") || !strings.Contains(snippet, "&amp;") {
+		t.Errorf("expected a snippet with the markup escaped, got %q", results[0].Snippet)
+	}
+	if !strings.Contains(results[0].Snippet, "<mark>") {
+		t.Errorf("expected a highlighted snippet, got %q", results[0].Snippet)
+	}
+	if err := service.DeletePostComment(&script); err != nil {
+		t.Fatalf("DeletePostComment() returned error: %v", err)
+	}
+
+	page, nextCursor, err := service.Search("database", "", "", 1)
+	if err != nil {
+		t.Fatalf("Search() returned error: %v", err)
+	}
+	if len(page) != 1 || nextCursor == "" {
+		t.Fatalf("expected a page of 1 result with a cursor, got %d results and cursor %q", len(page), nextCursor)
+	}
+	// Results leaving the first page do not shift the next one
+	if page[0].Type == models.SearchResultPost {
+		err = service.DeletePost(&postgres)
+	} else {
+		err = service.DeletePostComment(&comment)
+	}
+	if err != nil {
+		t.Fatalf("failed to delete %s %d: %v", page[0].Type, page[0].ID, err)
+	}
+	rest, nextCursor, err := service.Search("database", "", nextCursor, 1)
+	if err != nil {
+		t.Fatalf("Search() returned error: %v", err)
+	}
+	if len(rest) != 1 || nextCursor != "" || (rest[0].Type == page[0].Type && rest[0].ID == page[0].ID) {
+		t.Errorf("expected a final page with the other result, got %+v and cursor %q", rest, nextCursor)
+	}
+	if _, _, err := service.Search("database", "", "bm90IGEgY3Vyc29y", 1); err == nil {
+		t.Error("expected an error searching with an invalid cursor")
+	}
+}
@@ -0,0 +1,225 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/willdady/postms/internal/postms/models"
+	"github.com/willdady/postms/internal/utils"
+)
+
+// Sort modes accepted when listing.
+const (
+	SortNewest        = "newest"
+	SortOldest        = "oldest"
+	SortTop           = "top"
+	SortHot           = "hot"
+	SortControversial = "controversial"
+)
+
+// Windows which limit the posts considered by the top and controversial
+// sorts to those created recently.
+const (
+	WindowDay   = "day"
+	WindowWeek  = "week"
+	WindowMonth = "month"
+	WindowYear  = "year"
+	WindowAll   = "all"
+)
+
+// IsPostCommentSort reports whether value is a sort mode supported when
+// listing comments.
+func IsPostCommentSort(value string) bool {
+	switch value {
+	case SortNewest, SortOldest, SortTop:
+		return true
+	}
+	return false
+}
+
+// IsPostSort reports whether value is a sort mode supported when listing
+// posts.
+func IsPostSort(value string) bool {
+	switch value {
+	case SortNewest, SortHot, SortTop, SortControversial:
+		return true
+	}
+	return false
+}
+
+// IsWindow reports whether value is a supported window.
+func IsWindow(value string) bool {
+	switch value {
+	case WindowDay, WindowWeek, WindowMonth, WindowYear, WindowAll:
+		return true
+	}
+	return false
+}
+
+// WindowStart returns the earliest creation time of posts within window
+// ending at now. It returns false if the window is unbounded.
+func WindowStart(window string, now time.Time) (time.Time, bool) {
+	switch window {
+	case WindowDay:
+		return now.AddDate(0, 0, -1), true
+	case WindowWeek:
+		return now.AddDate(0, 0, -7), true
+	case WindowMonth:
+		return now.AddDate(0, -1, 0), true
+	case WindowYear:
+		return now.AddDate(-1, 0, 0), true
+	}
+	return time.Time{}, false
+}
+
+// SortPostComments sorts comments in place according to mode, which defaults
+// to SortNewest. Ties are broken by descending ID so the order is total.
+func SortPostComments(comments []models.PostComment, mode string) {
+	sort.Slice(comments, func(i, j int) bool {
+		a, b := comments[i], comments[j]
+		switch mode {
+		case SortOldest:
+			return a.ID < b.ID
+		case SortTop:
+			if a.Score != b.Score {
+				return a.Score > b.Score
+			}
+		}
+		return a.ID > b.ID
+	})
+}
+
+// PostSortKey returns the value posts are ranked by in descending order for
+// mode, before ties are broken by descending ID. It is 0 for SortNewest.
+func PostSortKey(post models.Post, mode string) float64 {
+	switch mode {
+	case SortHot:
+		return post.Hot
+	case SortTop:
+		return float64(post.Score)
+	case SortControversial:
+		return post.Controversy
+	}
+	return 0
+}
+
+// SortPosts sorts posts in place according to mode, which defaults to
+// SortNewest.
+func SortPosts(posts []models.Post, mode string) {
+	sort.Slice(posts, func(i, j int) bool {
+		a, b := PostSortKey(posts[i], mode), PostSortKey(posts[j], mode)
+		if a != b {
+			return a > b
+		}
+		return posts[i].ID > posts[j].ID
+	})
+}
+
+// EncodePostCursor returns a cursor for a page of posts sorted by mode which
+// starts at post.
+func EncodePostCursor(post models.Post, mode string) string {
+	if mode == SortHot || mode == SortTop || mode == SortControversial {
+		key := PostSortKey(post, mode)
+		return utils.EncodeCursor(int64(math.Float64bits(key)), int64(post.ID))
+	}
+	return utils.UintToBase64(post.ID)
+}
+
+// DecodePostCursor decodes a cursor produced by EncodePostCursor for the same
+// mode into the sort key and ID of the first post of the page.
+func DecodePostCursor(cursor string, mode string) (float64, uint64, error) {
+	if mode == SortHot || mode == SortTop || mode == SortControversial {
+		values, err := utils.DecodeCursor(cursor, 2)
+		if err != nil {
+			return 0, 0, err
+		}
+		return math.Float64frombits(uint64(values[0])), uint64(values[1]), nil
+	}
+	values, err := utils.DecodeCursor(cursor, 1)
+	if err != nil {
+		return 0, 0, err
+	}
+	return 0, uint64(values[0]), nil
+}
+
+// resultTypeOrder orders the types of trash items and search results, which
+// are sorted by type after their date or rank as posts and comments may share
+// an ID.
+var resultTypeOrder = map[string]int64{models.TrashItemComment: 0, models.TrashItemPost: 1}
+
+// resultType returns the type of trash item or search result ordered by order.
+func resultType(order int64) (string, bool) {
+	for resultType, o := range resultTypeOrder {
+		if o == order {
+			return resultType, true
+		}
+	}
+	return "", false
+}
+
+// EncodeTrashCursor returns a cursor for a page of the trash which starts at
+// item.
+func EncodeTrashCursor(item models.TrashItem) string {
+	return utils.EncodeCursor(item.DeletedAt.UnixNano(), resultTypeOrder[item.Type], int64(item.ID))
+}
+
+// DecodeTrashCursor decodes a cursor produced by EncodeTrashCursor into the
+// first item of the page, of which only the type, ID and deletion time are
+// set.
+func DecodeTrashCursor(cursor string) (models.TrashItem, error) {
+	values, err := utils.DecodeCursor(cursor, 3)
+	if err != nil {
+		return models.TrashItem{}, err
+	}
+	itemType, ok := resultType(values[1])
+	if !ok || values[2] < 0 {
+		return models.TrashItem{}, fmt.Errorf("invalid trash cursor")
+	}
+	return models.TrashItem{Type: itemType, ID: uint(values[2]), DeletedAt: time.Unix(0, values[0])}, nil
+}
+
+// TrashItemBefore reports whether a is listed before b in the trash, which is
+// ordered by deletion time, most recent first.
+func TrashItemBefore(a models.TrashItem, b models.TrashItem) bool {
+	if !a.DeletedAt.Equal(b.DeletedAt) {
+		return a.DeletedAt.After(b.DeletedAt)
+	}
+	if a.Type != b.Type {
+		return a.Type > b.Type
+	}
+	return a.ID > b.ID
+}
+
+// EncodeSearchCursor returns a cursor for a page of search results which
+// starts at result.
+func EncodeSearchCursor(result models.SearchResult) string {
+	return utils.EncodeCursor(int64(math.Float64bits(result.Rank)), resultTypeOrder[result.Type], int64(result.ID))
+}
+
+// DecodeSearchCursor decodes a cursor produced by EncodeSearchCursor into the
+// first result of the page, of which only the type, ID and rank are set.
+func DecodeSearchCursor(cursor string) (models.SearchResult, error) {
+	values, err := utils.DecodeCursor(cursor, 3)
+	if err != nil {
+		return models.SearchResult{}, err
+	}
+	itemType, ok := resultType(values[1])
+	if !ok || values[2] < 0 {
+		return models.SearchResult{}, fmt.Errorf("invalid search cursor")
+	}
+	return models.SearchResult{Type: itemType, ID: uint(values[2]), Rank: math.Float64frombits(uint64(values[0]))}, nil
+}
+
+// SearchResultBefore reports whether a is listed before b in search results,
+// which are ordered by rank, most relevant first.
+func SearchResultBefore(a models.SearchResult, b models.SearchResult) bool {
+	if a.Rank != b.Rank {
+		return a.Rank > b.Rank
+	}
+	if a.Type != b.Type {
+		return a.Type > b.Type
+	}
+	return a.ID > b.ID
+}
@@ -0,0 +1,38 @@
+package services
+
+import (
+	"github.com/willdady/postms/internal/postms/models"
+)
+
+// BuildPostCommentThreads assembles roots and the replies returned for them by
+// PostService.GetPostCommentReplies into threads. The order of roots is
+// preserved while replies are ordered by mode. When depth is greater than 0,
+// replies nested deeper than depth levels (counting the roots as the first
+// level) are dropped and their parent is marked with MoreReplies.
+func BuildPostCommentThreads(roots []models.PostComment, replies []models.PostComment, depth int, mode string) []models.PostCommentThread {
+	children := make(map[uint][]models.PostComment)
+	for _, reply := range replies {
+		if reply.ParentID != nil {
+			children[*reply.ParentID] = append(children[*reply.ParentID], reply)
+		}
+	}
+	for _, siblings := range children {
+		SortPostComments(siblings, mode)
+	}
+	return buildPostCommentThreads(children, roots, depth, 1)
+}
+
+func buildPostCommentThreads(children map[uint][]models.PostComment, comments []models.PostComment, depth int, level int) []models.PostCommentThread {
+	threads := make([]models.PostCommentThread, 0, len(comments))
+	for _, comment := range comments {
+		thread := models.PostCommentThread{PostComment: comment}
+		if depth > 0 && level >= depth {
+			thread.Replies = []models.PostCommentThread{}
+			thread.MoreReplies = len(children[comment.ID]) > 0
+		} else {
+			thread.Replies = buildPostCommentThreads(children, children[comment.ID], depth, level+1)
+		}
+		threads = append(threads, thread)
+	}
+	return threads
+}
@@ -0,0 +1,124 @@
+package rest
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CacheMap maps resources to the Cache-Control header sent with successful
+// GET responses for them. Resources which are not in the map are sent without
+// one.
+type CacheMap map[string]string
+
+var cacheControls CacheMap
+
+// bufferedWriter holds back a response so it can be inspected before it is
+// sent, for example to replace it with 304 Not Modified. The status is usually
+// set on the underlying writer by gin, and only recorded here when set
+// directly.
+type bufferedWriter struct {
+	gin.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedWriter) WriteHeader(code int) {
+	w.status = code
+}
+
+func (w *bufferedWriter) WriteHeaderNow() {}
+
+func (w *bufferedWriter) Write(data []byte) (int, error) {
+	return w.body.Write(data)
+}
+
+func (w *bufferedWriter) WriteString(s string) (int, error) {
+	return w.body.WriteString(s)
+}
+
+func (w *bufferedWriter) Status() int {
+	if w.status != 0 {
+		return w.status
+	}
+	return w.ResponseWriter.Status()
+}
+
+func (w *bufferedWriter) Size() int {
+	return w.body.Len()
+}
+
+func (w *bufferedWriter) Written() bool {
+	return w.body.Len() > 0
+}
+
+// conditionalGet answers GET requests with 304 Not Modified when the client's
+// copy is still current, as given by If-None-Match or If-Modified-Since.
+// Actions may set the ETag and Last-Modified headers themselves, otherwise a
+// weak ETag is generated from the body.
+func conditionalGet(c *gin.Context) {
+	writer := c.Writer
+	buffered := &bufferedWriter{ResponseWriter: writer}
+	c.Writer = buffered
+	c.Next()
+	c.Writer = writer
+
+	status := buffered.Status()
+	header := writer.Header()
+	if status == http.StatusOK {
+		if header.Get("ETag") == "" {
+			header.Set("ETag", fmt.Sprintf("W/\"%x\"", sha1.Sum(buffered.body.Bytes())))
+		}
+		if cacheControl, ok := cacheControls[c.Param("resource")]; ok && header.Get("Cache-Control") == "" {
+			header.Set("Cache-Control", cacheControl)
+		}
+		// Drafts are only visible to their author, so shared caches must
+		// keep a copy per user
+		header.Add("Vary", "X-User-ID")
+		if notModified(c.Request, header) {
+			header.Del("Content-Type")
+			writer.WriteHeader(http.StatusNotModified)
+			writer.WriteHeaderNow()
+			return
+		}
+	}
+	writer.WriteHeader(status)
+	writer.Write(buffered.body.Bytes())
+}
+
+// notModified reports whether a request's preconditions show the client's copy
+// of a response with the given headers is current. If-Modified-Since is only
+// used when If-None-Match is not given.
+func notModified(request *http.Request, header http.Header) bool {
+	if ifNoneMatch := request.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		for _, tag := range strings.Split(ifNoneMatch, ",") {
+			tag = strings.TrimSpace(tag)
+			// If-None-Match uses weak comparison
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ifModifiedSince, err := http.ParseTime(request.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.After(ifModifiedSince)
+}
+
+// SetLastModified sets the Last-Modified header of the response. It is
+// truncated to seconds, the precision of HTTP dates.
+func SetLastModified(c *gin.Context, t time.Time) {
+	c.Header("Last-Modified", t.UTC().Format(http.TimeFormat))
+}
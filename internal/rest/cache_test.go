@@ -0,0 +1,137 @@
+package rest_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/willdady/postms/internal/errors"
+	"github.com/willdady/postms/internal/rest"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// lastModified is the Last-Modified time of the items served by
+// newCacheRouter.
+var lastModified = time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// newCacheRouter returns a router serving a list of items, whose ETag is
+// generated, and single items which give their own validators.
+func newCacheRouter() *gin.Engine {
+	r := gin.New()
+	rest.AttachEndpoints(rest.ResourceMap{
+		"items": rest.ActionMap{
+			"list": func(c *gin.Context) {
+				c.JSON(http.StatusOK, gin.H{"results": []int{1, 2}})
+			},
+			"detail": func(c *gin.Context) {
+				if c.GetInt64("ID") != 1 {
+					rest.AbortWithError(c, &errors.NotFound{})
+					return
+				}
+				c.Header("ETag", `"3-abc"`)
+				rest.SetLastModified(c, lastModified)
+				c.JSON(http.StatusOK, gin.H{"id": 1})
+			},
+			"*/private": func(c *gin.Context) {
+				c.Header("Cache-Control", "private, no-cache")
+				c.JSON(http.StatusOK, gin.H{"id": 1})
+			},
+		},
+	}, rest.CacheMap{"items": "public, max-age=60"}, r)
+	return r
+}
+
+// serve makes a request with the given headers, given as name and value
+// pairs.
+func serve(r *gin.Engine, method string, path string, body string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestConditionalGetHeaders(t *testing.T) {
+	r := newCacheRouter()
+
+	w := serve(r, "GET", "/items", "")
+	if w.Code != http.StatusOK || w.Body.String() != `{"results":[1,2]}` {
+		t.Fatalf("expected the list, got %d %s", w.Code, w.Body.String())
+	}
+	if etag := w.Header().Get("ETag"); !strings.HasPrefix(etag, `W/"`) {
+		t.Errorf("expected a weak ETag generated from the body, got %q", etag)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "public, max-age=60" {
+		t.Errorf("expected the Cache-Control of the resource, got %q", got)
+	}
+	if got := w.Header().Get("Vary"); got != "X-User-ID" {
+		t.Errorf("expected responses to vary on X-User-ID, got %q", got)
+	}
+
+	w = serve(r, "GET", "/items/1", "")
+	if got := w.Header().Get("ETag"); got != `"3-abc"` {
+		t.Errorf("expected the ETag set by the action, got %q", got)
+	}
+	if got := w.Header().Get("Last-Modified"); got != "Wed, 02 Jan 2019 03:04:05 GMT" {
+		t.Errorf("expected the Last-Modified set by the action, got %q", got)
+	}
+
+	w = serve(r, "GET", "/items/1/private", "")
+	if got := w.Header().Get("Cache-Control"); got != "private, no-cache" {
+		t.Errorf("expected the Cache-Control set by the action, got %q", got)
+	}
+
+	w = serve(r, "GET", "/items/2", "")
+	if w.Code != http.StatusNotFound || w.Header().Get("ETag") != "" || w.Header().Get("Cache-Control") != "" {
+		t.Errorf("expected errors to be sent without validators, got %d %v", w.Code, w.Header())
+	}
+}
+
+func TestConditionalGet(t *testing.T) {
+	r := newCacheRouter()
+	listETag := serve(r, "GET", "/items", "").Header().Get("ETag")
+	before := lastModified.Add(-time.Second).Format(http.TimeFormat)
+	after := lastModified.Add(time.Second).Format(http.TimeFormat)
+
+	tests := []struct {
+		path   string
+		header []string
+		want   int
+	}{
+		{"/items", []string{"If-None-Match", listETag}, http.StatusNotModified},
+		{"/items", []string{"If-None-Match", `W/"other"`}, http.StatusOK},
+		{"/items/1", []string{"If-None-Match", `"3-abc"`}, http.StatusNotModified},
+		{"/items/1", []string{"If-None-Match", `W/"3-abc"`}, http.StatusNotModified},
+		{"/items/1", []string{"If-None-Match", `"2-abc", "3-abc"`}, http.StatusNotModified},
+		{"/items/1", []string{"If-None-Match", `*`}, http.StatusNotModified},
+		{"/items/1", []string{"If-None-Match", `"2-abc"`}, http.StatusOK},
+		{"/items/1", []string{"If-Modified-Since", lastModified.Format(http.TimeFormat)}, http.StatusNotModified},
+		{"/items/1", []string{"If-Modified-Since", after}, http.StatusNotModified},
+		{"/items/1", []string{"If-Modified-Since", before}, http.StatusOK},
+		{"/items/1", []string{"If-Modified-Since", "yesterday"}, http.StatusOK},
+		// If-Modified-Since is ignored along with If-None-Match
+		{"/items/1", []string{"If-None-Match", `"2-abc"`, "If-Modified-Since", after}, http.StatusOK},
+		{"/items", []string{"If-Modified-Since", after}, http.StatusOK},
+		{"/items/2", []string{"If-None-Match", `*`}, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := serve(r, "GET", tt.path, "", tt.header...)
+		if w.Code != tt.want {
+			t.Errorf("GET %s with %v responded with %d, want %d", tt.path, tt.header, w.Code, tt.want)
+		}
+		if w.Code == http.StatusNotModified && (w.Body.Len() != 0 || w.Header().Get("Content-Type") != "") {
+			t.Errorf("GET %s with %v responded to 304 with a body: %v %s", tt.path, tt.header, w.Header(), w.Body.String())
+		}
+		if w.Code == http.StatusNotModified && w.Header().Get("ETag") == "" {
+			t.Errorf("GET %s with %v responded to 304 without an ETag", tt.path, tt.header)
+		}
+	}
+}
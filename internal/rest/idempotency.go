@@ -0,0 +1,113 @@
+package rest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/willdady/postms/internal/errors"
+	"github.com/willdady/postms/internal/postms/services"
+)
+
+// maxIdempotencyKeyLength is the longest Idempotency-Key accepted.
+const maxIdempotencyKeyLength = 255
+
+var idempotencyStore services.IdempotencyStore
+var idempotencyTTL time.Duration
+
+// UseIdempotencyStore enables the Idempotency-Key header for create requests,
+// keeping responses in store for ttl. It must be called before
+// AttachEndpoints.
+func UseIdempotencyStore(store services.IdempotencyStore, ttl time.Duration) {
+	idempotencyStore = store
+	idempotencyTTL = ttl
+}
+
+// idempotent answers retries of requests made with an Idempotency-Key with the
+// original response. Keys are scoped to the user and path, and reusing a key
+// for a different request is rejected. Responses with a 5xx status are not
+// stored so the request may be retried.
+func idempotent(c *gin.Context) {
+	key := c.GetHeader("Idempotency-Key")
+	if idempotencyStore == nil || key == "" {
+		return
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		AbortWithError(c, &errors.BadRequest{
+			Code:    "invalid_idempotency_key",
+			Message: fmt.Sprintf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLength),
+		})
+		return
+	}
+	body, err := c.GetRawData()
+	if err != nil {
+		AbortWithError(c, &errors.BadRequest{Message: err.Error()})
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	fingerprint := fmt.Sprintf("%x", sha256.Sum256(append([]byte(c.Request.Method+" "+c.Request.URL.Path+"\n"), body...)))
+	key = c.GetHeader("X-User-ID") + " " + c.Request.URL.Path + " " + key
+
+	record, claimed, err := idempotencyStore.Claim(key, fingerprint, time.Now().Add(-idempotencyTTL))
+	if err != nil {
+		AbortWithError(c, err)
+		return
+	}
+	if !claimed {
+		switch {
+		case record.Fingerprint != fingerprint:
+			AbortWithError(c, &errors.Unprocessable{
+				Code:    "idempotency_key_reused",
+				Message: "Idempotency-Key has already been used for a different request",
+			})
+		case record.Status == 0:
+			AbortWithError(c, &errors.Conflict{
+				Code:    "idempotency_key_in_progress",
+				Message: "A request with this Idempotency-Key is in progress",
+			})
+		default:
+			header := c.Writer.Header()
+			for name, values := range record.Header {
+				header[name] = values
+			}
+			header.Set("Idempotent-Replayed", "true")
+			c.Writer.WriteHeader(record.Status)
+			c.Writer.Write(record.Body)
+			c.Abort()
+		}
+		return
+	}
+
+	// The claim is released if the action panics, otherwise retries would be
+	// rejected as in progress until the key expires
+	completed := false
+	defer func() {
+		if !completed {
+			if err := idempotencyStore.Release(key); err != nil {
+				log.Printf("Failed to release idempotency key: %v\n", err)
+			}
+		}
+	}()
+
+	writer := c.Writer
+	buffered := &bufferedWriter{ResponseWriter: writer}
+	c.Writer = buffered
+	c.Next()
+	c.Writer = writer
+
+	status := buffered.Status()
+	if status < http.StatusInternalServerError {
+		if err := idempotencyStore.Complete(key, status, writer.Header().Clone(), buffered.body.Bytes()); err != nil {
+			log.Printf("Failed to store idempotent response: %v\n", err)
+		} else {
+			completed = true
+		}
+	}
+	writer.WriteHeader(status)
+	writer.Write(buffered.body.Bytes())
+}
@@ -0,0 +1,131 @@
+package rest_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/willdady/postms/internal/errors"
+	"github.com/willdady/postms/internal/postms/memory"
+	"github.com/willdady/postms/internal/rest"
+)
+
+// newIdempotentRouter returns a router whose create action is given by
+// create, storing idempotent responses in a new in-memory store.
+func newIdempotentRouter(create rest.Action) *gin.Engine {
+	rest.UseIdempotencyStore(memory.NewIdempotencyStore(), time.Hour)
+	r := gin.New()
+	r.Use(gin.RecoveryWithWriter(io.Discard))
+	rest.AttachEndpoints(rest.ResourceMap{
+		"items": rest.ActionMap{"create": create},
+	}, rest.CacheMap{}, r)
+	return r
+}
+
+// counter returns a create action responding with the number of times it has
+// been called.
+func counter(calls *int) rest.Action {
+	return func(c *gin.Context) {
+		*calls++
+		c.Header("Location", fmt.Sprintf("/items/%d", *calls))
+		c.JSON(http.StatusCreated, gin.H{"id": *calls})
+	}
+}
+
+func TestIdempotent(t *testing.T) {
+	calls := 0
+	r := newIdempotentRouter(counter(&calls))
+
+	tests := []struct {
+		name     string
+		header   []string
+		body     string
+		want     int
+		wantBody string
+		replayed bool
+	}{
+		{"without a key", nil, `{}`, http.StatusCreated, `{"id":1}`, false},
+		{"repeated without a key", nil, `{}`, http.StatusCreated, `{"id":2}`, false},
+		{"with a key", []string{"Idempotency-Key", "a"}, `{}`, http.StatusCreated, `{"id":3}`, false},
+		{"retried", []string{"Idempotency-Key", "a"}, `{}`, http.StatusCreated, `{"id":3}`, true},
+		{"with a different body", []string{"Idempotency-Key", "a"}, `{"x":1}`, http.StatusUnprocessableEntity, `"code":"idempotency_key_reused"`, false},
+		{"by another user", []string{"Idempotency-Key", "a", "X-User-ID", "other"}, `{}`, http.StatusCreated, `{"id":4}`, false},
+		{"retried by another user", []string{"Idempotency-Key", "a", "X-User-ID", "other"}, `{}`, http.StatusCreated, `{"id":4}`, true},
+		{"with a long key", []string{"Idempotency-Key", strings.Repeat("a", 256)}, `{}`, http.StatusBadRequest, `"code":"invalid_idempotency_key"`, false},
+	}
+	for _, tt := range tests {
+		w := serve(r, "POST", "/items", tt.body, tt.header...)
+		if w.Code != tt.want || !strings.Contains(w.Body.String(), tt.wantBody) {
+			t.Errorf("POST %s responded with %d %s, want %d containing %s", tt.name, w.Code, w.Body.String(), tt.want, tt.wantBody)
+		}
+		if replayed := w.Header().Get("Idempotent-Replayed") == "true"; replayed != tt.replayed {
+			t.Errorf("POST %s replayed %v, want %v", tt.name, replayed, tt.replayed)
+		}
+		if tt.replayed && w.Header().Get("Location") == "" {
+			t.Errorf("POST %s replayed without the original headers: %v", tt.name, w.Header())
+		}
+	}
+	if calls != 4 {
+		t.Errorf("expected 4 creates, got %d", calls)
+	}
+}
+
+func TestIdempotentRetriesFailures(t *testing.T) {
+	attempts, calls := 0, 0
+	create := counter(&calls)
+	r := newIdempotentRouter(func(c *gin.Context) {
+		switch attempts++; attempts {
+		case 1:
+			rest.AbortWithError(c, &errors.Unavailable{})
+		case 2:
+			panic("create failed")
+		default:
+			create(c)
+		}
+	})
+	header := []string{"Idempotency-Key", "a"}
+
+	if w := serve(r, "POST", "/items", `{}`, header...); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected the first request to fail, got %d %s", w.Code, w.Body.String())
+	}
+	if w := serve(r, "POST", "/items", `{}`, header...); w.Code != http.StatusInternalServerError {
+		t.Errorf("expected the second request to panic, got %d %s", w.Code, w.Body.String())
+	}
+	w := serve(r, "POST", "/items", `{}`, header...)
+	if w.Code != http.StatusCreated || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("expected failed requests to be retried, got %d %v %s", w.Code, w.Header(), w.Body.String())
+	}
+}
+
+func TestIdempotentInProgress(t *testing.T) {
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	r := newIdempotentRouter(func(c *gin.Context) {
+		close(started)
+		<-finish
+		c.JSON(http.StatusCreated, gin.H{"id": 1})
+	})
+	header := []string{"Idempotency-Key", "a"}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- serve(r, "POST", "/items", `{}`, header...)
+	}()
+	<-started
+	w := serve(r, "POST", "/items", `{}`, header...)
+	close(finish)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), `"code":"idempotency_key_in_progress"`) {
+		t.Errorf("expected a retry while in progress to conflict, got %d %s", w.Code, w.Body.String())
+	}
+	if w := <-done; w.Code != http.StatusCreated {
+		t.Errorf("expected the original request to succeed, got %d %s", w.Code, w.Body.String())
+	}
+	if w := serve(r, "POST", "/items", `{}`, header...); w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("expected the completed request to be replayed, got %d %v", w.Code, w.Header())
+	}
+}
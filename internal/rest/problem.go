@@ -0,0 +1,57 @@
+package rest
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/willdady/postms/internal/errors"
+)
+
+// Problem is an RFC 7807 problem details object, the body of every error
+// response. Code is a stable identifier of the error and Errors lists the
+// invalid fields of a request which failed validation.
+type Problem struct {
+	Type     string              `json:"type"`
+	Title    string              `json:"title"`
+	Status   int                 `json:"status"`
+	Detail   string              `json:"detail,omitempty"`
+	Instance string              `json:"instance,omitempty"`
+	Code     string              `json:"code"`
+	Errors   []errors.FieldError `json:"errors,omitempty"`
+}
+
+// retryAfter is implemented by errors which may be retried after a delay.
+type retryAfter interface {
+	RetryAfterDuration() time.Duration
+}
+
+// AbortWithError aborts the request with a problem+json response describing
+// err. Errors which are not of the errors package are logged and hidden from
+// the client behind a generic internal server error.
+func AbortWithError(c *gin.Context, err error) {
+	problem := Problem{Type: "about:blank", Instance: c.Request.URL.Path}
+	if e, ok := err.(errors.Error); ok {
+		problem.Status = e.StatusCode()
+		problem.Code = e.ErrorCode()
+		problem.Detail = e.Error()
+	} else {
+		log.Printf("Internal server error: %v\n", err)
+		problem.Status = http.StatusInternalServerError
+		problem.Code = "internal_error"
+		problem.Detail = "An internal server error occurred"
+	}
+	problem.Title = http.StatusText(problem.Status)
+	if e, ok := err.(*errors.Validation); ok {
+		problem.Errors = e.Fields
+	}
+	if e, ok := err.(retryAfter); ok && e.RetryAfterDuration() > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(e.RetryAfterDuration().Seconds()))))
+	}
+	// The Content-Type is only set by gin if it is not already
+	c.Header("Content-Type", "application/problem+json")
+	c.AbortWithStatusJSON(problem.Status, problem)
+}
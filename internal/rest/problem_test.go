@@ -0,0 +1,94 @@
+package rest_test
+
+import (
+	"encoding/json"
+	goerrors "errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/willdady/postms/internal/errors"
+	"github.com/willdady/postms/internal/rest"
+)
+
+func TestAbortWithError(t *testing.T) {
+	tests := []struct {
+		err        error
+		want       rest.Problem
+		retryAfter string
+	}{
+		{
+			errors.InvalidField("title", "required", "title is required"),
+			rest.Problem{
+				Type: "about:blank", Title: "Bad Request", Status: http.StatusBadRequest, Detail: "title is required",
+				Instance: "/items/1/fail", Code: "validation_failed",
+				Errors: []errors.FieldError{{Field: "title", Code: "required", Message: "title is required"}},
+			},
+			"",
+		},
+		{
+			&errors.SlugTaken{},
+			rest.Problem{
+				Type: "about:blank", Title: "Conflict", Status: http.StatusConflict, Detail: (&errors.SlugTaken{}).Error(),
+				Instance: "/items/1/fail", Code: "slug_taken",
+			},
+			"",
+		},
+		{
+			&errors.Unavailable{Code: "database_busy", RetryAfter: 1500 * time.Millisecond},
+			rest.Problem{
+				Type: "about:blank", Title: "Service Unavailable", Status: http.StatusServiceUnavailable,
+				Detail: "Service temporarily unavailable", Instance: "/items/1/fail", Code: "database_busy",
+			},
+			"2",
+		},
+		{
+			goerrors.New("pq: password authentication failed"),
+			rest.Problem{
+				Type: "about:blank", Title: "Internal Server Error", Status: http.StatusInternalServerError,
+				Detail: "An internal server error occurred", Instance: "/items/1/fail", Code: "internal_error",
+			},
+			"",
+		},
+	}
+	for _, tt := range tests {
+		r := gin.New()
+		rest.AttachEndpoints(rest.ResourceMap{
+			"items": rest.ActionMap{
+				"POST */fail": func(c *gin.Context) {
+					rest.AbortWithError(c, tt.err)
+				},
+			},
+		}, rest.CacheMap{}, r)
+
+		w := serve(r, "POST", "/items/1/fail", "")
+		if w.Code != tt.want.Status {
+			t.Errorf("AbortWithError(%v) responded with %d, want %d", tt.err, w.Code, tt.want.Status)
+		}
+		if got := w.Header().Get("Content-Type"); got != "application/problem+json" {
+			t.Errorf("AbortWithError(%v) responded with Content-Type %q", tt.err, got)
+		}
+		if got := w.Header().Get("Retry-After"); got != tt.retryAfter {
+			t.Errorf("AbortWithError(%v) responded with Retry-After %q, want %q", tt.err, got, tt.retryAfter)
+		}
+		var got rest.Problem
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("AbortWithError(%v) responded with invalid JSON %s: %v", tt.err, w.Body.String(), err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("AbortWithError(%v) responded with %+v, want %+v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestUnknownRoutesAreProblems(t *testing.T) {
+	r := newCacheRouter()
+	for _, path := range []string{"/missing", "/items/x", "/items/1/missing", "/a/b/c/d"} {
+		w := serve(r, "GET", path, "")
+		if w.Code != http.StatusNotFound || w.Header().Get("Content-Type") != "application/problem+json" {
+			t.Errorf("GET %s responded with %d %v, want a 404 problem", path, w.Code, w.Header())
+		}
+	}
+}
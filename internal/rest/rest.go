@@ -1,10 +1,10 @@
 package rest
 
 import (
-	"net/http"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
+	"github.com/willdady/postms/internal/errors"
 )
 
 type Action func(c *gin.Context)
@@ -16,7 +16,7 @@ type ResourceMap map[string]ActionMap
 var resources ResourceMap
 
 func notFound(c *gin.Context) {
-	c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"status": http.StatusNotFound, "message": "Not found"})
+	AbortWithError(c, &errors.NotFound{})
 }
 
 func createAction(c *gin.Context) {
@@ -53,6 +53,28 @@ func updateAction(c *gin.Context) {
 	action(c)
 }
 
+// patchAction handles PATCH requests, which change part of a resource. The
+// action is looked up in the ActionMap using the key "patch".
+func patchAction(c *gin.Context) {
+	resource, exists := resources[c.Param("resource")]
+	if exists == false {
+		notFound(c)
+		return
+	}
+	action, exists := resource["patch"]
+	if exists == false {
+		notFound(c)
+		return
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		notFound(c)
+		return
+	}
+	c.Set("ID", id)
+	action(c)
+}
+
 func detailAction(c *gin.Context) {
 	resource, exists := resources[c.Param("resource")]
 	if exists == false {
@@ -93,12 +115,49 @@ func listChildAction(c *gin.Context) {
 		notFound(c)
 		return
 	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		lookupAction(c, resource)
+		return
+	}
 	child := c.Param("child")
 	action, exists := resource["*/"+child]
 	if exists == false {
 		notFound(c)
 		return
 	}
+	c.Set("ID", id)
+	action(c)
+}
+
+// lookupAction handles GET requests which find a resource by something other
+// than its ID, such as /posts/by-slug/:slug. The action is looked up in the
+// ActionMap using a key of the form "by-slug/*" and the value is set as "Key".
+func lookupAction(c *gin.Context, resource ActionMap) {
+	action, exists := resource[c.Param("id")+"/*"]
+	if exists == false {
+		notFound(c)
+		return
+	}
+	c.Set("Key", c.Param("child"))
+	action(c)
+}
+
+// childCommandAction handles POST requests to a child of a resource, such as
+// an action which changes its state. The action is looked up in the ActionMap
+// using a key of the form "POST */child".
+func childCommandAction(c *gin.Context) {
+	resource, exists := resources[c.Param("resource")]
+	if exists == false {
+		notFound(c)
+		return
+	}
+	child := c.Param("child")
+	action, exists := resource["POST */"+child]
+	if exists == false {
+		notFound(c)
+		return
+	}
 	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
 	if err != nil {
 		notFound(c)
@@ -129,12 +188,16 @@ func deleteAction(c *gin.Context) {
 }
 
 // See https://www.openmymind.net/RESTful-routing-in-Go/
-func AttachEndpoints(resourceMap ResourceMap, r *gin.Engine) {
+func AttachEndpoints(resourceMap ResourceMap, cacheMap CacheMap, r *gin.Engine) {
 	resources = resourceMap
-	r.POST("/:resource", createAction)
-	r.GET("/:resource", listAction)
-	r.GET("/:resource/:id", detailAction)
-	r.GET("/:resource/:id/:child", listChildAction)
+	cacheControls = cacheMap
+	r.POST("/:resource", idempotent, createAction)
+	r.GET("/:resource", conditionalGet, listAction)
+	r.GET("/:resource/:id", conditionalGet, detailAction)
+	r.GET("/:resource/:id/:child", conditionalGet, listChildAction)
+	r.POST("/:resource/:id/:child", childCommandAction)
 	r.DELETE("/:resource/:id", deleteAction)
 	r.PUT("/:resource/:id", updateAction)
+	r.PATCH("/:resource/:id", patchAction)
+	r.NoRoute(notFound)
 }
@@ -4,6 +4,8 @@ import (
 	"encoding/base64"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/gosimple/slug"
 )
@@ -13,6 +15,36 @@ func UintToBase64(val uint) string {
 	return base64.StdEncoding.EncodeToString(data)
 }
 
+// EncodeCursor encodes values as an opaque pagination cursor. A cursor holding
+// a single value is identical to one produced by UintToBase64.
+func EncodeCursor(values ...int64) string {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i] = strconv.FormatInt(value, 10)
+	}
+	return base64.StdEncoding.EncodeToString([]byte(strings.Join(parts, ",")))
+}
+
+// DecodeCursor decodes a cursor produced by EncodeCursor, returning an error if
+// it does not hold exactly n values.
+func DecodeCursor(cursor string, n int) ([]int64, error) {
+	data, err := base64.StdEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(string(data), ",")
+	if len(parts) != n {
+		return nil, fmt.Errorf("expected %d cursor values, got %d", n, len(parts))
+	}
+	values := make([]int64, n)
+	for i, part := range parts {
+		if values[i], err = strconv.ParseInt(part, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
 func Getenv(key string, fallback string) string {
 	if value, ok := os.LookupEnv(key); ok {
 		return value